@@ -0,0 +1,109 @@
+package gauthbox
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"time"
+)
+
+const CURRENT_DRIVER_GPIO = "gpio"
+const CURRENT_DRIVER_MCP3008 = "mcp3008"
+
+// Number of back-to-back samples per RMS measurement, covering a few mains cycles.
+const ADC_RMS_SAMPLES = 500
+const ADC_DEFAULT_INTERVAL = 500 * time.Millisecond
+
+// Switching back to low below that fraction of the threshold, by default.
+const ADC_HYSTERESIS_RATIO = 0.8
+
+type adcConfig struct {
+	SpiBus        int `json:"spi_bus"`
+	SpiChipSelect int `json:"spi_cs"`
+	Channel       int `json:"channel"`
+	// Conversion from RMS ADC counts to Amps, depends on the CT clamp and burden resistor.
+	AmpsPerCount  float64 `json:"amps_per_count"`
+	ThresholdAmps float64 `json:"threshold_amps"`
+	// Switching back to low below that fraction of the threshold, defaults to ADC_HYSTERESIS_RATIO.
+	HysteresisRatio float64 `json:"hysteresis_ratio,omitempty"`
+	IntervalMs      uint32  `json:"interval_ms,omitempty"`
+}
+
+// Reads a single-ended 10-bit sample from the MCP3008 channel.
+func mcp3008Read(dev *spiDevice, channel int) (int, error) {
+	w := []byte{0x01, byte(0x08|channel) << 4, 0x00}
+	r := make([]byte, len(w))
+	if err := dev.Tx(w, r); err != nil {
+		return 0, err
+	}
+	return int(r[1]&0x03)<<8 | int(r[2]), nil
+}
+
+// Analog current sensing through an MCP3008 ADC and a CT clamp. Sends high/low
+// transitions of the RMS current compared to the threshold with 'send'. The
+// looper returns once ctx is done, closing the SPI device.
+func mcp3008CurrentSensing(ctx context.Context, c adcConfig, send func(high bool)) (func(), error) {
+	dev, err := openSpiDevice(c.SpiBus, c.SpiChipSelect, 1_000_000)
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Duration(c.IntervalMs) * time.Millisecond
+	if interval == 0 {
+		interval = ADC_DEFAULT_INTERVAL
+	}
+	hysteresis := c.HysteresisRatio
+	if hysteresis == 0 {
+		hysteresis = ADC_HYSTERESIS_RATIO
+	}
+	return func() {
+		defer dev.Close()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		alive := time.NewTicker(LIVENESS_INTERVAL)
+		defer alive.Stop()
+		Beat("current_sensor")
+		high := false
+		samples := make([]float64, ADC_RMS_SAMPLES)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-alive.C:
+				Beat("current_sensor")
+				continue
+			case <-ticker.C:
+			}
+			var sum float64
+			var err error
+			for i := range samples {
+				var v int
+				if v, err = mcp3008Read(dev, c.Channel); err != nil {
+					break
+				}
+				samples[i] = float64(v)
+				sum += samples[i]
+			}
+			if err != nil {
+				slog.Warn("adc: could not read sample", slog.Any("err", err))
+				continue
+			}
+			// The CT clamp signal is centered around the bias voltage: remove it.
+			mean := sum / float64(len(samples))
+			var squares float64
+			for _, v := range samples {
+				squares += (v - mean) * (v - mean)
+			}
+			amps := math.Sqrt(squares/float64(len(samples))) * c.AmpsPerCount
+			switch {
+			case !high && amps > c.ThresholdAmps:
+				high = true
+			case high && amps < c.ThresholdAmps*hysteresis:
+				high = false
+			default:
+				continue
+			}
+			slog.Debug("adc: current transition", slog.Float64("amps", amps), slog.Bool("high", high))
+			send(high)
+		}
+	}, nil
+}
@@ -0,0 +1,188 @@
+package gauthbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the conditions that do not change the state, e.g. the badge reader
+// going missing, are checked.
+const ALERT_CHECK_INTERVAL = 10 * time.Second
+const ALERT_DEFAULT_AUTH_BACKEND_DOWN = 5 * time.Minute
+
+// How many alerts are queued while the webhooks are unreachable.
+const ALERT_QUEUE_SIZE = 50
+
+// Alert conditions.
+const ALERT_READER_MISSING = "reader_missing"
+const ALERT_RELAY_FEEDBACK = "relay_feedback_mismatch"
+const ALERT_AUTH_BACKEND_DOWN = "auth_backend_down"
+
+// One-off: an interlock, e.g. an e-stop, ended the session.
+const ALERT_INTERLOCK_TRIPPED = "interlock_tripped"
+
+// One-off: a temperature sensor became unreadable and is considered over temperature.
+const ALERT_TEMPERATURE_SENSOR_FAILED = "temperature_sensor_failed"
+
+// Webhook notifications of failure conditions, for spaces without Home
+// Assistant automations.
+type alertsConfig struct {
+	Webhooks []alertWebhookConfig `json:"webhooks"`
+	// How long the badge auth backend must be unreachable before alerting.
+	// Defaults to ALERT_DEFAULT_AUTH_BACKEND_DOWN.
+	AuthBackendDownS uint32 `json:"auth_backend_down_s,omitempty"`
+}
+
+type alertWebhookConfig struct {
+	// Alerts are POSTed to it as JSON.
+	Url string `json:"url"`
+	// ALERT_* conditions to notify, all if empty.
+	Conditions []string `json:"conditions,omitempty"`
+}
+
+// A condition was raised or cleared, as posted to the webhooks.
+type Alert struct {
+	Box       string `json:"box"`
+	Condition string `json:"condition"`
+	// Whether the condition was raised, false once it cleared. Always true for
+	// one-off conditions.
+	Active bool      `json:"active"`
+	Detail string    `json:"detail,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+func postAlert(url string, a Alert) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), EVENTS_POST_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// Active conditions of the health, by condition, with their detail.
+func alertConditions(h Health, authDown bool) map[string]string {
+	active := map[string]string{}
+	if !h.BadgeReader {
+		active[ALERT_READER_MISSING] = "badge reader not readable"
+	}
+	if len(h.WiringFaults) > 0 {
+		active[ALERT_RELAY_FEEDBACK] = "relays: " + strings.Join(h.WiringFaults, ", ")
+	}
+	if authDown {
+		active[ALERT_AUTH_BACKEND_DOWN] = "auth backend " + h.AuthBackend
+	}
+	return active
+}
+
+// Alert webhooks logic. Report the health with the returned check func, on
+// each state change; it is checked again every ALERT_CHECK_INTERVAL. Raise
+// one-off conditions with the returned raise func. Alerts are posted when a
+// condition is raised and when it clears, in order, to the webhooks that want
+// it.
+func AlertWebhooks(c alertsConfig, name string) (func(), func(Health), func(condition, detail string)) {
+	authDownAfter := time.Duration(c.AuthBackendDownS) * time.Second
+	if authDownAfter == 0 {
+		authDownAfter = ALERT_DEFAULT_AUTH_BACKEND_DOWN
+	}
+	queue := make(chan Alert, ALERT_QUEUE_SIZE)
+	enqueue := func(a Alert) {
+		select {
+		case queue <- a:
+		default:
+			slog.Warn("alert queue full, dropping alert", slog.String("condition", a.Condition))
+		}
+	}
+
+	var mu sync.Mutex
+	// Nil until the first report.
+	var last *Health
+	var authDownSince time.Time
+	active := map[string]string{}
+	check := func(h Health) {
+		mu.Lock()
+		defer mu.Unlock()
+		last = &h
+		now := time.Now()
+		if h.AuthBackend == "unreachable" || h.AuthBackend == "failing" {
+			if authDownSince.IsZero() {
+				authDownSince = now
+			}
+		} else {
+			authDownSince = time.Time{}
+		}
+		current := alertConditions(h, !authDownSince.IsZero() && now.Sub(authDownSince) >= authDownAfter)
+		for condition, detail := range current {
+			if _, ok := active[condition]; !ok {
+				slog.Warn("alert raised", slog.String("condition", condition), slog.String("detail", detail))
+				enqueue(Alert{Box: name, Condition: condition, Active: true, Detail: detail, Time: now})
+			}
+		}
+		for condition := range active {
+			if _, ok := current[condition]; !ok {
+				slog.Info("alert cleared", slog.String("condition", condition))
+				enqueue(Alert{Box: name, Condition: condition, Active: false, Time: now})
+			}
+		}
+		active = current
+	}
+	raise := func(condition, detail string) {
+		slog.Warn("alert raised", slog.String("condition", condition), slog.String("detail", detail))
+		enqueue(Alert{Box: name, Condition: condition, Active: true, Detail: detail, Time: time.Now()})
+	}
+
+	looper := func() {
+		go func() {
+			for {
+				time.Sleep(ALERT_CHECK_INTERVAL)
+				mu.Lock()
+				h := last
+				mu.Unlock()
+				if h != nil {
+					check(h.Refresh())
+				}
+			}
+		}()
+		for a := range queue {
+			for _, w := range c.Webhooks {
+				if len(w.Conditions) > 0 && !slices.Contains(w.Conditions, a.Condition) {
+					continue
+				}
+				for attempt := 1; ; attempt++ {
+					err := postAlert(w.Url, a)
+					if err == nil {
+						break
+					}
+					if attempt == EVENTS_ATTEMPTS {
+						slog.Warn("could not post alert, dropping it", slog.String("url", w.Url), slog.Any("err", err))
+						break
+					}
+					time.Sleep(EVENTS_RETRY_DELAY)
+				}
+			}
+		}
+	}
+	return looper, check, raise
+}
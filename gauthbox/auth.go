@@ -0,0 +1,262 @@
+package gauthbox
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// The badge authentication of the sessions: decides what a scanned badge does,
+// authenticates it, keeps track of the real utilization with extend calls,
+// enforces the maximum session duration and returns the unused minutes.
+// Owns the extendDeadline, sessionDeadline, pendingBadgeId and peerBadges
+// fields of the state.
+type SessionAuth struct {
+	config  *AuthboxConfig
+	name    string
+	publish PublishFunc
+	state   *State
+	bus     *Bus
+	// Badge expiry window, and maximum session duration if non-zero.
+	extend, max time.Duration
+	// Fires when the badge expiry window is over.
+	expired *BusTimer
+	// Fires when the maximum session duration is reached.
+	over *BusTimer
+}
+
+func NewSessionAuth(config *AuthboxConfig, name string, publish PublishFunc, state *State) *SessionAuth {
+	return &SessionAuth{
+		config:  config,
+		name:    name,
+		publish: publish,
+		state:   state,
+		extend:  time.Duration(config.BadgeAuth.UsageMinutes) * time.Minute,
+		max:     time.Duration(config.MaxSessionMinutes) * time.Minute,
+	}
+}
+
+// Subscribes to the badge scans and to the session events that start, extend
+// and end the badge authentication.
+func (a *SessionAuth) Subscribe(bus *Bus) {
+	a.bus = bus
+	a.expired = bus.NewTimer(a.onExpired)
+	a.over = bus.NewTimer(a.onOver)
+	Subscribe(bus, a.onBadge)
+	Subscribe(bus, func(e PeerUpdated) { a.state.peerBadges.Update(e.Event) })
+	Subscribe(bus, func(e SessionStarted) {
+		if e.Previous != "" {
+			go a.returnBadge(e.Previous)
+		}
+		if e.BadgeId != "" {
+			a.start()
+		}
+	})
+	Subscribe(bus, func(e SessionRestored) { a.resume(e.Session.ExtendDeadline, e.Session.SessionDeadline) })
+	Subscribe(bus, func(SessionExtended) { a.extendSession() })
+	Subscribe(bus, func(e MachineInUse) {
+		if !e.InUse && a.state.pendingBadgeId != "" {
+			a.handOver()
+		}
+	})
+	Subscribe(bus, func(e SessionEnded) {
+		a.expired.Stop()
+		a.over.Stop()
+		a.state.pendingBadgeId = ""
+		if e.Exiting {
+			// Synchronously, to not lose the return call.
+			a.returnBadge(e.BadgeId)
+		} else {
+			go a.returnBadge(e.BadgeId)
+		}
+	})
+}
+
+// Like BadgeAuthContext, also publishing the outcome and latency.
+func (a *SessionAuth) authenticate(ctx context.Context, badgeId string, action string) (*BadgeAuthResult, error) {
+	start := time.Now()
+	auth, err := BadgeAuthContext(ctx, a.config.BadgeAuth, badgeId, action)
+	go PublishAuthOutcome(AuthOutcome(err), time.Since(start), a.name, a.publish)
+	return auth, err
+}
+
+// Someone badged.
+func (a *SessionAuth) onBadge(e BadgeScanned) {
+	s, badgeId := a.state, e.BadgeId
+	if a.config.ExtendOnBadge && s.state != STATE_OFF && badgeId == s.badgeId && !s.dormant &&
+		!(a.config.BadgeOut && s.state == STATE_IDLE) {
+		// The member explicitly keeps the session authorized, e.g. for a long job.
+		slog.Info("session extended by badge", BadgeAttr("id", badgeId))
+		Publish(a.bus, SessionExtended{BadgeId: badgeId})
+		Publish(a.bus, StateUpdated{})
+		Publish(a.bus, DisplayMessage{Text: "Extended"})
+		return
+	}
+	if s.state == STATE_IN_USE {
+		// If the tool is already in active use, nothing to do, unless
+		// someone else wants to take over once the machine stops.
+		if a.config.TransferOnBadge && badgeId != s.badgeId {
+			slog.Info("session handover pending", BadgeAttr("from", s.badgeId), BadgeAttr("to", badgeId))
+			s.pendingBadgeId = badgeId
+			Publish(a.bus, DisplayMessage{Text: "Handover pending"})
+		}
+		return
+	}
+	if a.config.BadgeOut && s.state == STATE_IDLE && !s.dormant && badgeId == s.badgeId {
+		// The member is done, no need to wait for the idle timeout.
+		slog.Info("badged out", BadgeAttr("id", badgeId))
+		Publish(a.bus, EndSession{})
+		return
+	}
+	if reason := a.refusal(badgeId); reason != "" {
+		Publish(a.bus, BadgeDenied{BadgeId: badgeId, Reason: reason})
+		return
+	}
+	if badgeId != s.badgeId && a.inUseElsewhere(badgeId) {
+		return
+	}
+	// Otherwise, the tool is either OFF or in grace period (IDLE).
+	// Authenticate and switch the relay.
+	ctx, span := StartSpan(context.Background(), "badge")
+	auth, err := a.authenticate(ctx, badgeId, BADGE_ACTION_INITIAL)
+	if err != nil {
+		// Blink the red LED a few times to provide “access denied” feedback.
+		slog.Warn("error authenticating badge", BadgeAttr("id", badgeId), slog.Any("error", err))
+		Publish(a.bus, BadgeDenied{BadgeId: badgeId, Reason: "Access denied"})
+	} else {
+		// All good, power the machine and start IDLEing.
+		_, powerSpan := StartSpan(ctx, "power_on")
+		Publish(a.bus, StartSession{BadgeId: badgeId, MemberName: auth.MemberName, IdleOverride: time.Duration(auth.IdleSeconds) * time.Second})
+		powerSpan.End(nil)
+		metricsBadgeToPower(Clk.Now().Sub(e.Time))
+	}
+	span.End(err)
+}
+
+// Returns why the badge may not start or renew a session, empty if it may.
+func (a *SessionAuth) refusal(badgeId string) string {
+	s := a.state
+	if len(s.wiringFaults) > 0 {
+		// A relay does not do what it is told: do not start or renew sessions until fixed.
+		slog.Warn("refusing badge, relay wiring fault", BadgeAttr("id", badgeId))
+		return "Wiring fault"
+	}
+	if s.lockout != "" {
+		slog.Warn("refusing badge, locked out", BadgeAttr("id", badgeId), slog.String("reason", s.lockout))
+		return "Out of service"
+	}
+	if s.curfewClosed && (s.state == STATE_OFF || badgeId != s.badgeId) {
+		// The ongoing session may continue, but no new one starts.
+		slog.Warn("refusing badge, curfew", BadgeAttr("id", badgeId))
+		return "Curfew"
+	}
+	if id, _ := trippedInterlock(a.config, s); id != "" {
+		// Without a grace period, the interlock must be satisfied to start.
+		slog.Warn("refusing badge, interlock not satisfied", BadgeAttr("id", badgeId), slog.String("interlock", id))
+		return "Interlock " + id
+	}
+	if s.overheatCutoff() {
+		// Do not start or renew sessions until the machine has cooled down.
+		slog.Warn("refusing badge, over temperature", BadgeAttr("id", badgeId))
+		return "Too hot"
+	}
+	return ""
+}
+
+// Returns whether the badge is denied by anti-passback, with feedback.
+func (a *SessionAuth) inUseElsewhere(badgeId string) bool {
+	if a.config.AntiPassback == nil || !a.state.peerBadges.Denies(*a.config.AntiPassback, badgeId) {
+		return false
+	}
+	slog.Warn("refusing badge, already in use elsewhere", BadgeAttr("id", badgeId))
+	Publish(a.bus, BadgeDenied{BadgeId: badgeId, Reason: "In use elsewhere"})
+	return true
+}
+
+// Hands the session over to the pending badge, if it is authorized.
+func (a *SessionAuth) handOver() {
+	s := a.state
+	badgeId := s.pendingBadgeId
+	s.pendingBadgeId = ""
+	if a.inUseElsewhere(badgeId) {
+		return
+	}
+	auth, err := a.authenticate(context.Background(), badgeId, BADGE_ACTION_INITIAL)
+	if err != nil {
+		// The current member keeps the session.
+		slog.Warn("error authenticating badge for handover", BadgeAttr("id", badgeId), slog.Any("error", err))
+		Publish(a.bus, BadgeDenied{BadgeId: badgeId, Reason: "Access denied"})
+		return
+	}
+	slog.Info("session handed over", BadgeAttr("from", s.badgeId), BadgeAttr("to", badgeId))
+	Publish(a.bus, StartSession{BadgeId: badgeId, MemberName: auth.MemberName, IdleOverride: time.Duration(auth.IdleSeconds) * time.Second})
+}
+
+// Starts the extend and maximum duration timers of a new session.
+func (a *SessionAuth) start() {
+	s := a.state
+	a.expired.Reset(a.extend)
+	s.extendDeadline = Clk.Now().Add(a.extend)
+	s.sessionDeadline = time.Time{}
+	if a.max > 0 {
+		a.over.Reset(a.max)
+		s.sessionDeadline = Clk.Now().Add(a.max)
+	}
+}
+
+// Restarts the badge expiry window and authenticates again in the background.
+// This is only to accurately keep track of the real utilization duration.
+func (a *SessionAuth) extendSession() {
+	a.expired.Reset(a.extend)
+	a.state.extendDeadline = Clk.Now().Add(a.extend)
+	go func(badgeId string) {
+		_, err := a.authenticate(context.Background(), badgeId, BADGE_ACTION_EXTEND)
+		if err != nil {
+			// That extend call is only for informational purposes.
+			// Do not cut off power if that fails. Stopping a machine while in use can be dangerous or expensive.
+			slog.Warn("error authenticating badge for extend", BadgeAttr("id", badgeId), slog.Any("error", err))
+		}
+	}(a.state.badgeId)
+}
+
+// Restarts the timers of a restored session with its deadlines.
+func (a *SessionAuth) resume(extendDeadline, sessionDeadline time.Time) {
+	a.expired.Reset(extendDeadline.Sub(Clk.Now()))
+	a.state.extendDeadline = extendDeadline
+	if !sessionDeadline.IsZero() {
+		a.over.Reset(sessionDeadline.Sub(Clk.Now()))
+		a.state.sessionDeadline = sessionDeadline
+	}
+}
+
+// Returns the unused minutes of the badge, if any.
+func (a *SessionAuth) returnBadge(badgeId string) {
+	if badgeId == "" {
+		// Open access.
+		return
+	}
+	_, err := a.authenticate(context.Background(), badgeId, BADGE_ACTION_RETURN)
+	if err != nil {
+		// That return call is only for informational purposes.
+		slog.Warn("error authenticating badge for return", BadgeAttr("id", badgeId), slog.Any("error", err))
+	}
+}
+
+// The badge authentication duration (e.g. 10 minutes) has expired.
+func (a *SessionAuth) onExpired() {
+	if a.state.state == STATE_OFF {
+		return
+	}
+	a.extendSession()
+	Publish(a.bus, StateUpdated{})
+}
+
+// The maximum session duration is reached, regardless of extends.
+func (a *SessionAuth) onOver() {
+	if a.state.state == STATE_OFF {
+		return
+	}
+	slog.Info("maximum session duration reached", BadgeAttr("id", a.state.badgeId))
+	// Do not stop a machine in use: warn, and power off once it stops.
+	Publish(a.bus, EndSession{Graceful: true, Message: "Time's up"})
+}
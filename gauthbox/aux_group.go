@@ -0,0 +1,126 @@
+package gauthbox
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Sub-topic prefix on which each box of a group publishes whether it is in
+// use, as '<topic>/<name>/aux_group/<group>', retained.
+const AUX_GROUP_TOPIC = "aux_group"
+
+const RELAY_ROLE_SHARED = "shared"
+
+// Shared auxiliary equipment, e.g. a dust collector serving several tools.
+// Coordinated over MQTT: the device runs while any box of the group is in use,
+// and stops once all are idle plus the off delay.
+type auxGroupConfig struct {
+	Group string `json:"group"`
+	// Set on the one box driving the shared device.
+	Relay     *relayConfig `json:"relay,omitempty"`
+	OffDelayS uint32       `json:"off_delay_s,omitempty"`
+}
+
+// Returns the shared device relay config, with its role.
+func (c auxGroupConfig) RelayConfig() relayConfig {
+	r := *c.Relay
+	r.Role = RELAY_ROLE_SHARED
+	return r
+}
+
+// What is known of a box of the group, as retained messages arrive in any order.
+type auxGroupMember struct {
+	InUse  bool
+	Online bool
+}
+
+// Boxes of the group, by name, including this one. Other boxes are tracked too,
+// but never in use.
+type AuxGroupMembers map[string]auxGroupMember
+
+// Tracks whether another box of the group is in use or online.
+func (m AuxGroupMembers) Update(group string, e MqttEvent) {
+	member := m[e.Peer]
+	switch e.Command {
+	case AUX_GROUP_TOPIC + "/" + group:
+		member.InUse = e.Payload == "ON"
+	case "availability":
+		member.Online = e.Payload == "online"
+	default:
+		return
+	}
+	m[e.Peer] = member
+}
+
+// Returns whether any online box of the group is in use.
+func (m AuxGroupMembers) AnyInUse() bool {
+	for _, member := range m {
+		if member.InUse && member.Online {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs the shared equipment while any box of the group is in use, and stops
+// it after the off delay once none is. Only on the box driving it.
+type AuxGroup struct {
+	config  auxGroupConfig
+	name    string
+	publish PublishFunc
+	relay   *DeviceRet[bool]
+	isOn    chan<- bool
+	on      bool
+	members AuxGroupMembers
+	// Whether off is due once the delay elapsed.
+	offPending bool
+	off        *BusTimer
+}
+
+func NewAuxGroup(config auxGroupConfig, name string, publish PublishFunc, relay *DeviceRet[bool], isOn chan<- bool, on bool) *AuxGroup {
+	return &AuxGroup{config: config, name: name, publish: publish, relay: relay, isOn: isOn, on: on, members: AuxGroupMembers{}}
+}
+
+func (a *AuxGroup) Subscribe(bus *Bus) {
+	a.off = bus.NewTimer(func() {
+		// The group has been idle for the off delay.
+		a.offPending = false
+		if a.on && !a.members.AnyInUse() {
+			a.set(false)
+		}
+	})
+	Subscribe(bus, func(e StateChanged) {
+		a.members[a.name] = auxGroupMember{InUse: e.State.state == STATE_IN_USE, Online: true}
+		a.update()
+	})
+	Subscribe(bus, func(e PeerUpdated) {
+		a.members.Update(a.config.Group, e.Event)
+		a.update()
+	})
+}
+
+func (a *AuxGroup) update() {
+	switch {
+	case a.members.AnyInUse():
+		a.off.Stop()
+		a.offPending = false
+		if !a.on {
+			a.set(true)
+		}
+	case a.on && !a.offPending:
+		a.offPending = true
+		a.off.Reset(time.Duration(a.config.OffDelayS) * time.Second)
+	}
+}
+
+func (a *AuxGroup) set(on bool) {
+	slog.Info("shared equipment", slog.String("group", a.config.Group), slog.Bool("on", on))
+	a.on = on
+	a.isOn <- on
+	go a.relay.OnEvent(on, a.name, a.publish)
+}
+
+// Publishes whether this box is in use to the group.
+func PublishAuxGroupInUse(group string, inUse bool, name string, publish PublishFunc) {
+	publish(name+"/"+AUX_GROUP_TOPIC+"/"+group, MqttRetained{Payload: map[bool]string{false: "OFF", true: "ON"}[inUse]})
+}
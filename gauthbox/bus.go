@@ -0,0 +1,283 @@
+package gauthbox
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Publish/subscribe of state machine events. The state machine loop publishes
+// the inputs of the devices; each behavior (a decision like the door interlock
+// or the curfew, or a side effect like telemetry or feedback) is a handler
+// reacting to them and publishing its own events in turn.
+// Dispatch is synchronous, on the state machine goroutine, in subscription
+// order: handlers must not block, and can read the state without locking.
+type Bus struct {
+	handlers map[reflect.Type][]func(any)
+
+	mu sync.Mutex
+	// Timers that fired, for the state machine loop to run.
+	due   []dueTimer
+	ready chan struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{handlers: map[reflect.Type][]func(any){}, ready: make(chan struct{}, 1)}
+}
+
+// Calls the handler for each published event of type E.
+func Subscribe[E any](b *Bus, handler func(E)) {
+	t := reflect.TypeFor[E]()
+	b.handlers[t] = append(b.handlers[t], func(e any) { handler(e.(E)) })
+}
+
+// Calls the handlers subscribed to events of type E.
+func Publish[E any](b *Bus, e E) {
+	for _, h := range b.handlers[reflect.TypeFor[E]()] {
+		h(e)
+	}
+}
+
+// A timer of a handler: its function is called on the state machine goroutine,
+// like the handlers. Stopping or resetting the timer drops a call already due.
+type BusTimer struct {
+	bus   *Bus
+	f     func()
+	timer Timer
+	// Incremented on each stop and reset, to tell the calls still due.
+	gen uint64
+}
+
+type dueTimer struct {
+	t   *BusTimer
+	gen uint64
+}
+
+// Returns a stopped timer calling f.
+func (b *Bus) NewTimer(f func()) *BusTimer {
+	return &BusTimer{bus: b, f: f}
+}
+
+// Calls f once d elapsed, unless stopped or reset before.
+func (t *BusTimer) Reset(d time.Duration) {
+	t.Stop()
+	gen := t.gen
+	t.timer = Clk.AfterFunc(d, func() { t.bus.fire(dueTimer{t, gen}) })
+}
+
+func (t *BusTimer) Stop() {
+	t.gen++
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
+
+func (b *Bus) fire(d dueTimer) {
+	b.mu.Lock()
+	b.due = append(b.due, d)
+	b.mu.Unlock()
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Yields when timers fired: the state machine loop then calls RunTimers.
+func (b *Bus) TimersDue() <-chan struct{} {
+	return b.ready
+}
+
+// Calls the functions of the timers that fired and were not stopped or reset
+// since, in the order they fired.
+func (b *Bus) RunTimers() {
+	b.mu.Lock()
+	due := b.due
+	b.due = nil
+	b.mu.Unlock()
+	for _, d := range due {
+		if d.gen == d.t.gen {
+			d.t.timer = nil
+			d.t.f()
+		}
+	}
+}
+
+// Inputs, published by the state machine loop as the devices report them.
+
+// The devices are set up: the handlers resume what they persisted and bring
+// the outputs in line with the state.
+type Started struct{}
+
+// A badge was scanned at Time.
+type BadgeScanned struct {
+	BadgeId string
+	Time    time.Time
+}
+
+// Current sensing went up or down.
+type CurrentSensed struct {
+	High bool
+}
+
+// A new tachometer reading.
+type TachometerRead struct {
+	Reading TachometerReading
+}
+
+// The door or enclosure was opened or closed.
+type DoorSensed struct {
+	Closed bool
+}
+
+// The button was pressed or released.
+type ButtonPressed struct {
+	Pressed bool
+}
+
+// The maintenance bypass key was turned, or the bypass toggled from the
+// console. Reason tells why it ends.
+type BypassSwitched struct {
+	On     bool
+	Reason string
+}
+
+// A new temperature reading.
+type TemperatureRead struct {
+	Reading TemperatureReading
+}
+
+// An interlock became satisfied or not.
+type InterlockSensed struct {
+	State InterlockState
+}
+
+// The run gate or stop button changed.
+type RunGateSensed struct {
+	Input RunInput
+}
+
+// A relay's auxiliary contact disagrees with its commanded state, or agrees again.
+type RelayFaulted struct {
+	Fault RelayFault
+}
+
+// A command received over MQTT, the local HTTP API or the debug console.
+type CommandReceived struct {
+	Command string
+	Payload string
+}
+
+// Another box published its active badge, use or availability.
+type PeerUpdated struct {
+	Event MqttEvent
+}
+
+// The MQTT broker was connected to, or the connection was lost.
+type MqttConnection struct {
+	Connected bool
+}
+
+// Requests, published by the handlers to one another.
+
+// A handler updated its fields of the state, which is then published as
+// StateChanged.
+type StateUpdated struct{}
+
+// Starts a session for the badge, or takes the running one over. An empty
+// BadgeId starts an open access session.
+type StartSession struct {
+	BadgeId    string
+	MemberName string
+	// Zero for the default.
+	IdleOverride time.Duration
+}
+
+// Ends the running session, if any. If Graceful, a machine in use keeps running
+// and the session ends once it stops. Message, if any, is then shown on the
+// displays.
+type EndSession struct {
+	Graceful bool
+	Message  string
+}
+
+// The state the relays depend on changed: switch them as needed.
+type UpdatePower struct{}
+
+// Shows a message on the displays, along with the state.
+type DisplayMessage struct {
+	Text string
+}
+
+// Raises a one-off ALERT_* condition on the alert webhooks.
+type AlertRaised struct {
+	Condition string
+	Detail    string
+}
+
+// Notifications.
+
+// The state machine state changed.
+type StateChanged struct {
+	State State
+}
+
+// A badge was refused, with a reason short enough for the status display.
+type BadgeDenied struct {
+	BadgeId string
+	Reason  string
+}
+
+// A session started, or was renewed or taken over by badging. BadgeId is empty
+// for open access, and Previous the badge of the session taken over, if any.
+type SessionStarted struct {
+	BadgeId  string
+	Previous string
+}
+
+// A session persisted before a restart was resumed.
+type SessionRestored struct {
+	Session persistedSession
+}
+
+// The member badged to keep the running session authorized.
+type SessionExtended struct {
+	BadgeId string
+}
+
+// The machine started or stopped drawing current or spinning.
+type MachineInUse struct {
+	InUse bool
+}
+
+// The session ended, its badge is to be returned. Exiting when ended by the
+// state machine exiting, with the relays going to their exit state.
+type SessionEnded struct {
+	BadgeId string
+	Exiting bool
+}
+
+// The relays were switched on or off.
+type RelaySwitched struct {
+	On bool
+}
+
+// Whether the clock is trusted changed: Problem is why not, empty once it is.
+type ClockTrustChanged struct {
+	Problem string
+}
+
+// Causes of trips.
+const TRIP_DOOR = "door"
+const TRIP_INTERLOCK = "interlock"
+const TRIP_CUT_DEFERRED = "cut_deferred"
+
+// The machine was powered off against the user's will, or should have been
+// long ago. Cause is one of TRIP_*, Reason e.g. "interlock airflow".
+type Tripped struct {
+	Cause  string
+	Reason string
+}
+
+// The curfew is near while a session is running, published every minute.
+type CurfewWarning struct{}
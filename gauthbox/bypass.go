@@ -0,0 +1,126 @@
+package gauthbox
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+const BYPASS_DEFAULT_DURATION = 30 * time.Minute
+
+type bypassConfig struct {
+	inputConfig
+	// How long the bypass lasts before the key must be turned off and on again.
+	MaxMinutes uint32 `json:"max_minutes,omitempty"`
+}
+
+// Returns how long a bypass lasts.
+func (c bypassConfig) Duration() time.Duration {
+	if c.MaxMinutes == 0 {
+		return BYPASS_DEFAULT_DURATION
+	}
+	return time.Duration(c.MaxMinutes) * time.Minute
+}
+
+// Maintenance bypass key switch logic. Yields each change of the key position.
+// The position at startup is ignored: the key must be turned for the bypass to
+// start, so a power cycle never energizes the machine on its own.
+// The looper returns once ctx is done, releasing the input.
+// MQTT: registers as a binary sensor with a 'safety' device class, on while
+// the bypass is active.
+func Bypass(ctx context.Context, c bypassConfig) (*DeviceRet[bool], error) {
+	events := make(chan bool)
+	watch, _, err := Hw.WatchInput(c.inputConfig, func(high bool) {
+		select {
+		case events <- high:
+		case <-ctx.Done():
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceRet[bool]{
+		Looper: func() {
+			defer watch.Close()
+			<-ctx.Done()
+		},
+		Events: stampEvents(events),
+		OnEvent: func(active bool, name string, publish PublishFunc) {
+			publish(name+"/bypass", map[bool]string{false: "OFF", true: "ON"}[active])
+		},
+		Discovery: MqttDiscovery{
+			Component: "binary_sensor",
+			Id:        "bypass",
+			Announce: func(name, topic string) interface{} {
+				return struct {
+					Device      MqttDevice `json:"device"`
+					DeviceClass string     `json:"device_class"`
+					StateTopic  string     `json:"state_topic"`
+				}{
+					Device:      MqttDevice{Name: "Maintenance bypass on " + name},
+					DeviceClass: "safety",
+					StateTopic:  topic + "/" + name + "/bypass",
+				}
+			},
+		},
+	}, nil
+}
+
+// Forces the relay on while the maintenance bypass is engaged, for a limited
+// time. Owns the bypass field of the state.
+type MaintenanceBypass struct {
+	// Nil without a key switch, when only toggled from the console.
+	config  *bypassConfig
+	dev     *DeviceRet[bool]
+	name    string
+	publish PublishFunc
+	state   *State
+	bus     *Bus
+	expired *BusTimer
+}
+
+func NewMaintenanceBypass(config *bypassConfig, dev *DeviceRet[bool], name string, publish PublishFunc, state *State) *MaintenanceBypass {
+	return &MaintenanceBypass{config: config, dev: dev, name: name, publish: publish, state: state}
+}
+
+func (b *MaintenanceBypass) Subscribe(bus *Bus) {
+	b.bus = bus
+	b.expired = bus.NewTimer(func() {
+		// Time's up, the key must be turned off and on again to continue.
+		if b.state.bypass {
+			b.end("expired")
+		}
+	})
+	Subscribe(bus, func(e BypassSwitched) {
+		switch {
+		case e.On && !b.state.bypass:
+			b.start()
+		case !e.On && b.state.bypass:
+			b.end(e.Reason)
+		}
+	})
+}
+
+func (b *MaintenanceBypass) start() {
+	duration := BYPASS_DEFAULT_DURATION
+	if b.config != nil {
+		duration = b.config.Duration()
+		go b.dev.OnEvent(true, b.name, b.publish)
+	}
+	b.state.bypass = true
+	b.expired.Reset(duration)
+	slog.Warn("maintenance bypass engaged, forcing relay on", slog.Duration("max", duration))
+	Publish(b.bus, UpdatePower{})
+	Publish(b.bus, StateUpdated{})
+}
+
+func (b *MaintenanceBypass) end(reason string) {
+	b.state.bypass = false
+	b.expired.Stop()
+	slog.Warn("maintenance bypass ended", slog.String("reason", reason))
+	if b.config != nil {
+		go b.dev.OnEvent(false, b.name, b.publish)
+	}
+	Publish(b.bus, UpdatePower{})
+	Publish(b.bus, StateUpdated{})
+}
@@ -0,0 +1,137 @@
+package gauthbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Numbers of warnings and errors logged since startup, for check-ins.
+var logWarnings, logErrors atomic.Int64
+
+type countingHandler struct {
+	slog.Handler
+}
+
+func (h countingHandler) Handle(ctx context.Context, r slog.Record) error {
+	switch {
+	case r.Level >= slog.LevelError:
+		logErrors.Add(1)
+	case r.Level >= slog.LevelWarn:
+		logWarnings.Add(1)
+	}
+	if r.Level >= slog.LevelWarn {
+		detail := r.Level.String() + " " + r.Message
+		r.Attrs(func(a slog.Attr) bool {
+			detail += " " + a.String()
+			return true
+		})
+		Record(HISTORY_LOG, detail)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h countingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return countingHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h countingHandler) WithGroup(name string) slog.Handler {
+	return countingHandler{h.Handler.WithGroup(name)}
+}
+
+// Wraps the log handler to count warnings and errors, reported in check-ins,
+// and keep them in the history.
+func CountingHandler(h slog.Handler) slog.Handler {
+	return countingHandler{h}
+}
+
+// Returns the VCS revision gauthbox was built from, if known.
+func BuildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			version = s.Value
+		}
+	}
+	return version
+}
+
+// Periodic check-in, as posted to command & control at '<url>/checkin/<name>'.
+type CheckIn struct {
+	Time          time.Time `json:"time"`
+	State         string    `json:"state"`
+	UptimeSeconds int       `json:"uptime_s"`
+	Version       string    `json:"version"`
+	// Served version of the running config, empty for the local one.
+	ConfigVersion string `json:"config_version,omitempty"`
+	// Logged since startup.
+	Warnings int64 `json:"warnings"`
+	Errors   int64 `json:"errors"`
+}
+
+// Check-in logic. Posts the reported state every interval, so command & control
+// can tell stale boxes apart.
+func CheckIns(url string, interval time.Duration, configVersion string) (func(), func(string)) {
+	start := time.Now()
+	var mu sync.Mutex
+	state := ""
+	report := func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		state = s
+	}
+	looper := func() {
+		for {
+			time.Sleep(interval)
+			mu.Lock()
+			c := CheckIn{
+				Time:          time.Now(),
+				State:         state,
+				UptimeSeconds: int(time.Since(start).Seconds()),
+				Version:       BuildVersion(),
+				ConfigVersion: configVersion,
+				Warnings:      logWarnings.Load(),
+				Errors:        logErrors.Load(),
+			}
+			mu.Unlock()
+			if err := postCheckIn(url, c); err != nil {
+				slog.Debug("could not check in", slog.Any("err", err))
+			}
+		}
+	}
+	return looper, report
+}
+
+func postCheckIn(url string, c CheckIn) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("check-in endpoint: %s", resp.Status)
+	}
+	return nil
+}
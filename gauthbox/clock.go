@@ -0,0 +1,169 @@
+package gauthbox
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Time source of the state machine. Defaults to the wall clock; set Clk to a
+// MockClock to go through timeouts deterministically.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	// Calls f in its own goroutine once d elapsed, unless stopped before.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Like time.Timer as of Go 1.23: stopping or resetting the timer drops a value
+// it sent but that was not received yet, so that none is received after.
+type Timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+var Clk Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTimer) Reset(d time.Duration) bool {
+	active := t.Stop()
+	t.t.Reset(d)
+	return active
+}
+
+func (t realTimer) Stop() bool {
+	// The module predates Go 1.23, which does not drain the channel itself.
+	if t.t.Stop() {
+		return true
+	}
+	select {
+	case <-t.t.C:
+	default:
+	}
+	return false
+}
+
+// Clock that only moves with Advance, firing the timers that are due.
+type MockClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*mockTimer
+}
+
+func NewMockClock(now time.Time) *MockClock {
+	return &MockClock{now: now}
+}
+
+func (c *MockClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *MockClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &mockTimer{clock: c, c: make(chan time.Time, 1), deadline: c.now.Add(d), active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *MockClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &mockTimer{clock: c, f: f, deadline: c.now.Add(d), active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Moves the time forward, firing the due timers in deadline order. A fired
+// timer only fires again once reset, and its channel holds a single value.
+// The functions of the due AfterFunc timers are called before returning.
+func (c *MockClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	due := []*mockTimer{}
+	for _, t := range c.timers {
+		if t.active && !t.deadline.After(c.now) {
+			due = append(due, t)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].deadline.Before(due[j].deadline) })
+	funcs := []func(){}
+	for _, t := range due {
+		t.active = false
+		if t.f != nil {
+			funcs = append(funcs, t.f)
+			continue
+		}
+		select {
+		case t.c <- t.deadline:
+		default:
+		}
+	}
+	c.mu.Unlock()
+	for _, f := range funcs {
+		f()
+	}
+}
+
+type mockTimer struct {
+	clock *MockClock
+	c     chan time.Time
+	// Set for AfterFunc timers, which have no channel.
+	f        func()
+	deadline time.Time
+	active   bool
+}
+
+func (t *mockTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *mockTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.drain()
+	t.deadline, t.active = t.clock.now.Add(d), true
+	return wasActive
+}
+
+func (t *mockTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.drain()
+	t.active = false
+	return wasActive
+}
+
+// Drops the value sent but not received, if any.
+func (t *mockTimer) drain() {
+	select {
+	case <-t.c:
+	default:
+	}
+}
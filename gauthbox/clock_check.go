@@ -0,0 +1,140 @@
+package gauthbox
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The clock is not trusted if off by more than that from command & control.
+const CLOCK_MAX_SKEW = 5 * time.Minute
+const CLOCK_CHECK_INTERVAL = time.Minute
+
+// Time of command & control as of its last response, and when that was on the
+// monotonic clock, which keeps counting right if the wall clock is stepped.
+var clockReference = struct {
+	mu       sync.Mutex
+	server   time.Time
+	received time.Time
+}{}
+
+// Records the Date header of a command & control response, if any.
+func observeServerDate(h http.Header) {
+	server, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		return
+	}
+	clockReference.mu.Lock()
+	defer clockReference.mu.Unlock()
+	clockReference.server, clockReference.received = server, time.Now()
+}
+
+// Returns when the binary was built, zero if unknown.
+func buildTime() time.Time {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return time.Time{}
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.time" {
+			t, _ := time.Parse(time.RFC3339, s.Value)
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Returns why the clock is not trusted, e.g. no NTP after a power loss, empty
+// if it is.
+func ClockProblem(now time.Time) string {
+	if built := buildTime(); now.Before(built) {
+		return fmt.Sprintf("before the build time %s", built.Format(time.RFC3339))
+	}
+	clockReference.mu.Lock()
+	server, received := clockReference.server, clockReference.received
+	clockReference.mu.Unlock()
+	if !server.IsZero() {
+		// The Date header has a one second resolution.
+		skew := now.Sub(server.Add(time.Since(received))).Truncate(time.Second)
+		if skew > CLOCK_MAX_SKEW || skew < -CLOCK_MAX_SKEW {
+			return fmt.Sprintf("off by %s from command & control", skew)
+		}
+	}
+	var tx unix.Timex
+	if state, err := unix.Adjtimex(&tx); err == nil && (state == unix.TIME_BAD || tx.Status&unix.STA_UNSYNC != 0) {
+		return "not synchronized"
+	}
+	return ""
+}
+
+// Checks whether the clock is trusted every CLOCK_CHECK_INTERVAL. Owns the
+// clockProblem field of the state.
+type ClockCheck struct {
+	config *AuthboxConfig
+	state  *State
+	bus    *Bus
+	check  *BusTimer
+}
+
+func NewClockCheck(config *AuthboxConfig, state *State) *ClockCheck {
+	return &ClockCheck{config: config, state: state}
+}
+
+// Subscribes to the start. Must come before the schedules, which are held
+// until the clock is trusted if configured so.
+func (c *ClockCheck) Subscribe(bus *Bus) {
+	c.bus = bus
+	c.check = bus.NewTimer(func() {
+		c.check.Reset(CLOCK_CHECK_INTERVAL)
+		c.update()
+	})
+	Subscribe(bus, func(Started) {
+		c.check.Reset(CLOCK_CHECK_INTERVAL)
+		c.update()
+	})
+}
+
+func (c *ClockCheck) update() {
+	problem := ClockProblem(Clk.Now())
+	if problem == c.state.clockProblem {
+		return
+	}
+	if problem != "" {
+		slog.Warn("clock not trusted", slog.String("reason", problem), slog.Bool("schedules_held", c.config.ScheduleNeedsClock))
+	} else {
+		slog.Info("clock trusted again")
+	}
+	c.state.clockProblem = problem
+	Publish(c.bus, StateUpdated{})
+	Publish(c.bus, ClockTrustChanged{Problem: problem})
+}
+
+// Publishes whether the clock is not trusted.
+func PublishClockProblem(problem string, name string, publish PublishFunc) {
+	publish(name+"/clock", map[bool]string{false: "OFF", true: "ON"}[problem != ""])
+}
+
+// MQTT: whether the clock is not trusted, as a binary sensor with a 'problem'
+// device class.
+func ClockDiscovery() MqttDiscovery {
+	return MqttDiscovery{
+		Component: "binary_sensor",
+		Id:        "clock",
+		Announce: func(name, topic string) interface{} {
+			return struct {
+				Device      MqttDevice `json:"device"`
+				DeviceClass string     `json:"device_class"`
+				StateTopic  string     `json:"state_topic"`
+			}{
+				Device:      MqttDevice{Name: "Clock on " + name},
+				DeviceClass: "problem",
+				StateTopic:  topic + "/" + name + "/clock",
+			}
+		},
+	}
+}
@@ -0,0 +1,64 @@
+package gauthbox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimerResetAfterFired(t *testing.T) {
+	mock := NewMockClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	tests := []struct {
+		name  string
+		clock Clock
+		// Lets the timer fire, or the new deadline pass.
+		elapse func(d time.Duration)
+	}{
+		{"real", realClock{}, func(d time.Duration) { time.Sleep(d + 50*time.Millisecond) }},
+		{"mock", mock, mock.Advance},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := 10 * time.Millisecond
+			timer := tt.clock.NewTimer(d)
+			tt.elapse(d)
+			// Fired, but the value was not received.
+			timer.Reset(d)
+			select {
+			case <-timer.C():
+				t.Fatal("received the value of the fired timer after reset")
+			default:
+			}
+			tt.elapse(d)
+			select {
+			case <-timer.C():
+			default:
+				t.Fatal("reset timer did not fire")
+			}
+		})
+	}
+}
+
+func TestTimerStopAfterFired(t *testing.T) {
+	mock := NewMockClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	tests := []struct {
+		name   string
+		clock  Clock
+		elapse func(d time.Duration)
+	}{
+		{"real", realClock{}, func(d time.Duration) { time.Sleep(d + 50*time.Millisecond) }},
+		{"mock", mock, mock.Advance},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := 10 * time.Millisecond
+			timer := tt.clock.NewTimer(d)
+			tt.elapse(d)
+			timer.Stop()
+			select {
+			case <-timer.C():
+				t.Fatal("received the value of the fired timer after stop")
+			default:
+			}
+		})
+	}
+}
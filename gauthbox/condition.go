@@ -0,0 +1,133 @@
+package gauthbox
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Resolves a variable of a condition to its current value, or false if unknown.
+type conditionLookup = func(name string) (func() bool, bool)
+
+// Compiles a small boolean expression over named inputs, e.g.
+// "door_closed && !spinning.spindle && (interlock.vacuum || !current)".
+// Supports !, &&, || and parentheses, with the usual precedence.
+func compileCondition(expr string, lookup conditionLookup) (func() bool, error) {
+	p := conditionParser{tokens: tokenizeCondition(expr), lookup: lookup}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected '%s'", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+func tokenizeCondition(expr string) []string {
+	tokens := []string{}
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.HasPrefix(expr[i:], "&&"), strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		case c == '!' || c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			j := i
+			for j < len(expr) && (unicode.IsLetter(rune(expr[j])) || unicode.IsDigit(rune(expr[j])) || strings.ContainsRune("_.-", rune(expr[j]))) {
+				j++
+			}
+			if j == i {
+				// Unknown character, reported by the parser.
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+type conditionParser struct {
+	tokens []string
+	pos    int
+	lookup conditionLookup
+}
+
+func (p *conditionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *conditionParser) or() (func() bool, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func() bool { return l() || right() }
+	}
+	return left, nil
+}
+
+func (p *conditionParser) and() (func() bool, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func() bool { return l() && right() }
+	}
+	return left, nil
+}
+
+func (p *conditionParser) unary() (func() bool, error) {
+	switch t := p.peek(); t {
+	case "":
+		return nil, fmt.Errorf("unexpected end of condition")
+	case "!":
+		p.pos++
+		f, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func() bool { return !f() }, nil
+	case "(":
+		p.pos++
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		p.pos++
+		return f, nil
+	default:
+		f, ok := p.lookup(t)
+		if !ok {
+			return nil, fmt.Errorf("unknown input '%s'", t)
+		}
+		p.pos++
+		return f, nil
+	}
+}
@@ -0,0 +1,88 @@
+package gauthbox
+
+import "testing"
+
+func TestCompileCondition(t *testing.T) {
+	inputs := map[string]bool{"door_closed": true, "current": false, "spinning.spindle": true, "interlock.vacuum": false}
+	lookup := func(name string) (func() bool, bool) {
+		if _, ok := inputs[name]; !ok {
+			return nil, false
+		}
+		return func() bool { return inputs[name] }, true
+	}
+	tests := []struct {
+		expr  string
+		want  bool
+		error bool
+	}{
+		{expr: "door_closed", want: true},
+		{expr: "!door_closed", want: false},
+		{expr: "!!door_closed", want: true},
+		{expr: "door_closed && current", want: false},
+		{expr: "door_closed || current", want: true},
+		{expr: "  door_closed&&!current  ", want: true},
+		// && binds tighter than ||.
+		{expr: "current && interlock.vacuum || door_closed", want: true},
+		{expr: "current && (interlock.vacuum || door_closed)", want: false},
+		{expr: "door_closed && !spinning.spindle && (interlock.vacuum || !current)", want: false},
+		{expr: "!(current || interlock.vacuum) && spinning.spindle", want: true},
+		{expr: "", error: true},
+		{expr: "door_closed &&", error: true},
+		{expr: "(door_closed", error: true},
+		{expr: "door_closed)", error: true},
+		{expr: "door_closed current", error: true},
+		{expr: "door_closed & current", error: true},
+		{expr: "spinning.lathe", error: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			f, err := compileCondition(tt.expr, lookup)
+			if tt.error {
+				if err == nil {
+					t.Errorf("compiled, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f(); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileIdleCondition(t *testing.T) {
+	config := &AuthboxConfig{
+		IdleWhen:    "door_closed && !spinning.spindle && interlock.vacuum",
+		DoorContact: &doorContactConfig{},
+		Tachometers: []tachometerConfig{{Id: "spindle"}},
+		Interlocks:  []interlockConfig{{Id: "vacuum"}},
+	}
+	state := &State{doorClosed: true, spinning: map[string]bool{}, interlocksOpen: map[string]bool{}}
+	f, err := compileIdleCondition(config, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The condition follows the state.
+	if !f() {
+		t.Error("idle condition does not hold")
+	}
+	state.spinning["spindle"] = true
+	if f() {
+		t.Error("idle condition holds while spinning")
+	}
+	delete(state.spinning, "spindle")
+	state.interlocksOpen["vacuum"] = true
+	if f() {
+		t.Error("idle condition holds with the interlock open")
+	}
+	// Inputs that are not configured are unknown.
+	for _, expr := range []string{"running", "spinning.lathe", "interlock.guard"} {
+		config.IdleWhen = expr
+		if _, err := compileIdleCondition(config, state); err == nil {
+			t.Errorf("compiled '%s' without the input configured", expr)
+		}
+	}
+}
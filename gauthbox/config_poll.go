@@ -0,0 +1,37 @@
+package gauthbox
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// Config polling logic. Fetches the config from command & control every
+// interval; the event stream yields the new version once it differs from the
+// running one and is valid, which should then be reloaded.
+func ConfigPoller(name string, c *AuthboxConfig) *DeviceRet[string] {
+	events := make(chan string)
+	interval := time.Duration(c.ConfigPollMinutes) * time.Minute
+	return &DeviceRet[string]{
+		Looper: func() {
+			for {
+				time.Sleep(interval)
+				config, err := getConfigRemotely(name, c.ccUrl, c.version)
+				if errors.Is(err, ErrInvalidConfig) {
+					// Keep running the current one until fixed.
+					slog.Warn("new config is invalid, not reloading", slog.Any("err", err))
+					continue
+				}
+				if err != nil {
+					slog.Debug("could not poll config", slog.Any("err", err))
+					continue
+				}
+				if config != nil {
+					events <- config.version
+					return
+				}
+			}
+		},
+		Events: stampEvents(events),
+	}
+}
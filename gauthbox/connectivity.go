@@ -0,0 +1,162 @@
+package gauthbox
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const CONNECTIVITY_DEFAULT_INTERVAL = time.Minute
+const CONNECTIVITY_TIMEOUT = 5 * time.Second
+
+// Probed targets.
+const CONNECTIVITY_COMMAND_CONTROL = "command_control"
+const CONNECTIVITY_AUTH_BACKEND = "auth_backend"
+
+// Periodic probing of command & control and the badge auth backend, so outages
+// show before someone badges.
+type connectivityConfig struct {
+	// Defaults to CONNECTIVITY_DEFAULT_INTERVAL.
+	IntervalS uint32 `json:"interval_s,omitempty"`
+}
+
+// Reachability of a target, as of its last probe.
+type Reachability struct {
+	Target    string
+	Reachable bool
+	// Why it is not reachable, empty otherwise.
+	Reason string
+	At     time.Time
+}
+
+// Last probe per target, for health reports.
+var reachability = struct {
+	mu       sync.Mutex
+	byTarget map[string]Reachability
+}{byTarget: map[string]Reachability{}}
+
+func lastReachability(target string) (Reachability, bool) {
+	reachability.mu.Lock()
+	defer reachability.mu.Unlock()
+	r, ok := reachability.byTarget[target]
+	return r, ok
+}
+
+// Returns the base URL of the badge auth backend, e.g. "https://auth.shop".
+func authBackendUrl(c badgeAuthConfig) (string, error) {
+	t, err := template.New("url").Parse(c.UrlTemplate)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, map[string]interface{}{}); err != nil {
+		return "", err
+	}
+	u, err := url.Parse(b.String())
+	if err != nil {
+		return "", err
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// Resolves the host of the URL, then sends it a HEAD request. Any HTTP
+// response means reachable, as the root may well be a 404.
+func probe(base string) error {
+	u, err := url.Parse(base)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), CONNECTIVITY_TIMEOUT)
+	defer cancel()
+	if _, err := net.DefaultResolver.LookupHost(ctx, u.Hostname()); err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, base+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("http: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Connectivity monitor logic. Probes the targets, by name, every interval.
+// The event stream yields each change of reachability, starting with the
+// first probe. The looper returns once ctx is done.
+// MQTT: publishes each target's reachability, see ConnectivityDiscovery.
+func ConnectivityMonitor(ctx context.Context, c connectivityConfig, targets map[string]string) *DeviceRet[Reachability] {
+	interval := time.Duration(c.IntervalS) * time.Second
+	if interval == 0 {
+		interval = CONNECTIVITY_DEFAULT_INTERVAL
+	}
+	events := make(chan Reachability)
+	return &DeviceRet[Reachability]{
+		Looper: func() {
+			for {
+				for target, base := range targets {
+					r := Reachability{Target: target, Reachable: true, At: time.Now()}
+					if err := probe(base); err != nil {
+						r.Reachable, r.Reason = false, err.Error()
+					}
+					reachability.mu.Lock()
+					last, known := reachability.byTarget[target]
+					reachability.byTarget[target] = r
+					reachability.mu.Unlock()
+					if !known || last.Reachable != r.Reachable {
+						select {
+						case events <- r:
+						case <-ctx.Done():
+							return
+						}
+					}
+				}
+				select {
+				case <-time.After(interval):
+				case <-ctx.Done():
+					return
+				}
+			}
+		},
+		Events: stampEvents(events),
+		OnEvent: func(r Reachability, name string, publish PublishFunc) {
+			if r.Reachable {
+				slog.Info("connectivity: reachable", slog.String("target", r.Target))
+			} else {
+				slog.Warn("connectivity: unreachable", slog.String("target", r.Target), slog.String("reason", r.Reason))
+			}
+			publish(name+"/connectivity/"+r.Target, MqttRetained{Payload: map[bool]string{false: "OFF", true: "ON"}[r.Reachable]})
+		},
+	}
+}
+
+// MQTT: the reachability of the target, as a diagnostic binary sensor with a
+// 'connectivity' device class.
+func ConnectivityDiscovery(target string) MqttDiscovery {
+	return MqttDiscovery{
+		Component: "binary_sensor",
+		Id:        "connectivity_" + target,
+		Announce: func(name, topic string) interface{} {
+			return struct {
+				Device         MqttDevice `json:"device"`
+				DeviceClass    string     `json:"device_class"`
+				EntityCategory string     `json:"entity_category"`
+				StateTopic     string     `json:"state_topic"`
+			}{
+				Device:         MqttDevice{Name: "Connectivity (" + target + ") of " + name},
+				DeviceClass:    "connectivity",
+				EntityCategory: "diagnostic",
+				StateTopic:     topic + "/" + name + "/connectivity/" + target,
+			}
+		},
+	}
+}
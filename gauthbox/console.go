@@ -0,0 +1,152 @@
+package gauthbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const CONSOLE_HELP = `commands:
+  status               state and health
+  history [since]      recent events, since an RFC 3339 time or HH:MM today
+  badge <id>           scan a badge, as if read by the reader
+  relay on|off         engage or end the maintenance bypass, forcing the relay on
+  log <level>|reset    set the log level (debug, info, warn, error) or go back to GO_LOG
+  cmd <name> [payload] send a command, as over MQTT, e.g. 'cmd lockout broken belt'
+  help`
+
+// Local debug console, for on-site debugging without restarting, e.g. with
+// 'socat - UNIX-CONNECT:<socket>'.
+type consoleConfig struct {
+	// Path of the Unix socket, only accessible to the daemon's user.
+	Socket string `json:"socket"`
+}
+
+// A console command for the state machine: "badge", "relay", or any command
+// handled like MQTT commands.
+type ConsoleCommand struct {
+	Command string
+	Arg     string
+}
+
+// Debug console logic. Serves the CONSOLE_HELP text protocol, one command per
+// line. Report the state with the returned func.
+func DebugConsole(c consoleConfig) (*DeviceRet[ConsoleCommand], func(HttpStatus), error) {
+	if c.Socket == "" {
+		return nil, nil, errors.New("a socket path is required")
+	}
+	// Bound in a private directory, then moved in place once restricted, so
+	// that the socket is never reachable by others.
+	dir, err := os.MkdirTemp(filepath.Dir(c.Socket), ".console")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+	bound := filepath.Join(dir, "socket")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: bound, Net: "unix"})
+	if err != nil {
+		return nil, nil, err
+	}
+	// Removed on shutdown under its final path instead.
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(bound, 0o600); err != nil {
+		listener.Close()
+		return nil, nil, err
+	}
+	// Replaces the one left behind if the daemon crashed.
+	if err := os.Rename(bound, c.Socket); err != nil {
+		listener.Close()
+		return nil, nil, err
+	}
+
+	var mu sync.Mutex
+	var status HttpStatus
+	report := func(s HttpStatus) {
+		mu.Lock()
+		defer mu.Unlock()
+		status = s
+	}
+
+	commands := make(chan ConsoleCommand)
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		fmt.Fprintln(conn, CONSOLE_HELP)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			args := strings.Fields(scanner.Text())
+			if len(args) == 0 {
+				continue
+			}
+			arg := strings.Join(args[1:], " ")
+			switch {
+			case args[0] == "status" && len(args) == 1:
+				mu.Lock()
+				s := status
+				mu.Unlock()
+				s.Health = s.Health.Refresh()
+				b, _ := json.MarshalIndent(s, "", "  ")
+				fmt.Fprintln(conn, string(b))
+			case args[0] == "history":
+				since, err := parseHistorySince(arg)
+				if err != nil {
+					fmt.Fprintf(conn, "error: %s\n", err)
+					continue
+				}
+				for _, e := range History(since) {
+					fmt.Fprintf(conn, "%s %-6s %s\n", e.Time.Format(time.DateTime), e.Kind, e.Detail)
+				}
+			case args[0] == "log" && len(args) == 2:
+				if args[1] == "reset" {
+					SetLogLevel(nil)
+					fmt.Fprintln(conn, "ok")
+					continue
+				}
+				var level slog.Level
+				if err := level.UnmarshalText([]byte(args[1])); err != nil {
+					fmt.Fprintf(conn, "error: %s\n", err)
+					continue
+				}
+				SetLogLevel(&level)
+				fmt.Fprintln(conn, "ok")
+			case args[0] == "badge" && len(args) == 2,
+				args[0] == "relay" && len(args) == 2 && (args[1] == "on" || args[1] == "off"):
+				commands <- ConsoleCommand{Command: args[0], Arg: arg}
+				fmt.Fprintln(conn, "ok")
+			case args[0] == "cmd" && len(args) >= 2:
+				commands <- ConsoleCommand{Command: args[1], Arg: strings.Join(args[2:], " ")}
+				fmt.Fprintln(conn, "ok")
+			default:
+				fmt.Fprintln(conn, CONSOLE_HELP)
+			}
+		}
+	}
+
+	return &DeviceRet[ConsoleCommand]{
+		Looper: func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					if !errors.Is(err, net.ErrClosed) {
+						slog.Error("console: stopped serving", slog.Any("error", err))
+					}
+					return
+				}
+				slog.Warn("console: session opened")
+				go serve(conn)
+			}
+		},
+		Events: stampEvents(commands),
+		Shutdown: func() {
+			listener.Close()
+			os.Remove(c.Socket)
+		},
+	}, report, nil
+}
@@ -0,0 +1,169 @@
+package gauthbox
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// State file holding the lifetime counters.
+const COUNTERS_STATE_FILE = "counters.json"
+
+// How often the relay-on time is persisted and published while the relay is on.
+const COUNTERS_INTERVAL = 10 * time.Minute
+
+// Totals since the box was commissioned, for maintenance scheduling and
+// utilization reporting.
+type Lifetime struct {
+	RelayOnSeconds int64 `json:"relay_on_s"`
+	Sessions       int64 `json:"sessions"`
+	BadgeScans     int64 `json:"badge_scans"`
+}
+
+// Lifetime counters, persisted on each change.
+type LifetimeCounters struct {
+	mu    sync.Mutex
+	total Lifetime
+	// Since when the relay is on, zero if off. Not yet counted in total.
+	relayOnSince time.Time
+}
+
+// Returns the counters, resuming the persisted ones, if any.
+func NewLifetimeCounters() *LifetimeCounters {
+	l := &LifetimeCounters{}
+	if b, err := os.ReadFile(StatePath(COUNTERS_STATE_FILE)); err == nil {
+		if err := json.Unmarshal(b, &l.total); err != nil {
+			slog.Warn("could not parse persisted counters", slog.Any("err", err))
+		}
+	}
+	return l
+}
+
+func (l *LifetimeCounters) AddSession() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total.Sessions++
+	l.save()
+}
+
+func (l *LifetimeCounters) AddBadgeScan() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total.BadgeScans++
+	l.save()
+}
+
+// Reports whether the relay is on as of t. Reporting it on again counts the
+// time so far, e.g. to persist it periodically.
+func (l *LifetimeCounters) Relay(on bool, t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.relayOnSince.IsZero() {
+		l.total.RelayOnSeconds += int64(t.Sub(l.relayOnSince).Seconds())
+		// Keeps the sub-second remainder for the next report.
+		l.relayOnSince = l.relayOnSince.Add(t.Sub(l.relayOnSince).Truncate(time.Second))
+		l.save()
+	}
+	if !on {
+		l.relayOnSince = time.Time{}
+	} else if l.relayOnSince.IsZero() {
+		l.relayOnSince = t
+	}
+}
+
+// Returns the counters, including the ongoing relay-on time as of t.
+func (l *LifetimeCounters) Total(t time.Time) Lifetime {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	total := l.total
+	if !l.relayOnSince.IsZero() {
+		total.RelayOnSeconds += int64(t.Sub(l.relayOnSince).Seconds())
+	}
+	return total
+}
+
+func (l *LifetimeCounters) save() {
+	b, err := json.Marshal(l.total)
+	if err != nil {
+		return
+	}
+	if err := writeStateFile(COUNTERS_STATE_FILE, b); err != nil {
+		slog.Warn("could not persist counters", slog.Any("err", err))
+	}
+}
+
+// Counts the badge scans, the sessions and the relay-on time, published on
+// each change and on connecting, and persisted every COUNTERS_INTERVAL while
+// the relay is on.
+func (l *LifetimeCounters) Subscribe(bus *Bus, name string, publish PublishFunc) {
+	published := func() { go PublishLifetime(l.Total(Clk.Now()), name, publish) }
+	relay := false
+	var tick *BusTimer
+	tick = bus.NewTimer(func() {
+		tick.Reset(COUNTERS_INTERVAL)
+		if relay {
+			// Persists the relay-on time so far.
+			l.Relay(true, Clk.Now())
+			published()
+		}
+	})
+	Subscribe(bus, func(Started) { tick.Reset(COUNTERS_INTERVAL) })
+	Subscribe(bus, func(BadgeScanned) {
+		l.AddBadgeScan()
+		published()
+	})
+	Subscribe(bus, func(SessionSummary) {
+		l.AddSession()
+		published()
+	})
+	Subscribe(bus, func(e StateChanged) {
+		if e.State.relay != relay {
+			relay = e.State.relay
+			l.Relay(relay, Clk.Now())
+			published()
+		}
+	})
+	Subscribe(bus, func(e MqttConnection) {
+		if e.Connected {
+			published()
+		}
+	})
+}
+
+// Publishes the lifetime counters to MQTT, retained.
+func PublishLifetime(l Lifetime, name string, publish PublishFunc) {
+	publish(name+"/lifetime/relay_on_hours", MqttRetained{Payload: strconv.FormatFloat(float64(l.RelayOnSeconds)/3600, 'f', 2, 64)})
+	publish(name+"/lifetime/sessions", MqttRetained{Payload: strconv.FormatInt(l.Sessions, 10)})
+	publish(name+"/lifetime/badge_scans", MqttRetained{Payload: strconv.FormatInt(l.BadgeScans, 10)})
+}
+
+// MQTT: the lifetime counters, as total increasing sensors.
+func LifetimeDiscovery() []MqttDiscovery {
+	sensor := func(id, label, unit string) MqttDiscovery {
+		return MqttDiscovery{
+			Component: "sensor",
+			Id:        "lifetime_" + id,
+			Announce: func(name, topic string) interface{} {
+				return struct {
+					Device     MqttDevice `json:"device"`
+					StateClass string     `json:"state_class"`
+					StateTopic string     `json:"state_topic"`
+					Unit       string     `json:"unit_of_measurement,omitempty"`
+				}{
+					Device:     MqttDevice{Name: label + " on " + name},
+					StateClass: "total_increasing",
+					StateTopic: topic + "/" + name + "/lifetime/" + id,
+					Unit:       unit,
+				}
+			},
+		}
+	}
+	return []MqttDiscovery{
+		sensor("relay_on_hours", "Lifetime relay on time", "h"),
+		sensor("sessions", "Lifetime sessions", ""),
+		sensor("badge_scans", "Lifetime badge scans", ""),
+	}
+}
@@ -0,0 +1,100 @@
+package gauthbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+// Crash reports are kept in the state directory as '<prefix><unix nanos>.json'
+// until uploaded.
+const CRASH_FILE_PREFIX = "crash-"
+
+// A panic, as uploaded to command & control at '<url>/crash/<name>'.
+type CrashReport struct {
+	Time time.Time `json:"time"`
+	// The looper that panicked, or "main" for the state machine.
+	Looper  string `json:"looper"`
+	Panic   string `json:"panic"`
+	Stack   string `json:"stack"`
+	Version string `json:"version"`
+}
+
+// Wraps the looper so a panic is persisted as a crash report, before crashing
+// as usual for systemd to restart the daemon.
+func Guard(name string, looper func()) func() {
+	return func() {
+		defer reportPanic(name)
+		looper()
+	}
+}
+
+// Persists the ongoing panic, if any, and panics again. Must be deferred.
+func reportPanic(name string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	c := CrashReport{
+		Time:    time.Now(),
+		Looper:  name,
+		Panic:   fmt.Sprint(r),
+		Stack:   string(debug.Stack()),
+		Version: BuildVersion(),
+	}
+	if b, err := json.Marshal(c); err == nil {
+		if err := writeStateFile(fmt.Sprintf("%s%d.json", CRASH_FILE_PREFIX, c.Time.UnixNano()), b); err != nil {
+			fmt.Fprintf(os.Stderr, "could not persist crash report: %v\n", err)
+		}
+	}
+	panic(r)
+}
+
+// Uploads the crash reports persisted by previous runs, deleting them once
+// accepted. Reports that could not be uploaded are retried on next start.
+func UploadCrashReports(url string) {
+	paths, err := filepath.Glob(StatePath(CRASH_FILE_PREFIX + "*.json"))
+	if err != nil {
+		return
+	}
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if err := postCrashReport(url, b); err != nil {
+			slog.Warn("could not upload crash report", slog.String("path", path), slog.Any("err", err))
+			return
+		}
+		slog.Info("uploaded crash report", slog.String("path", path))
+		if err := os.Remove(path); err != nil {
+			slog.Warn("could not delete crash report", slog.String("path", path), slog.Any("err", err))
+		}
+	}
+}
+
+func postCrashReport(url string, b []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("command & control: %s", resp.Status)
+	}
+	return nil
+}
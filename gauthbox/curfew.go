@@ -0,0 +1,157 @@
+package gauthbox
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Curfew phases, as published over MQTT.
+const CURFEW_OFF = "off"
+
+// Ongoing sessions are about to be ended.
+const CURFEW_WARNING = "warning"
+
+// No new sessions; ongoing ones may continue for the grace period.
+const CURFEW_CLOSED = "closed"
+
+// Ongoing sessions end, once the machine stops if in use.
+const CURFEW_ENFORCED = "enforced"
+
+// Nightly curfew, e.g. for noise regulations: from the start, the tool accepts
+// no new sessions, and ongoing ones end after the grace period.
+type curfewConfig struct {
+	// Time of day as "HH:MM". A curfew ending before it starts ends the next day.
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// How long ongoing sessions may continue after the start.
+	GraceMinutes uint32 `json:"grace_minutes,omitempty"`
+	// How long before ongoing sessions end to warn, zero for no warning.
+	WarningMinutes uint32 `json:"warning_minutes,omitempty"`
+}
+
+func (c curfewConfig) Validate() error {
+	start, err := parseTimeOfDay(c.Start)
+	if err != nil {
+		return err
+	}
+	end, err := parseTimeOfDay(c.End)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return fmt.Errorf("start and end must differ")
+	}
+	if _, length := c.since(time.Time{}); time.Duration(c.GraceMinutes)*time.Minute >= length {
+		return fmt.Errorf("grace period must be shorter than the curfew")
+	}
+	return nil
+}
+
+// Returns how long since the curfew last started at t, and how long it lasts.
+func (c curfewConfig) since(t time.Time) (time.Duration, time.Duration) {
+	start, _ := parseTimeOfDay(c.Start)
+	end, _ := parseTimeOfDay(c.End)
+	return (sinceMidnight(t) - start + 24*time.Hour) % (24 * time.Hour), (end - start + 24*time.Hour) % (24 * time.Hour)
+}
+
+// Returns whether new sessions are refused at t. The config must be valid.
+func (c curfewConfig) Closed(t time.Time) bool {
+	since, length := c.since(t)
+	return since < length
+}
+
+// Returns the curfew phase at t, as one of CURFEW_*. The config must be valid.
+func (c curfewConfig) At(t time.Time) string {
+	since, length := c.since(t)
+	grace := time.Duration(c.GraceMinutes) * time.Minute
+	untilEnforced := (grace - since + 24*time.Hour) % (24 * time.Hour)
+	switch {
+	case since < length && since >= grace:
+		return CURFEW_ENFORCED
+	case untilEnforced <= time.Duration(c.WarningMinutes)*time.Minute:
+		return CURFEW_WARNING
+	case since < length:
+		return CURFEW_CLOSED
+	}
+	return CURFEW_OFF
+}
+
+// Follows the curfew phase every minute, warning ahead of and ending the
+// ongoing session. Owns the curfew and curfewClosed fields of the state.
+type Curfew struct {
+	config *AuthboxConfig
+	state  *State
+	bus    *Bus
+	check  *BusTimer
+}
+
+func NewCurfew(config *AuthboxConfig, state *State) *Curfew {
+	return &Curfew{config: config, state: state}
+}
+
+func (c *Curfew) Subscribe(bus *Bus) {
+	c.bus = bus
+	c.check = bus.NewTimer(func() {
+		c.check.Reset(untilNextMinute(Clk.Now()))
+		c.update()
+	})
+	Subscribe(bus, func(Started) {
+		c.check.Reset(untilNextMinute(Clk.Now()))
+		c.update()
+	})
+	Subscribe(bus, func(e ClockTrustChanged) {
+		if e.Problem == "" && c.config.ScheduleNeedsClock {
+			// Catch up with the held schedule.
+			c.update()
+		}
+	})
+}
+
+func (c *Curfew) update() {
+	s := c.state
+	if scheduleHeld(c.config, s) {
+		return
+	}
+	phase := c.config.Curfew.At(Clk.Now())
+	closed := c.config.Curfew.Closed(Clk.Now())
+	if phase == CURFEW_WARNING && s.state != STATE_OFF {
+		// Remind every minute until the session ends.
+		Publish(c.bus, CurfewWarning{})
+	}
+	if phase == s.curfew && closed == s.curfewClosed {
+		return
+	}
+	slog.Info("curfew", slog.String("phase", phase), slog.Bool("closed", closed))
+	s.curfew, s.curfewClosed = phase, closed
+	Publish(c.bus, StateUpdated{})
+	switch {
+	case phase == CURFEW_WARNING && s.state != STATE_OFF:
+		Publish(c.bus, DisplayMessage{Text: "Curfew soon"})
+	case phase == CURFEW_ENFORCED:
+		// Do not stop a machine in use: warn, and power off once it stops.
+		Publish(c.bus, EndSession{Graceful: true, Message: "Curfew"})
+	}
+}
+
+// Publishes the curfew phase.
+func PublishCurfew(phase string, name string, publish PublishFunc) {
+	publish(name+"/curfew", phase)
+}
+
+// MQTT: the curfew phase, as a sensor.
+func CurfewDiscovery() MqttDiscovery {
+	return MqttDiscovery{
+		Component: "sensor",
+		Id:        "curfew",
+		Announce: func(name, topic string) interface{} {
+			return struct {
+				Device     MqttDevice `json:"device"`
+				StateTopic string     `json:"state_topic"`
+			}{
+				Device:     MqttDevice{Name: "Curfew on " + name},
+				StateTopic: topic + "/" + name + "/curfew",
+			}
+		},
+	}
+}
@@ -0,0 +1,123 @@
+package gauthbox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCurfewAt(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+	at := func(day, hour, min int) time.Time { return time.Date(2024, 3, day, hour, min, 0, 0, paris) }
+	// Summer time starts on 2024-03-31 at 02:00, ends on 2024-10-27 at 03:00:
+	// 02:00 to 03:00 then happens twice, an hour apart.
+	fallBack := func(hour, min int, summer bool) time.Time {
+		offset := 1
+		if summer {
+			offset = 2
+		}
+		return time.Date(2024, 10, 27, hour-offset, min, 0, 0, time.UTC).In(paris)
+	}
+	night := curfewConfig{Start: "22:00", End: "06:00", GraceMinutes: 30, WarningMinutes: 10}
+	tests := []struct {
+		name   string
+		c      curfewConfig
+		t      time.Time
+		phase  string
+		closed bool
+	}{
+		{"before", night, at(1, 21, 59), CURFEW_OFF, false},
+		{"start", night, at(1, 22, 0), CURFEW_CLOSED, true},
+		{"grace", night, at(1, 22, 19), CURFEW_CLOSED, true},
+		{"warning", night, at(1, 22, 20), CURFEW_WARNING, true},
+		{"enforced", night, at(1, 22, 30), CURFEW_ENFORCED, true},
+		{"after midnight", night, at(2, 0, 30), CURFEW_ENFORCED, true},
+		{"last minute", night, at(2, 5, 59), CURFEW_ENFORCED, true},
+		{"end", night, at(2, 6, 0), CURFEW_OFF, false},
+		{"no grace", curfewConfig{Start: "22:00", End: "06:00"}, at(1, 22, 0), CURFEW_ENFORCED, true},
+		{"warning before midnight", curfewConfig{Start: "23:30", End: "01:00", GraceMinutes: 40, WarningMinutes: 15}, at(1, 23, 55), CURFEW_WARNING, true},
+		{"enforced after midnight", curfewConfig{Start: "23:30", End: "01:00", GraceMinutes: 40, WarningMinutes: 15}, at(2, 0, 10), CURFEW_ENFORCED, true},
+		{"daytime", curfewConfig{Start: "12:00", End: "14:00"}, at(1, 23, 0), CURFEW_OFF, false},
+		// The curfew follows the wall clock through the DST changes.
+		{"spring forward, last minute", night, at(31, 5, 59), CURFEW_ENFORCED, true},
+		{"spring forward, end", night, at(31, 6, 0), CURFEW_OFF, false},
+		{"spring forward, skipped hour", curfewConfig{Start: "01:30", End: "02:30"}, at(31, 3, 0), CURFEW_OFF, false},
+		{"spring forward, starting in the skipped hour", curfewConfig{Start: "02:30", End: "04:00"}, at(31, 3, 0), CURFEW_ENFORCED, true},
+		{"fall back, first 02:30", night, fallBack(2, 30, true), CURFEW_ENFORCED, true},
+		{"fall back, second 02:30", night, fallBack(2, 30, false), CURFEW_ENFORCED, true},
+		{"fall back, end", night, fallBack(6, 0, false), CURFEW_OFF, false},
+		{"fall back, second hour", curfewConfig{Start: "02:00", End: "03:00"}, fallBack(2, 30, false), CURFEW_ENFORCED, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if phase := tt.c.At(tt.t); phase != tt.phase {
+				t.Errorf("phase %s at %s, want %s", phase, tt.t, tt.phase)
+			}
+			if closed := tt.c.Closed(tt.t); closed != tt.closed {
+				t.Errorf("closed %v at %s, want %v", closed, tt.t, tt.closed)
+			}
+		})
+	}
+}
+
+func TestCurfewValidate(t *testing.T) {
+	for _, c := range []curfewConfig{
+		{Start: "22:00", End: "22:00"},
+		{Start: "24:00", End: "06:00"},
+		{Start: "22:00", End: "6am"},
+		{Start: "22:00", End: "23:00", GraceMinutes: 60},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%+v is valid", c)
+		}
+	}
+}
+
+// Advances the test clock to the next time the time of day is d.
+func advanceToTimeOfDay(d time.Duration) {
+	testClock.Advance((d - sinceMidnight(testClock.Now()) + 24*time.Hour) % (24 * time.Hour))
+}
+
+func TestCurfewHandler(t *testing.T) {
+	advanceToTimeOfDay(21*time.Hour + 50*time.Minute)
+	config := &AuthboxConfig{Curfew: &curfewConfig{Start: "22:00", End: "06:00", GraceMinutes: 30, WarningMinutes: 10}}
+	state := &State{state: STATE_IDLE, curfew: CURFEW_OFF}
+	bus := NewBus()
+	var warnings int
+	var ended []EndSession
+	Subscribe(bus, func(CurfewWarning) { warnings++ })
+	Subscribe(bus, func(e EndSession) { ended = append(ended, e) })
+	curfew := NewCurfew(config, state)
+	curfew.Subscribe(bus)
+	Publish(bus, Started{})
+	defer curfew.check.Stop()
+	// Minutes after 21:50 → phase.
+	want := map[int]string{0: CURFEW_OFF, 9: CURFEW_OFF, 10: CURFEW_CLOSED, 30: CURFEW_WARNING, 39: CURFEW_WARNING, 40: CURFEW_ENFORCED, 8*60 + 9: CURFEW_ENFORCED, 8*60 + 10: CURFEW_OFF}
+	for minute := 0; minute <= 8*60+10; minute++ {
+		if minute > 0 {
+			testClock.Advance(time.Minute)
+			bus.RunTimers()
+		}
+		if phase, ok := want[minute]; ok && state.curfew != phase {
+			t.Errorf("phase %s at minute %d, want %s", state.curfew, minute, phase)
+		}
+		if minute == 10 && !state.curfewClosed {
+			t.Error("closed curfew does not refuse badges")
+		}
+	}
+	if state.curfewClosed {
+		t.Error("curfew still refuses badges once over")
+	}
+	// Reminded every minute of the warning phase, until the session is ended.
+	if warnings != 10 {
+		t.Errorf("got %d warnings, want 10", warnings)
+	}
+	if len(ended) != 1 || !ended[0].Graceful {
+		t.Errorf("ended %+v, want a single graceful end", ended)
+	}
+}
@@ -0,0 +1,221 @@
+package gauthbox
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"log/slog"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const DISPLAY_DRIVER_SSD1306 = "ssd1306"
+const DISPLAY_DRIVER_SH1106 = "sh1106"
+
+const DISPLAY_WIDTH = 128
+const DISPLAY_HEIGHT = 64
+
+type displayConfig struct {
+	// One of DISPLAY_DRIVER_*.
+	Driver  string `json:"driver"`
+	I2cBus  int    `json:"i2c_bus"`
+	Address uint16 `json:"address"`
+}
+
+// What the status display shows. Deadline, if non-zero, is rendered as a
+// countdown refreshed every second.
+type DisplayStatus struct {
+	State    string
+	Member   string
+	Deadline time.Time
+	Error    string
+}
+
+// Creates the channel the state machine shows statuses on, see ShowLatest.
+func NewDisplayChannel() chan DisplayStatus {
+	return make(chan DisplayStatus, 1)
+}
+
+// Shows the status on the display without waiting for it to draw: a status
+// not picked up yet by the display is replaced.
+func ShowLatest(display chan DisplayStatus, s DisplayStatus) {
+	for {
+		select {
+		case display <- s:
+			return
+		default:
+		}
+		select {
+		case <-display:
+		default:
+		}
+	}
+}
+
+// Shows the state on the displays, with the messages of the state machine and
+// the denied badge feedback.
+func SubscribeDisplays(bus *Bus, config *AuthboxConfig, displays []chan DisplayStatus) {
+	if len(displays) == 0 {
+		return
+	}
+	// As last changed.
+	var state State
+	show := func(errorMessage string) {
+		for _, display := range displays {
+			ShowLatest(display, DisplayStatus{
+				State:    state.ShortString(),
+				Member:   state.memberName,
+				Deadline: state.idleDeadline,
+				Error:    errorMessage,
+			})
+		}
+	}
+	Subscribe(bus, func(e StateChanged) {
+		state = e.State
+		show("")
+	})
+	Subscribe(bus, func(e DisplayMessage) { show(e.Text) })
+	Subscribe(bus, func(e BadgeDenied) {
+		if config.DeniedFeedback != nil && config.DeniedFeedback.Message != "" {
+			show(config.DeniedFeedback.Message)
+		} else {
+			show(e.Reason)
+		}
+	})
+}
+
+// Status display logic for 128x64 monochrome I2C OLEDs.
+// To change what is displayed, send a DisplayStatus to chan 'status' with
+// ShowLatest. The looper returns once ctx is done, releasing the device.
+func Display(ctx context.Context, c displayConfig, status <-chan DisplayStatus) (func(), error) {
+	if c.Address == 0 {
+		c.Address = 0x3c
+	}
+	dev, err := openI2cDevice(c.I2cBus, c.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err := oledInit(dev, c.Driver); err != nil {
+		return nil, fmt.Errorf("display init: %w", err)
+	}
+	return func() {
+		defer dev.Close()
+		ticker := time.NewTicker(time.Second)
+		ticker.Stop()
+		current := DisplayStatus{}
+		draw := func() {
+			if err := oledDraw(dev, c.Driver, renderStatus(current)); err != nil {
+				slog.Warn("display: could not draw", slog.Any("err", err))
+			}
+		}
+		draw()
+		alive := time.NewTicker(LIVENESS_INTERVAL)
+		defer alive.Stop()
+		Beat("display")
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-alive.C:
+				Beat("display")
+			case s := <-status:
+				current = s
+				if current.Deadline.IsZero() {
+					ticker.Stop()
+				} else {
+					ticker.Reset(time.Second)
+				}
+				draw()
+			case <-ticker.C:
+				draw()
+			}
+		}
+	}, nil
+}
+
+// Renders the status as four lines of text.
+func renderStatus(s DisplayStatus) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, DISPLAY_WIDTH, DISPLAY_HEIGHT))
+	lines := []string{s.State, s.Member, "", s.Error}
+	if !s.Deadline.IsZero() {
+		remaining := max(time.Until(s.Deadline).Round(time.Second), 0)
+		lines[2] = "left: " + remaining.String()
+	}
+	d := font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(color.White),
+		Face: basicfont.Face7x13,
+	}
+	for i, l := range lines {
+		d.Dot = fixed.P(0, 13*(i+1)-2)
+		d.DrawString(l)
+	}
+	return img
+}
+
+// Sends a sequence of commands to the controller.
+func oledCommand(dev *i2cDevice, cmds ...byte) error {
+	return dev.Write(append([]byte{0x00}, cmds...))
+}
+
+// Initializes the controller, switching the display on.
+func oledInit(dev *i2cDevice, driver string) error {
+	cmds := []byte{
+		0xae,       // display off
+		0xd5, 0x80, // clock divider
+		0xa8, DISPLAY_HEIGHT - 1, // multiplex ratio
+		0xd3, 0x00, // display offset
+		0x40,       // start line
+		0xa1,       // segment remap
+		0xc8,       // COM scan direction
+		0xda, 0x12, // COM pins
+		0x81, 0xcf, // contrast
+		0xd9, 0xf1, // pre-charge period
+		0xdb, 0x40, // VCOMH level
+		0xa4, // resume from RAM
+		0xa6, // normal (not inverted)
+	}
+	if driver != DISPLAY_DRIVER_SH1106 {
+		cmds = append(cmds,
+			0x8d, 0x14, // charge pump
+			0x20, 0x00, // horizontal addressing mode
+		)
+	}
+	cmds = append(cmds, 0xaf) // display on
+	return oledCommand(dev, cmds...)
+}
+
+// Sends the image to the display RAM, one 8-pixel high page at a time.
+func oledDraw(dev *i2cDevice, driver string, img *image.Gray) error {
+	for page := 0; page < DISPLAY_HEIGHT/8; page++ {
+		data := make([]byte, DISPLAY_WIDTH)
+		for x := range data {
+			for bit := 0; bit < 8; bit++ {
+				if img.GrayAt(x, page*8+bit).Y > 127 {
+					data[x] |= 1 << bit
+				}
+			}
+		}
+		var err error
+		if driver == DISPLAY_DRIVER_SH1106 {
+			// The SH1106 has 132 columns RAM, centered on the panel.
+			err = oledCommand(dev, 0xb0+byte(page), 0x02, 0x10)
+		} else {
+			err = oledCommand(dev, 0x21, 0, DISPLAY_WIDTH-1, 0x22, byte(page), byte(page))
+		}
+		if err != nil {
+			return err
+		}
+		// Keep I2C messages short, some adapters limit their size.
+		for i := 0; i < len(data); i += 32 {
+			if err := dev.Write(append([]byte{0x40}, data[i:i+32]...)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package gauthbox
+
+import "log/slog"
+
+// Follows the door or enclosure contact, which the relay depends on. Opening
+// the door while in use ends the session with the 'cut' action. Owns the
+// doorClosed field of the state.
+type Door struct {
+	config *AuthboxConfig
+	state  *State
+}
+
+func NewDoor(config *AuthboxConfig, state *State) *Door {
+	return &Door{config: config, state: state}
+}
+
+func (d *Door) Subscribe(bus *Bus) {
+	Subscribe(bus, func(e DoorSensed) {
+		s := d.state
+		s.doorClosed = e.Closed
+		if !e.Closed && s.state == STATE_IN_USE {
+			slog.Warn("door opened while in use", slog.String("action", d.config.DoorContact.OpenAction))
+			if d.config.DoorContact.OpenAction == DOOR_ACTION_CUT {
+				// Closing the door must not restart the machine: badge again.
+				Publish(bus, Tripped{Cause: TRIP_DOOR, Reason: "door opened"})
+				Publish(bus, EndSession{Message: "Door open"})
+				return
+			}
+		}
+		Publish(bus, UpdatePower{})
+		Publish(bus, StateUpdated{})
+	})
+}
@@ -0,0 +1,224 @@
+package gauthbox
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// SSD1680-based panels, e.g. 2.13" 250x122.
+const EINK_WIDTH = 250
+const EINK_HEIGHT = 122
+const EINK_RAM_ROW_BYTES = 16
+const EINK_BUSY_TIMEOUT = 10 * time.Second
+
+type einkConfig struct {
+	SpiBus        int `json:"spi_bus"`
+	SpiChipSelect int `json:"spi_cs"`
+	DcPin         Pin `json:"dc_pin"`
+	ResetPin      Pin `json:"reset_pin"`
+	BusyPin       Pin `json:"busy_pin"`
+	// Optional, returns the next reservation of the tool as plain text.
+	ReservationUrl string `json:"reservation_url,omitempty"`
+}
+
+type einkPanel struct {
+	spi   *spiDevice
+	dc    OutputLine
+	reset OutputLine
+	busy  PolledLine
+}
+
+// E-ink signage logic for SSD1680 SPI panels.
+// To change what is displayed, send a DisplayStatus to chan 'status' with
+// ShowLatest. The panel is only refreshed when the state, member or error changes, and is put to deep
+// sleep in between to respect refresh limits and save power.
+// The looper returns once ctx is done, releasing the panel.
+func EinkDisplay(ctx context.Context, c einkConfig, name string, status <-chan DisplayStatus) (func(), error) {
+	spi, err := openSpiDevice(c.SpiBus, c.SpiChipSelect, 4_000_000)
+	if err != nil {
+		return nil, err
+	}
+	p := &einkPanel{spi: spi}
+	if p.dc, err = Hw.RequestOutput(c.DcPin, 0); err != nil {
+		return nil, fmt.Errorf("dc pin: %w", err)
+	}
+	if p.reset, err = Hw.RequestOutput(c.ResetPin, 1); err != nil {
+		return nil, fmt.Errorf("reset pin: %w", err)
+	}
+	if p.busy, err = requestPolledInput(c.BusyPin); err != nil {
+		return nil, fmt.Errorf("busy pin: %w", err)
+	}
+	return func() {
+		defer p.close()
+		var shown *DisplayStatus
+		// Refreshing takes seconds: statuses sent meanwhile are replaced by the latest.
+		for {
+			var s DisplayStatus
+			select {
+			case s = <-status:
+			case <-ctx.Done():
+				return
+			}
+			if shown != nil && s.State == shown.State && s.Member == shown.Member && s.Error == shown.Error {
+				continue
+			}
+			shown = &s
+			lines := []string{name, "", s.State, s.Member, s.Error}
+			if c.ReservationUrl != "" {
+				next, err := fetchReservation(c.ReservationUrl)
+				if err != nil {
+					slog.Warn("eink: could not fetch next reservation", slog.Any("err", err))
+				} else if next != "" {
+					lines = append(lines, "", "Next: "+next)
+				}
+			}
+			if err := p.draw(renderEink(lines)); err != nil {
+				slog.Warn("eink: could not draw", slog.Any("err", err))
+			}
+		}
+	}, nil
+}
+
+// Retrieves the first line of the plain text body at url.
+func fetchReservation(url string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", err
+	}
+	next, _, _ := strings.Cut(strings.TrimSpace(string(body)), "\n")
+	return next, nil
+}
+
+// Renders lines of text in landscape orientation.
+func renderEink(lines []string) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, EINK_WIDTH, EINK_HEIGHT))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	d := font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(color.Black),
+		Face: basicfont.Face7x13,
+	}
+	for i, l := range lines {
+		d.Dot = fixed.P(2, 13*(i+1))
+		d.DrawString(l)
+	}
+	return img
+}
+
+// Releases the SPI device and the lines.
+func (p *einkPanel) close() {
+	p.spi.Close()
+	p.dc.Close()
+	p.reset.Close()
+	p.busy.Close()
+}
+
+// Waits for the controller to release its BUSY line.
+func (p *einkPanel) waitBusy() error {
+	deadline := time.Now().Add(EINK_BUSY_TIMEOUT)
+	for time.Now().Before(deadline) {
+		v, err := p.busy.Value()
+		if err != nil {
+			return err
+		}
+		if v == 0 {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("panel still busy after %s", EINK_BUSY_TIMEOUT)
+}
+
+// Sends a command, followed by its data bytes.
+func (p *einkPanel) command(cmd byte, data ...byte) error {
+	p.dc.SetValue(0)
+	if err := p.spi.Tx([]byte{cmd}, nil); err != nil {
+		return err
+	}
+	p.dc.SetValue(1)
+	// spidev transfers are limited to 4 KiB by default.
+	for i := 0; i < len(data); i += 4096 {
+		if err := p.spi.Tx(data[i:min(i+4096, len(data))], nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wakes up the panel, sends the image, refreshes and goes back to deep sleep.
+func (p *einkPanel) draw(img *image.Gray) error {
+	p.reset.SetValue(0)
+	time.Sleep(10 * time.Millisecond)
+	p.reset.SetValue(1)
+	time.Sleep(10 * time.Millisecond)
+	if err := p.waitBusy(); err != nil {
+		return err
+	}
+	// The RAM is portrait: rows along the long edge, 8 pixels per byte along the short one.
+	ram := make([]byte, EINK_RAM_ROW_BYTES*EINK_WIDTH)
+	for i := range ram {
+		ram[i] = 0xff
+	}
+	for x := 0; x < EINK_WIDTH; x++ {
+		for y := 0; y < EINK_HEIGHT; y++ {
+			if img.GrayAt(x, y).Y < 128 {
+				col := EINK_HEIGHT - 1 - y
+				ram[x*EINK_RAM_ROW_BYTES+col/8] &^= 0x80 >> (col % 8)
+			}
+		}
+	}
+	steps := []struct {
+		cmd  byte
+		data []byte
+	}{
+		{0x12, nil},                      // software reset
+		{0x01, []byte{0xf9, 0x00, 0x00}}, // driver output: 250 gates
+		{0x11, []byte{0x03}},             // data entry: X then Y increment
+		{0x44, []byte{0x00, EINK_RAM_ROW_BYTES - 1}},
+		{0x45, []byte{0x00, 0x00, 0xf9, 0x00}},
+		{0x3c, []byte{0x05}},       // border waveform
+		{0x21, []byte{0x00, 0x80}}, // display update control
+		{0x18, []byte{0x80}},       // internal temperature sensor
+		{0x4e, []byte{0x00}},
+		{0x4f, []byte{0x00, 0x00}},
+		{0x24, ram},
+		{0x22, []byte{0xf7}}, // full update sequence
+		{0x20, nil},          // activate
+	}
+	for _, s := range steps {
+		if err := p.command(s.cmd, s.data...); err != nil {
+			return err
+		}
+		if err := p.waitBusy(); err != nil {
+			return err
+		}
+	}
+	return p.command(0x10, 0x01) // deep sleep
+}
@@ -0,0 +1,88 @@
+package gauthbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// How many state transitions are queued while the events endpoint is unreachable.
+const EVENTS_QUEUE_SIZE = 100
+
+// Attempts to post an event before dropping it, waiting EVENTS_RETRY_DELAY in between.
+const EVENTS_ATTEMPTS = 3
+const EVENTS_RETRY_DELAY = 10 * time.Second
+
+// How long posting an event may take before the attempt fails.
+const EVENTS_POST_TIMEOUT = 10 * time.Second
+
+// A state transition, as posted to the command & control events endpoint.
+type StateEvent struct {
+	Time time.Time `json:"time"`
+	// Empty outside sessions.
+	SessionId string `json:"session_id,omitempty"`
+	// Hashed, like in session summaries. Empty outside sessions.
+	BadgeHash string `json:"badge_hash,omitempty"`
+	State     string `json:"state"`
+}
+
+func postStateEvent(url string, e StateEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), EVENTS_POST_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("events endpoint: %s", resp.Status)
+	}
+	return nil
+}
+
+// State transitions logic. Posts the reported events to the URL, in order, one
+// at a time. Reporting the same state and session again is a no-op.
+func StateEvents(url string) (func(), func(StateEvent)) {
+	queue := make(chan StateEvent, EVENTS_QUEUE_SIZE)
+	var last StateEvent
+	report := func(e StateEvent) {
+		if e.State == last.State && e.SessionId == last.SessionId {
+			return
+		}
+		last = e
+		select {
+		case queue <- e:
+		default:
+			slog.Warn("events queue full, dropping state transition", slog.String("state", e.State))
+		}
+	}
+	looper := func() {
+		for e := range queue {
+			for attempt := 1; ; attempt++ {
+				err := postStateEvent(url, e)
+				if err == nil {
+					break
+				}
+				if attempt == EVENTS_ATTEMPTS {
+					slog.Warn("could not post state transition, dropping it", slog.Any("err", err))
+					break
+				}
+				time.Sleep(EVENTS_RETRY_DELAY)
+			}
+		}
+	}
+	return looper, report
+}
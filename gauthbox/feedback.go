@@ -0,0 +1,95 @@
+package gauthbox
+
+import (
+	"log/slog"
+	"time"
+)
+
+const RELAY_FEEDBACK_DEFAULT_MISMATCH = 500 * time.Millisecond
+
+type relayFeedbackConfig struct {
+	inputConfig
+	// How long the commanded state and the aux contact may disagree, e.g. while
+	// the contactor is moving.
+	MismatchMs uint32 `json:"mismatch_ms,omitempty"`
+}
+
+type RelayFault struct {
+	Role  string
+	Fault bool
+}
+
+// Relay feedback logic. Compares the state commanded through 'commanded' with
+// the relay's auxiliary contact. The event stream yields true when they have
+// disagreed for longer than the configured duration (wiring fault, welded or
+// stuck contactor), then false once they agree again.
+// MQTT: registers as a binary sensor with a 'problem' device class.
+func RelayFeedback(c relayConfig, commanded <-chan bool) (*DeviceRet[bool], error) {
+	feedback := make(chan bool)
+	_, initial, err := Hw.WatchInput(c.Feedback.inputConfig, func(closed bool) {
+		feedback <- closed
+	})
+	if err != nil {
+		return nil, err
+	}
+	tolerance := time.Duration(c.Feedback.MismatchMs) * time.Millisecond
+	if tolerance == 0 {
+		tolerance = RELAY_FEEDBACK_DEFAULT_MISMATCH
+	}
+	id := relayId(c)
+	events := make(chan bool)
+	looper := func() {
+		isOn, closed, fault := false, initial, false
+		mismatch := time.NewTimer(0)
+		mismatch.Stop()
+		check := func() {
+			if isOn != closed {
+				mismatch.Reset(tolerance)
+				return
+			}
+			mismatch.Stop()
+			if fault {
+				fault = false
+				slog.Info("relay: feedback agrees again", slog.String("relay", id))
+				events <- false
+			}
+		}
+		check()
+		for {
+			select {
+			case isOn = <-commanded:
+				check()
+			case closed = <-feedback:
+				check()
+			case <-mismatch.C:
+				if !fault {
+					fault = true
+					slog.Error("relay: feedback mismatch, wiring fault", slog.String("relay", id), slog.Bool("commanded", isOn), slog.Bool("feedback", closed))
+					events <- true
+				}
+			}
+		}
+	}
+	return &DeviceRet[bool]{
+		Looper: looper,
+		Events: stampEvents(events),
+		OnEvent: func(fault bool, name string, publish PublishFunc) {
+			publish(name+"/"+id+"/fault", map[bool]string{false: "OFF", true: "ON"}[fault])
+		},
+		Discovery: MqttDiscovery{
+			Component: "binary_sensor",
+			Id:        id + "_fault",
+			Announce: func(name, topic string) interface{} {
+				return struct {
+					Device      MqttDevice `json:"device"`
+					DeviceClass string     `json:"device_class"`
+					StateTopic  string     `json:"state_topic"`
+				}{
+					Device:      MqttDevice{Name: "Relay feedback (" + id + ") on " + name},
+					DeviceClass: "problem",
+					StateTopic:  topic + "/" + name + "/" + id + "/fault",
+				}
+			},
+		},
+	}, nil
+}
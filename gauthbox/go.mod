@@ -7,11 +7,12 @@ require (
 	github.com/eclipse/paho.mqtt.golang v1.5.0
 	github.com/holoplot/go-evdev v0.0.0-20240306072622-217e18f17db1
 	github.com/warthog618/go-gpiocdev v0.9.0
+	golang.org/x/image v0.18.0
+	golang.org/x/sys v0.22.0
 )
 
 require (
 	github.com/gorilla/websocket v1.5.3 // indirect
 	golang.org/x/net v0.27.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
-	golang.org/x/sys v0.22.0 // indirect
 )
@@ -0,0 +1,90 @@
+package gauthbox
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/warthog618/go-gpiocdev"
+)
+
+// Retries of a line held by another consumer, doubling the delay each time.
+const GPIO_CONFLICT_RETRIES = 6
+const GPIO_CONFLICT_FIRST_DELAY = 100 * time.Millisecond
+
+var gpioConflicts = struct {
+	mu sync.Mutex
+	// "<chip>:<offset>" → consumer holding the line.
+	byLine map[string]string
+}{byLine: map[string]string{}}
+
+// Returns the lines currently held by another consumer, as "<chip>:<offset> held by <consumer>".
+func GpioConflicts() []string {
+	gpioConflicts.mu.Lock()
+	defer gpioConflicts.mu.Unlock()
+	conflicts := []string{}
+	for line, consumer := range gpioConflicts.byLine {
+		conflicts = append(conflicts, line+" held by "+consumer)
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// Requests a line, retrying with backoff while another consumer (another
+// process, a kernel driver or a device tree overlay) holds it.
+func requestLine(chip *gpiocdev.Chip, offset int, options ...gpiocdev.LineReqOption) (*gpiocdev.Line, error) {
+	key := fmt.Sprintf("%s:%d", chip.Name, offset)
+	delay := GPIO_CONFLICT_FIRST_DELAY
+	for attempt := 0; ; attempt++ {
+		line, err := chip.RequestLine(offset, options...)
+		if err == nil {
+			gpioConflicts.mu.Lock()
+			delete(gpioConflicts.byLine, key)
+			gpioConflicts.mu.Unlock()
+			gpioChips.mu.Lock()
+			gpioChips.lines = append(gpioChips.lines, line)
+			gpioChips.mu.Unlock()
+			return line, nil
+		}
+		if !errors.Is(err, syscall.EBUSY) {
+			return nil, err
+		}
+		consumer := "unknown consumer"
+		if info, err := chip.LineInfo(offset); err == nil && info.Consumer != "" {
+			consumer = "'" + info.Consumer + "'"
+		}
+		gpioConflicts.mu.Lock()
+		gpioConflicts.byLine[key] = consumer
+		gpioConflicts.mu.Unlock()
+		if attempt == GPIO_CONFLICT_RETRIES {
+			return nil, fmt.Errorf("line %s is held by %s: %w", key, consumer, err)
+		}
+		slog.Warn("gpio: line busy, retrying", slog.String("line", key), slog.String("consumer", consumer), slog.Duration("in", delay))
+		go func() {
+			SdNotifyStatus("waiting for GPIO " + key + " held by " + consumer)
+			// Leave room for the attempt after the delay.
+			SdNotifyExtendTimeout(delay + 10*time.Second)
+		}()
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Releases all requested lines and open chips. Depending on the GPIO driver,
+// outputs keep their last value.
+func CloseGpio() {
+	gpioChips.mu.Lock()
+	defer gpioChips.mu.Unlock()
+	for _, l := range gpioChips.lines {
+		l.Close()
+	}
+	for _, c := range gpioChips.byLabel {
+		c.Close()
+	}
+	gpioChips.lines = nil
+	gpioChips.byLabel = map[string]*gpiocdev.Chip{}
+}
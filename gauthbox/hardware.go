@@ -0,0 +1,313 @@
+package gauthbox
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/holoplot/go-evdev"
+)
+
+// An output GPIO line, either on the SoC GPIO chip or on an expander.
+type OutputLine interface {
+	SetValue(value int) error
+	Close() error
+}
+
+// A source of key events, e.g. the badge reader.
+type InputDevice interface {
+	Grab() error
+	ReadOne() (*evdev.InputEvent, error)
+	Close() error
+}
+
+// An on-board LED, e.g. /sys/class/leds/ACT.
+type SystemLed interface {
+	Set(on bool) error
+}
+
+// Access to the hardware used by the devices. Defaults to the real hardware;
+// set Hw to a MockHardware to run on machines without it.
+type Hardware interface {
+	// Requests an output line with the given initial raw value.
+	RequestOutput(p Pin, value int) (OutputLine, error)
+	// Watches an input line, calling onChange with the logical (ActiveLow-adjusted)
+	// level on each debounced transition. Also returns the logical level at request time.
+	WatchInput(c inputConfig, onChange func(high bool)) (io.Closer, bool, error)
+	OpenBadgeReader(c badgeReaderConfig) (InputDevice, error)
+	// Returns the named on-board LED, taking control of it from the kernel.
+	SystemLed(name string) SystemLed
+}
+
+var Hw Hardware = realHardware{}
+
+type realHardware struct{}
+
+func (realHardware) RequestOutput(p Pin, value int) (OutputLine, error) {
+	return requestOutput(p, value)
+}
+
+func (realHardware) WatchInput(c inputConfig, onChange func(high bool)) (io.Closer, bool, error) {
+	return watchInput(c, onChange)
+}
+
+func (realHardware) OpenBadgeReader(c badgeReaderConfig) (InputDevice, error) {
+	return findBadgeReader(c)
+}
+
+func (realHardware) SystemLed(name string) SystemLed {
+	os.WriteFile("/sys/class/leds/"+name+"/trigger", []byte("none"), 0)
+	return sysfsLed(name)
+}
+
+type sysfsLed string
+
+func (l sysfsLed) Set(on bool) error {
+	return os.WriteFile("/sys/class/leds/"+string(l)+"/brightness", []byte(map[bool]string{false: "0", true: "1"}[on]), 0)
+}
+
+// In-memory hardware. Outputs record their values, inputs and the badge
+// reader are driven by the Set* and Type* methods.
+type MockHardware struct {
+	// Optional, called with the pin or LED name each time an output is set.
+	OnOutput func(name string, value int)
+
+	mu      sync.Mutex
+	outputs map[Pin]*MockLine
+	inputs  map[Pin]*mockInput
+	leds    map[string]*MockLine
+	badge   *MockInputDevice
+}
+
+func NewMockHardware() *MockHardware {
+	return &MockHardware{
+		outputs: map[Pin]*MockLine{},
+		inputs:  map[Pin]*mockInput{},
+		leds:    map[string]*MockLine{},
+		badge:   &MockInputDevice{events: make(chan *evdev.InputEvent, 64), done: make(chan struct{})},
+	}
+}
+
+// An in-memory output line or LED, keeping track of the values it was set to.
+type MockLine struct {
+	mu     sync.Mutex
+	values []int
+	onSet  func(value int)
+}
+
+func (l *MockLine) SetValue(value int) error {
+	l.mu.Lock()
+	l.values = append(l.values, value)
+	l.mu.Unlock()
+	if l.onSet != nil {
+		l.onSet(value)
+	}
+	return nil
+}
+
+func (l *MockLine) Set(on bool) error {
+	return l.SetValue(map[bool]int{false: 0, true: 1}[on])
+}
+
+func (l *MockLine) Close() error {
+	return nil
+}
+
+// Returns the current raw value of the line.
+func (l *MockLine) Value() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.values) == 0 {
+		return 0
+	}
+	return l.values[len(l.values)-1]
+}
+
+// Returns all the raw values the line was set to, in order.
+func (l *MockLine) History() []int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]int{}, l.values...)
+}
+
+type mockInput struct {
+	c        inputConfig
+	high     bool
+	onChange func(high bool)
+}
+
+func (h *MockHardware) RequestOutput(p Pin, value int) (OutputLine, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	l := &MockLine{values: []int{value}, onSet: h.notifier(p.String())}
+	h.outputs[p] = l
+	return l, nil
+}
+
+func (h *MockHardware) WatchInput(c inputConfig, onChange func(high bool)) (io.Closer, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	in, ok := h.inputs[c.Pin]
+	if !ok {
+		in = &mockInput{}
+		h.inputs[c.Pin] = in
+	}
+	in.c, in.onChange = c, onChange
+	return closerFunc(func() error { return nil }), in.high, nil
+}
+
+func (h *MockHardware) OpenBadgeReader(c badgeReaderConfig) (InputDevice, error) {
+	return h.badge, nil
+}
+
+func (h *MockHardware) SystemLed(name string) SystemLed {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	l := &MockLine{onSet: h.notifier("led:" + name)}
+	h.leds[name] = l
+	return l
+}
+
+func (h *MockHardware) notifier(name string) func(value int) {
+	return func(value int) {
+		if h.OnOutput != nil {
+			h.OnOutput(name, value)
+		}
+	}
+}
+
+// Returns the output line requested for that pin, nil if none.
+func (h *MockHardware) Output(p Pin) *MockLine {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.outputs[p]
+}
+
+// Returns the named on-board LED, nil if never requested.
+func (h *MockHardware) Led(name string) *MockLine {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.leds[name]
+}
+
+// Sets the logical level of an input pin, notifying its watcher on change.
+// Can be called before the pin is watched to set its initial level.
+func (h *MockHardware) SetInput(p Pin, high bool) {
+	h.mu.Lock()
+	in, ok := h.inputs[p]
+	if !ok {
+		in = &mockInput{}
+		h.inputs[p] = in
+	}
+	changed := in.high != high
+	in.high = high
+	onChange := in.onChange
+	h.mu.Unlock()
+	if changed && onChange != nil {
+		onChange(high)
+	}
+}
+
+// Types the badge ID on the mock badge reader, followed by Enter.
+func (h *MockHardware) TypeBadge(id string) error {
+	return h.badge.Type(id)
+}
+
+// An in-memory keyboard-like input device. Typing on it once closed fails.
+type MockInputDevice struct {
+	events chan *evdev.InputEvent
+	mu     sync.Mutex
+	closed bool
+	// Closed with the device, unblocking the readers and typists. The events
+	// channel itself is never closed, as typing may be underway.
+	done chan struct{}
+}
+
+func (d *MockInputDevice) Grab() error {
+	return nil
+}
+
+func (d *MockInputDevice) ReadOne() (*evdev.InputEvent, error) {
+	select {
+	case <-d.done:
+		// Like a real device, drops the events not read yet.
+		return nil, io.EOF
+	default:
+	}
+	select {
+	case e := <-d.events:
+		return e, nil
+	case <-d.done:
+		return nil, io.EOF
+	}
+}
+
+func (d *MockInputDevice) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.closed {
+		d.closed = true
+		close(d.done)
+	}
+	return nil
+}
+
+func (d *MockInputDevice) send(e *evdev.InputEvent) error {
+	select {
+	case d.events <- e:
+		return nil
+	case <-d.done:
+		return errors.New("input device closed")
+	}
+}
+
+// Types the string, followed by Enter, as key press events.
+func (d *MockInputDevice) Type(s string) error {
+	d.mu.Lock()
+	closed := d.closed
+	d.mu.Unlock()
+	if closed {
+		return errors.New("input device closed")
+	}
+	for _, r := range s {
+		code, shift, ok := keyForRune(r)
+		if !ok {
+			return errors.New("no key for character '" + string(r) + "'")
+		}
+		if shift {
+			if err := d.send(&evdev.InputEvent{Type: evdev.EV_KEY, Code: evdev.KEY_LEFTSHIFT, Value: 1}); err != nil {
+				return err
+			}
+		}
+		if err := d.send(&evdev.InputEvent{Type: evdev.EV_KEY, Code: code, Value: 1}); err != nil {
+			return err
+		}
+	}
+	return d.send(&evdev.InputEvent{Type: evdev.EV_KEY, Code: evdev.KEY_ENTER, Value: 1})
+}
+
+// Returns the US layout key code producing the rune, and whether shift is needed.
+func keyForRune(r rune) (evdev.EvCode, bool, bool) {
+	for code, k := range usKeyMap {
+		if k.normal == string(r) {
+			return code, false, true
+		}
+		if k.cap == string(r) {
+			return code, true, true
+		}
+	}
+	for code := evdev.EvCode(evdev.KEY_Q); code <= evdev.KEY_M; code++ {
+		name := evdev.CodeName(evdev.EV_KEY, code)
+		if len(name) != len("KEY_A") {
+			continue
+		}
+		switch name[4] {
+		case byte(r):
+			return code, true, true
+		case byte(r) - 'a' + 'A':
+			return code, false, true
+		}
+	}
+	return 0, false, false
+}
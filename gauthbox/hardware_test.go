@@ -0,0 +1,36 @@
+package gauthbox
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMockInputDeviceClose(t *testing.T) {
+	hw := NewMockHardware()
+	if err := hw.TypeBadge("1234"); err != nil {
+		t.Fatal(err)
+	}
+	// More than the buffer holds: blocks until the device closes.
+	typed := make(chan error)
+	go func() { typed <- hw.TypeBadge(strings.Repeat("0", 100)) }()
+	time.Sleep(10 * time.Millisecond)
+	hw.badge.Close()
+	select {
+	case err := <-typed:
+		if err == nil {
+			t.Error("typing on a closed device succeeded")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("closing did not unblock typing")
+	}
+	if err := hw.TypeBadge("1234"); err == nil {
+		t.Error("typing on a closed device succeeded")
+	}
+	if _, err := hw.badge.ReadOne(); err != io.EOF {
+		t.Errorf("read %v from a closed device, want EOF", err)
+	}
+	// Closing again is harmless.
+	hw.badge.Close()
+}
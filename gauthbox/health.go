@@ -0,0 +1,75 @@
+package gauthbox
+
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Whether the badge reader reads events fine, as opposed to e.g. unplugged.
+var badgeReaderHealthy atomic.Bool
+
+// Health of the box, for uptime monitors and commissioning.
+type Health struct {
+	Ok    bool   `json:"ok"`
+	State string `json:"state"`
+	// Whether the badge reader reads fine.
+	BadgeReader bool `json:"badge_reader"`
+	// Loopers that stopped reporting in, e.g. a stuck GPIO line watcher.
+	Wedged []string `json:"wedged"`
+	// Roles of the relays whose feedback disagrees with the commanded state.
+	WiringFaults []string `json:"wiring_faults"`
+	// "connected" or "disconnected", empty if MQTT is not configured.
+	Mqtt string `json:"mqtt,omitempty"`
+	// "reachable" or "unreachable" as of the last badge authentication or
+	// connectivity probe, whichever is the most recent, "unknown" before the
+	// first. "failing" if the last authentication got a 5xx.
+	AuthBackend string    `json:"auth_backend"`
+	LastAuth    time.Time `json:"last_auth"`
+	// Like AuthBackend, as of the last connectivity probe; empty without the
+	// connectivity monitor.
+	CommandControl string `json:"command_control,omitempty"`
+	// Why the clock is not trusted, empty if it is.
+	Clock string `json:"clock,omitempty"`
+}
+
+// Returns the health as far as the state machine knows.
+func (s State) Health(mqtt bool) Health {
+	h := Health{State: s.ShortString(), WiringFaults: []string{}, Clock: s.clockProblem}
+	for role := range s.wiringFaults {
+		h.WiringFaults = append(h.WiringFaults, role)
+	}
+	slices.Sort(h.WiringFaults)
+	if mqtt {
+		h.Mqtt = map[bool]string{false: "disconnected", true: "connected"}[s.mqttConnected]
+	}
+	return h
+}
+
+// Completes the health with the hardware and backend checks, as of now.
+func (h Health) Refresh() Health {
+	h.BadgeReader = badgeReaderHealthy.Load()
+	h.Wedged = Wedged()
+	metrics.mu.Lock()
+	h.LastAuth = metrics.lastAuthAt
+	switch metrics.lastAuthOutcome {
+	case "":
+		h.AuthBackend = "unknown"
+	case AUTH_OUTCOME_TIMEOUT, AUTH_OUTCOME_ERROR:
+		h.AuthBackend = "unreachable"
+	case AUTH_OUTCOME_5XX:
+		h.AuthBackend = "failing"
+	default:
+		h.AuthBackend = "reachable"
+	}
+	metrics.mu.Unlock()
+	if r, ok := lastReachability(CONNECTIVITY_AUTH_BACKEND); ok && r.At.After(h.LastAuth) {
+		h.AuthBackend = map[bool]string{false: "unreachable", true: "reachable"}[r.Reachable]
+	}
+	if r, ok := lastReachability(CONNECTIVITY_COMMAND_CONTROL); ok {
+		h.CommandControl = map[bool]string{false: "unreachable", true: "reachable"}[r.Reachable]
+	}
+	h.Ok = h.BadgeReader && len(h.Wedged) == 0 && len(h.WiringFaults) == 0 &&
+		h.Mqtt != "disconnected" && h.AuthBackend != "unreachable" && h.AuthBackend != "failing" && h.Clock == ""
+	return h
+}
@@ -0,0 +1,82 @@
+package gauthbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How many events the history keeps.
+const HISTORY_SIZE = 500
+
+// Kinds of history events.
+const HISTORY_SCAN = "scan"
+const HISTORY_STATE = "state"
+const HISTORY_DENIED = "denied"
+const HISTORY_LOG = "log"
+
+// Sub-topic on which the history is published when requested over MQTT.
+const HISTORY_TOPIC = "history"
+
+type HistoryEvent struct {
+	Time time.Time `json:"time"`
+	// One of HISTORY_*.
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+// Recent events, for "what happened at 19:42" without journald access.
+var history = struct {
+	mu     sync.Mutex
+	events []HistoryEvent
+}{}
+
+// Appends an event to the history, dropping the oldest past HISTORY_SIZE.
+func Record(kind, detail string) {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	history.events = append(history.events, HistoryEvent{Time: time.Now(), Kind: kind, Detail: detail})
+	if len(history.events) > HISTORY_SIZE {
+		history.events = history.events[len(history.events)-HISTORY_SIZE:]
+	}
+}
+
+// Returns the events since the time, oldest first.
+func History(since time.Time) []HistoryEvent {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	events := []HistoryEvent{}
+	for _, e := range history.events {
+		if !e.Time.Before(since) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// Publishes the events since the time, as JSON.
+func PublishHistory(since time.Time, name string, publish PublishFunc) {
+	b, err := json.Marshal(History(since))
+	if err != nil {
+		return
+	}
+	publish(name+"/"+HISTORY_TOPIC, string(b))
+}
+
+// Parses the start of a history query: empty for all, an RFC 3339 time, or
+// "HH:MM" for today at that local time.
+func parseHistorySince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := parseTimeOfDay(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected an RFC 3339 time or HH:MM")
+	}
+	y, m, day := time.Now().Date()
+	return time.Date(y, m, day, 0, 0, 0, 0, time.Local).Add(d), nil
+}
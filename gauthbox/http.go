@@ -0,0 +1,187 @@
+package gauthbox
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many state transitions the local HTTP API keeps.
+const HTTP_RECENT_EVENTS = 50
+
+// Local HTTP API, for staff on the workshop LAN to manage the box even when
+// MQTT or command & control are down.
+type httpConfig struct {
+	// Address to listen on, e.g. ":8080".
+	Listen string `json:"listen"`
+	// Required as a bearer token on all requests but /healthz.
+	Token string `json:"token"`
+	// Whether to serve the Go profiles under /debug/pprof/, e.g. to find a leak.
+	Pprof bool `json:"pprof,omitempty"`
+}
+
+// State of the box as reported by the local HTTP API.
+type HttpStatus struct {
+	State      string `json:"state"`
+	Details    string `json:"details"`
+	MemberName string `json:"member_name,omitempty"`
+	// Hashed, like in session summaries.
+	BadgeHash string `json:"badge_hash,omitempty"`
+	Relay     bool   `json:"relay"`
+	Lockout   string `json:"lockout,omitempty"`
+	// Zero when not running.
+	IdleDeadline    time.Time `json:"idle_deadline"`
+	SessionDeadline time.Time `json:"session_deadline"`
+	Health          Health    `json:"health"`
+}
+
+type HttpEvent struct {
+	Time  time.Time `json:"time"`
+	State string    `json:"state"`
+}
+
+// Local HTTP API logic. Serves:
+//
+//	GET  /status       status and recent state transitions, as JSON
+//	GET  /healthz      health, as JSON, with a 503 if unhealthy; unauthenticated
+//	GET  /history      recent events, as JSON, since the optional 'since' query
+//	                   parameter (RFC 3339 or HH:MM today)
+//	POST /session/end  ends the session, once the machine stops if in use
+//	POST /lockout      puts the tool out of service with the body as reason,
+//	                   or back in service with an empty body or "OFF"
+//	POST /reload       fetches the config again, keeping the running session
+//	POST /restart      restarts the daemon, keeping the running session
+//	POST /reboot       reboots the host
+//	GET  /debug/pprof/ Go profiles, if enabled, see net/http/pprof
+//
+// Commands are sent as MqttEvent, like MQTT commands. Report the state with
+// the returned func.
+func HttpServer(c httpConfig) (*DeviceRet[MqttEvent], func(HttpStatus), error) {
+	if c.Token == "" {
+		return nil, nil, errors.New("a token is required")
+	}
+	listener, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var mu sync.Mutex
+	var status HttpStatus
+	events := []HttpEvent{}
+	report := func(s HttpStatus) {
+		mu.Lock()
+		defer mu.Unlock()
+		if s.State != status.State {
+			events = append(events, HttpEvent{Time: Clk.Now(), State: s.State})
+			if len(events) > HTTP_RECENT_EVENTS {
+				events = events[len(events)-HTTP_RECENT_EVENTS:]
+			}
+		}
+		status = s
+	}
+
+	commands := make(chan MqttEvent)
+	command := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			payload, err := io.ReadAll(io.LimitReader(r.Body, 256))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			select {
+			case commands <- MqttEvent{Command: name, Payload: strings.TrimSpace(string(payload))}:
+				w.WriteHeader(http.StatusAccepted)
+			case <-r.Context().Done():
+			}
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		s := status
+		s.Health = s.Health.Refresh()
+		b, err := json.Marshal(struct {
+			HttpStatus
+			Events []HttpEvent `json:"events"`
+		}{s, events})
+		mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		health := status.Health.Refresh()
+		mu.Unlock()
+		b, err := json.Marshal(health)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !health.Ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(b)
+	})
+	mux.HandleFunc("GET /history", func(w http.ResponseWriter, r *http.Request) {
+		since, err := parseHistorySince(r.URL.Query().Get("since"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, err := json.Marshal(History(since))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+	mux.HandleFunc("POST /session/end", command("end_session"))
+	mux.HandleFunc("POST /lockout", command("lockout"))
+	mux.HandleFunc("POST /reload", command("reload"))
+	mux.HandleFunc("POST /restart", command("restart"))
+	mux.HandleFunc("POST /reboot", command("reboot"))
+	if c.Pprof {
+		mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+		mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if r.URL.Path != "/healthz" && subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	return &DeviceRet[MqttEvent]{
+		Looper: func() {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("http: stopped serving", slog.Any("error", err))
+			}
+		},
+		Events:   stampEvents(commands),
+		Shutdown: func() { server.Close() },
+	}, report, nil
+}
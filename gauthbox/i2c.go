@@ -0,0 +1,48 @@
+package gauthbox
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// From linux/i2c-dev.h.
+const I2C_SLAVE = 0x0703
+
+// A device on an I2C bus, addressed through /dev/i2c-<bus>.
+type i2cDevice struct {
+	f *os.File
+}
+
+// Opens the I2C device at 7-bit address addr on the given bus.
+func openI2cDevice(bus int, addr uint16) (*i2cDevice, error) {
+	f, err := os.OpenFile(fmt.Sprintf("/dev/i2c-%d", bus), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.IoctlSetInt(int(f.Fd()), I2C_SLAVE, int(addr)); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not address I2C device 0x%02x on bus %d: %w", addr, bus, err)
+	}
+	return &i2cDevice{f: f}, nil
+}
+
+// Writes a single I2C message.
+func (d *i2cDevice) Write(b []byte) error {
+	_, err := d.f.Write(b)
+	return err
+}
+
+// Writes the register address, then reads len(b) bytes from it.
+func (d *i2cDevice) ReadRegister(reg byte, b []byte) error {
+	if err := d.Write([]byte{reg}); err != nil {
+		return err
+	}
+	_, err := d.f.Read(b)
+	return err
+}
+
+func (d *i2cDevice) Close() error {
+	return d.f.Close()
+}
@@ -0,0 +1,210 @@
+package gauthbox
+
+import (
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The idle timeout of the sessions, with its warning phase and the dormant
+// state after which the member must badge again. Follows the session events on
+// the bus, and ends the session once the timeout is reached.
+// Owns the idle fields of the state: idleDeadline, idleTimeout, idleHeld,
+// dormant and warning.
+type IdleTimer struct {
+	state *State
+	bus   *Bus
+	// Idle time only accrues while it holds, if set.
+	condition func() bool
+	// Default timeout, length of the warning phase at its end, and time after
+	// which the session goes dormant; zero to disable the latter two.
+	duration, warning, reauth time.Duration
+	// Fires at the start of the warning phase, if any, then at the deadline.
+	timeout *BusTimer
+	dormant *BusTimer
+}
+
+func NewIdleTimer(config *AuthboxConfig, state *State, condition func() bool) *IdleTimer {
+	t := &IdleTimer{state: state, condition: condition}
+	t.duration = time.Duration(config.IdleSeconds) * time.Second
+	if config.Mode == MODE_DOOR {
+		t.duration = time.Duration(config.UnlockSeconds) * time.Second
+		if t.duration == 0 {
+			t.duration = DEFAULT_UNLOCK_DURATION
+		}
+	}
+	t.warning = time.Duration(config.IdleWarningSeconds) * time.Second
+	if config.Mode == MODE_DOOR || t.warning >= t.duration {
+		t.warning = 0
+	}
+	t.reauth = time.Duration(config.ReauthIdleMinutes) * time.Minute
+	if config.Mode == MODE_DOOR || config.Mode == MODE_ALWAYS_ON_METERED || t.reauth >= t.duration {
+		t.reauth = 0
+	}
+	return t
+}
+
+// Compiles the idle_when condition of the config, nil if none, on the inputs
+// of the state.
+func compileIdleCondition(config *AuthboxConfig, state *State) (func() bool, error) {
+	if config.IdleWhen == "" {
+		return nil, nil
+	}
+	lookup := func(input string) (func() bool, bool) {
+		kind, id, _ := strings.Cut(input, ".")
+		switch {
+		case input == "current":
+			return func() bool { return state.currentHigh }, true
+		case input == "spinning":
+			return func() bool { return len(state.spinning) > 0 }, true
+		case kind == "spinning" && slices.ContainsFunc(config.Tachometers, func(c tachometerConfig) bool { return c.Id == id }):
+			return func() bool { return state.spinning[id] }, true
+		case input == "door_closed" && config.DoorContact != nil:
+			return func() bool { return state.doorClosed }, true
+		case kind == "interlock" && slices.ContainsFunc(config.Interlocks, func(c interlockConfig) bool { return c.Id == id }):
+			return func() bool { return !state.interlocksOpen[id] }, true
+		case input == "running" && config.Run != nil:
+			return func() bool { return state.running }, true
+		}
+		return nil, false
+	}
+	return compileCondition(config.IdleWhen, lookup)
+}
+
+// Subscribes to the session events that start and stop the idle timer. Must
+// come first: it holds or restarts the idle timer as the inputs of its
+// condition change, before the state is published.
+func (t *IdleTimer) Subscribe(bus *Bus) {
+	t.bus = bus
+	t.timeout = bus.NewTimer(t.onTimeout)
+	t.dormant = bus.NewTimer(t.onDormant)
+	Subscribe(bus, func(StateUpdated) { t.updateQuiescence() })
+	Subscribe(bus, func(SessionStarted) { t.reset() })
+	Subscribe(bus, func(e SessionRestored) { t.resume(e.Session.IdleDeadline) })
+	Subscribe(bus, func(SessionExtended) { t.resetIfIdle() })
+	Subscribe(bus, func(e MachineInUse) {
+		if e.InUse {
+			t.stop()
+		} else {
+			t.reset()
+		}
+	})
+	Subscribe(bus, func(SessionEnded) { t.stop() })
+	Subscribe(bus, func(e CommandReceived) {
+		if e.Command == "idle_timeout" {
+			t.override(e.Payload)
+		}
+	})
+}
+
+// Restarts the idle timeout, leaving the warning phase. Open access sessions do
+// not time out.
+func (t *IdleTimer) reset() {
+	s := t.state
+	s.warning = false
+	if s.openAccess {
+		return
+	}
+	if t.condition != nil && !t.condition() {
+		// Not quiescent: hold the idle timer.
+		s.idleHeld = true
+		t.timeout.Stop()
+		t.dormant.Stop()
+		s.idleDeadline = time.Time{}
+		return
+	}
+	s.idleHeld = false
+	d := t.duration
+	if s.idleOverride > 0 {
+		d = s.idleOverride
+	}
+	if t.warning > 0 && d > t.warning {
+		t.timeout.Reset(d - t.warning)
+	} else {
+		t.timeout.Reset(d)
+	}
+	s.idleDeadline = Clk.Now().Add(d)
+	s.idleTimeout = d
+	s.dormant = false
+	if t.reauth > 0 {
+		t.dormant.Reset(t.reauth)
+	}
+}
+
+func (t *IdleTimer) resetIfIdle() {
+	if t.state.state == STATE_IDLE {
+		t.reset()
+	}
+}
+
+// Stops the idle timeout, e.g. while in use.
+func (t *IdleTimer) stop() {
+	s := t.state
+	s.warning = false
+	t.timeout.Stop()
+	s.idleDeadline = time.Time{}
+	s.idleHeld = false
+	s.dormant = false
+	t.dormant.Stop()
+}
+
+// Restarts the idle timeout of a restored session with its deadline, if any.
+func (t *IdleTimer) resume(deadline time.Time) {
+	t.reset()
+	if !deadline.IsZero() {
+		t.timeout.Reset(deadline.Sub(Clk.Now()) - t.warning)
+		t.state.idleDeadline = deadline
+	}
+}
+
+// Holds or restarts the idle timer as the idle condition changes.
+func (t *IdleTimer) updateQuiescence() {
+	if t.state.state != STATE_IDLE || t.condition == nil || t.state.idleHeld != t.condition() {
+		return
+	}
+	t.reset()
+}
+
+// Overrides the idle timeout of the running session only, in seconds.
+func (t *IdleTimer) override(payload string) {
+	seconds, err := strconv.Atoi(payload)
+	if err != nil || seconds < 0 || t.state.state == STATE_OFF {
+		slog.Warn("ignoring idle timeout command", slog.String("payload", payload))
+		return
+	}
+	t.state.idleOverride = time.Duration(seconds) * time.Second
+	t.resetIfIdle()
+	Publish(t.bus, StateUpdated{})
+}
+
+// The machine is not drawing current and the warning phase or the idle
+// timeout is reached.
+func (t *IdleTimer) onTimeout() {
+	s := t.state
+	if s.state != STATE_IDLE {
+		return
+	}
+	if remaining := s.idleDeadline.Sub(Clk.Now()); t.warning > 0 && !s.warning && remaining > 0 {
+		// Last chance to use the machine or badge again before power is cut.
+		s.warning = true
+		t.timeout.Reset(remaining)
+		Publish(t.bus, StateUpdated{})
+		return
+	}
+	Publish(t.bus, EndSession{})
+}
+
+// Idle for long: the member may have left, so whoever comes next must badge.
+func (t *IdleTimer) onDormant() {
+	s := t.state
+	if s.state != STATE_IDLE {
+		return
+	}
+	slog.Info("idle for long, badge again to resume", BadgeAttr("id", s.badgeId))
+	s.dormant = true
+	Publish(t.bus, UpdatePower{})
+	Publish(t.bus, StateUpdated{})
+	Publish(t.bus, DisplayMessage{Text: "Badge to resume"})
+}
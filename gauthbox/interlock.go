@@ -0,0 +1,140 @@
+package gauthbox
+
+import (
+	"context"
+	"log/slog"
+)
+
+type interlockConfig struct {
+	inputConfig
+	// Short identifier, e.g. "airflow" or "coolant".
+	Id string `json:"id"`
+	// How long after the relays switch on the interlock is not enforced, e.g. for
+	// the dust extraction airflow to build up. Without grace, a session cannot
+	// start while the interlock is not satisfied.
+	GraceMs uint32 `json:"grace_ms,omitempty"`
+}
+
+type InterlockState struct {
+	Id        string
+	Satisfied bool
+}
+
+// Interlock logic, e.g. an airflow, pressure or coolant flow switch. The input is
+// high when the interlock is satisfied. Yields the initial state, then each change.
+// The looper returns once ctx is done, releasing the input.
+// MQTT: registers as a binary sensor with a 'problem' device class.
+func Interlock(ctx context.Context, c interlockConfig) (*DeviceRet[InterlockState], error) {
+	events := make(chan InterlockState)
+	send := func(high bool) {
+		select {
+		case events <- InterlockState{Id: c.Id, Satisfied: high}:
+		case <-ctx.Done():
+		}
+	}
+	watch, satisfied, err := Hw.WatchInput(c.inputConfig, send)
+	if err != nil {
+		return nil, err
+	}
+	// Exempt from the liveness checks, see Beat.
+	looper := func() {
+		defer watch.Close()
+		send(satisfied)
+		<-ctx.Done()
+	}
+	return &DeviceRet[InterlockState]{
+		Looper: looper,
+		Events: stampEvents(events),
+		OnEvent: func(s InterlockState, name string, publish PublishFunc) {
+			publish(name+"/interlock/"+s.Id, map[bool]string{false: "ON", true: "OFF"}[s.Satisfied])
+		},
+		Discovery: MqttDiscovery{
+			Component: "binary_sensor",
+			Id:        "interlock_" + c.Id,
+			Announce: func(name, topic string) interface{} {
+				return struct {
+					Device      MqttDevice `json:"device"`
+					DeviceClass string     `json:"device_class"`
+					StateTopic  string     `json:"state_topic"`
+				}{
+					Device:      MqttDevice{Name: "Interlock (" + c.Id + ") on " + name},
+					DeviceClass: "problem",
+					StateTopic:  topic + "/" + name + "/interlock/" + c.Id,
+				}
+			},
+		},
+	}, nil
+}
+
+// Publishes why the machine was powered off against the user's will, e.g.
+// "interlock airflow".
+func PublishTrip(reason string, name string, publish PublishFunc) {
+	publish(name+"/trip", reason)
+}
+
+// MQTT: the last trip reason, as a sensor.
+func TripDiscovery() MqttDiscovery {
+	return MqttDiscovery{
+		Component: "sensor",
+		Id:        "trip",
+		Announce: func(name, topic string) interface{} {
+			return struct {
+				Device     MqttDevice `json:"device"`
+				StateTopic string     `json:"state_topic"`
+			}{
+				Device:     MqttDevice{Name: "Last trip on " + name},
+				StateTopic: topic + "/" + name + "/trip",
+			}
+		},
+	}
+}
+
+// Ends the session when an interlock is not satisfied past its grace period.
+// Owns the interlocksOpen field of the state.
+type Interlocks struct {
+	config *AuthboxConfig
+	state  *State
+	bus    *Bus
+	// Fires when a grace period ends, the interlocks must then be satisfied.
+	grace *BusTimer
+}
+
+func NewInterlocks(config *AuthboxConfig, state *State) *Interlocks {
+	return &Interlocks{config: config, state: state}
+}
+
+// Subscribes to the interlock inputs and to the relays starting the grace periods.
+func (i *Interlocks) Subscribe(bus *Bus) {
+	i.bus = bus
+	i.grace = bus.NewTimer(i.check)
+	Subscribe(bus, func(e InterlockSensed) {
+		if e.State.Satisfied {
+			delete(i.state.interlocksOpen, e.State.Id)
+		} else {
+			i.state.interlocksOpen[e.State.Id] = true
+			i.check()
+		}
+		Publish(bus, StateUpdated{})
+	})
+	Subscribe(bus, func(e RelaySwitched) {
+		if !e.On {
+			i.grace.Stop()
+		} else if _, next := trippedInterlock(i.config, i.state); next > 0 {
+			i.grace.Reset(next)
+		}
+	})
+}
+
+// Ends the session if an interlock is not satisfied past its grace period.
+func (i *Interlocks) check() {
+	id, next := trippedInterlock(i.config, i.state)
+	if next > 0 {
+		i.grace.Reset(next)
+	}
+	if id == "" || i.state.state == STATE_OFF {
+		return
+	}
+	slog.Warn("interlock tripped, powering off", slog.String("interlock", id))
+	Publish(i.bus, Tripped{Cause: TRIP_INTERLOCK, Reason: "interlock " + id})
+	Publish(i.bus, EndSession{Message: "Interlock " + id})
+}
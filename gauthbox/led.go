@@ -0,0 +1,516 @@
+package gauthbox
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Name of the base layer, reflecting the state machine state.
+const LED_PATTERN_STATE = "state"
+
+const LED_PATTERN_DENIED = "denied"
+const LED_PATTERN_NETWORK_DOWN = "network_down"
+const LED_PATTERN_MAINTENANCE = "maintenance"
+const LED_PATTERN_DOOR_OPEN = "door_open"
+const LED_PATTERN_OVERHEAT = "overheat"
+const LED_PATTERN_WIRING_FAULT = "wiring_fault"
+const LED_PATTERN_INTERLOCK = "interlock"
+const LED_PATTERN_SESSION_OVER = "session_over"
+const LED_PATTERN_LOCKOUT = "lockout"
+const LED_PATTERN_IDLE_WARNING = "idle_warning"
+const LED_PATTERN_CUT_DEFERRED = "cut_deferred"
+const LED_PATTERN_CURFEW = "curfew"
+
+const LED_GREEN = "green"
+const LED_RED = "red"
+
+// State machine states, as keys of the state LED patterns.
+const LED_STATE_OFF = "off"
+const LED_STATE_IDLE = "idle"
+const LED_STATE_IN_USE = "in_use"
+
+// A step of an LED pattern. A zero duration holds the step until the pattern
+// is replaced.
+type LedStep struct {
+	On         bool   `json:"on"`
+	DurationMs uint32 `json:"ms"`
+}
+
+// An LED signal: a sequence of on/off steps, played Repeat times (0 for
+// forever). While set, the pattern with the highest priority is shown; when a
+// finite pattern ends, the next one takes over.
+type LedPattern struct {
+	Name     string    `json:"-"`
+	Steps    []LedStep `json:"steps"`
+	Repeat   int       `json:"repeat,omitempty"`
+	Priority int       `json:"priority,omitempty"`
+}
+
+// Removes the pattern with that name.
+type LedClear struct {
+	Name string
+}
+
+// A change of the patterns played by a Blinker: LedPattern or LedClear.
+type LedMode interface {
+	ledModeName() string
+}
+
+func (p LedPattern) ledModeName() string { return p.Name }
+func (c LedClear) ledModeName() string   { return c.Name }
+
+// Modes to be played by a Blinker. Setting never blocks, even before the
+// Blinker runs: modes are kept until it takes them, the last one set per
+// pattern name winning.
+type LedModes struct {
+	mu sync.Mutex
+	// In the order they were set in.
+	pending []LedMode
+	ready   chan struct{}
+}
+
+func NewLedModes() *LedModes {
+	return &LedModes{ready: make(chan struct{}, 1)}
+}
+
+func (m *LedModes) Set(mode LedMode) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending = slices.DeleteFunc(m.pending, func(p LedMode) bool { return p.ledModeName() == mode.ledModeName() })
+	m.pending = append(m.pending, mode)
+	select {
+	case m.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (m *LedModes) take() []LedMode {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pending := m.pending
+	m.pending = nil
+	return pending
+}
+
+// Steady on or off, as the state layer.
+func LedSteady(on bool) LedPattern {
+	return LedPattern{Name: LED_PATTERN_STATE, Steps: []LedStep{{On: on}}}
+}
+
+// Regular blinking, as the state layer.
+func LedBlinking(interval time.Duration) LedPattern {
+	ms := uint32(interval.Milliseconds())
+	return LedPattern{Name: LED_PATTERN_STATE, Steps: []LedStep{{On: true, DurationMs: ms}, {On: false, DurationMs: ms}}}
+}
+
+var defaultLedPatterns = map[string]LedPattern{
+	LED_PATTERN_CUT_DEFERRED: {
+		Steps:    []LedStep{{true, 80}, {false, 80}},
+		Priority: 60,
+	},
+	LED_PATTERN_DENIED: {
+		Steps:    []LedStep{{true, 120}, {false, 120}},
+		Repeat:   5,
+		Priority: 50,
+	},
+	LED_PATTERN_MAINTENANCE: {
+		Steps:    []LedStep{{true, 1000}, {false, 200}, {true, 200}, {false, 200}},
+		Priority: 40,
+	},
+	LED_PATTERN_IDLE_WARNING: {
+		Steps:    []LedStep{{true, 100}, {false, 100}},
+		Priority: 55,
+	},
+	LED_PATTERN_LOCKOUT: {
+		Steps:    []LedStep{{true, 1000}, {false, 1000}},
+		Priority: 45,
+	},
+	LED_PATTERN_CURFEW: {
+		Steps:    []LedStep{{true, 300}, {false, 300}},
+		Repeat:   3,
+		Priority: 38,
+	},
+	LED_PATTERN_SESSION_OVER: {
+		Steps:    []LedStep{{true, 200}, {false, 200}, {true, 200}, {false, 1400}},
+		Priority: 35,
+	},
+	LED_PATTERN_WIRING_FAULT: {
+		Steps:    []LedStep{{true, 60}, {false, 60}},
+		Priority: 30,
+	},
+	LED_PATTERN_INTERLOCK: {
+		Steps:    []LedStep{{true, 500}, {false, 100}},
+		Priority: 25,
+	},
+	LED_PATTERN_OVERHEAT: {
+		Steps:    []LedStep{{true, 250}, {false, 250}},
+		Priority: 20,
+	},
+	LED_PATTERN_DOOR_OPEN: {
+		Steps:    []LedStep{{true, 120}, {false, 120}},
+		Priority: 20,
+	},
+	LED_PATTERN_NETWORK_DOWN: {
+		Steps:    []LedStep{{true, 100}, {false, 1900}},
+		Priority: 10,
+	},
+}
+
+// The patterns shown on each LED in a state, on the state layer. A missing
+// pattern turns the LED off.
+type stateLeds struct {
+	Green *LedPattern `json:"green,omitempty"`
+	Red   *LedPattern `json:"red,omitempty"`
+}
+
+var defaultStateLeds = map[string]stateLeds{
+	LED_STATE_OFF: {
+		Red: &LedPattern{Steps: []LedStep{{On: true}}},
+	},
+	LED_STATE_IDLE: {
+		Green: &LedPattern{Steps: []LedStep{{true, 500}, {false, 500}}},
+	},
+	LED_STATE_IN_USE: {
+		Green: &LedPattern{Steps: []LedStep{{On: true}}},
+	},
+}
+
+// Returns the state layer patterns of the green and red LEDs in that state,
+// as overridden in the config or the built-in default.
+func (c *AuthboxConfig) StateLedPatterns(state string) (LedPattern, LedPattern) {
+	leds, ok := c.StateLeds[state]
+	if !ok {
+		leds = defaultStateLeds[state]
+	}
+	layer := func(p *LedPattern) LedPattern {
+		if p == nil {
+			return LedSteady(false)
+		}
+		l := *p
+		l.Name = LED_PATTERN_STATE
+		return l
+	}
+	return layer(leds.Green), layer(leds.Red)
+}
+
+// Returns the named pattern, as overridden in the config or the built-in default.
+func (c *AuthboxConfig) LedPattern(name string) LedPattern {
+	p, ok := c.LedPatterns[name]
+	if !ok {
+		p = defaultLedPatterns[name]
+	}
+	p.Name = name
+	return p
+}
+
+// Blinker utility to play LED patterns on a GPIO LED.
+// To change the pattern, set a LedPattern, which replaces any pattern with the
+// same name, or LedClear to remove one, on 'modes'.
+// If sysLedName is non-empty, this also controls the on-board LED at /sys/class/leds/<sysLedName>.
+// The looper returns once ctx is done, switching the LED off and closing its line.
+func Blinker(ctx context.Context, c ledConfig, sysLedName string, modes *LedModes) (func(), error) {
+	var piLed SystemLed
+	if sysLedName != "" {
+		piLed = Hw.SystemLed(sysLedName)
+	}
+	setPiLed := func(isOn bool) {
+		if piLed != nil {
+			piLed.Set(isOn)
+		}
+	}
+	line, err := Hw.RequestOutput(c.Pin, 0)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		timer := Clk.NewTimer(0)
+		timer.Stop()
+		alive := time.NewTicker(LIVENESS_INTERVAL)
+		livenessName := "led_" + c.Pin.String()
+		Beat(livenessName)
+
+		// Active patterns by name, with the order they were set in to break priority ties.
+		layers := map[string]LedPattern{}
+		setOrder := map[string]int{}
+		order := 0
+		current, step, played := "", 0, 0
+
+		apply := func() {
+			p := layers[current]
+			s := p.Steps[step]
+			setLineValue(c.ActiveLow, line, s.On)
+			go setPiLed(s.On)
+			if s.DurationMs > 0 {
+				timer.Reset(time.Duration(s.DurationMs) * time.Millisecond)
+			}
+		}
+		// Switches to the highest priority layer, restarting it if it changed or restart is true.
+		pick := func(restart bool) {
+			best := ""
+			for name, p := range layers {
+				b, ok := layers[best]
+				if !ok || p.Priority > b.Priority || (p.Priority == b.Priority && setOrder[name] > setOrder[best]) {
+					best = name
+				}
+			}
+			if best == current && !restart {
+				return
+			}
+			timer.Stop()
+			current, step, played = best, 0, 0
+			if best == "" {
+				setLineValue(c.ActiveLow, line, false)
+				go setPiLed(false)
+				return
+			}
+			apply()
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				setLineValue(c.ActiveLow, line, false)
+				setPiLed(false)
+				line.Close()
+				return
+			case <-alive.C:
+				Beat(livenessName)
+			case <-modes.ready:
+				for _, m := range modes.take() {
+					switch mm := m.(type) {
+					case LedPattern:
+						if len(mm.Steps) == 0 {
+							delete(layers, mm.Name)
+							pick(false)
+							continue
+						}
+						order++
+						layers[mm.Name] = mm
+						setOrder[mm.Name] = order
+						pick(mm.Name == current)
+					case LedClear:
+						delete(layers, mm.Name)
+						pick(false)
+					}
+				}
+			case <-timer.C():
+				if current == "" {
+					continue
+				}
+				p := layers[current]
+				step++
+				if step == len(p.Steps) {
+					step = 0
+					played++
+					if p.Repeat > 0 && played >= p.Repeat {
+						delete(layers, current)
+						pick(true)
+						continue
+					}
+				}
+				apply()
+			}
+		}
+	}, nil
+}
+
+// Feedback when a badge is refused, on the alert LED with the LED_PATTERN_DENIED
+// pattern, which can be overridden like any other.
+type deniedFeedbackConfig struct {
+	// Whether to also play the pattern on the buzzer.
+	Buzz bool `json:"buzz,omitempty"`
+	// Shown instead of the reason on the displays, e.g. "Ask a host".
+	Message string `json:"message,omitempty"`
+	// Repeats the pattern for about that long, zero for the pattern's own repeats.
+	DurationMs uint32 `json:"duration_ms,omitempty"`
+}
+
+// Returns the pattern signaling a refused badge.
+func (c *AuthboxConfig) DeniedPattern() LedPattern {
+	p := c.LedPattern(LED_PATTERN_DENIED)
+	if c.DeniedFeedback == nil || c.DeniedFeedback.DurationMs == 0 {
+		return p
+	}
+	period := uint32(0)
+	for _, s := range p.Steps {
+		period += s.DurationMs
+	}
+	if period > 0 {
+		p.Repeat = max(1, int((c.DeniedFeedback.DurationMs+period/2)/period))
+	}
+	return p
+}
+
+// How often the remaining time pattern is updated.
+const REMAINING_TIME_LED_INTERVAL = 2 * time.Second
+
+// Blinks the green LED faster as the idle deadline approaches, for boxes
+// without a display. Replaces the idle state pattern of the green LED.
+type remainingTimeLedConfig struct {
+	// Blink period right after going idle, defaults to 2000.
+	SlowMs uint32 `json:"slow_ms,omitempty"`
+	// Blink period at the deadline, defaults to 200.
+	FastMs uint32 `json:"fast_ms,omitempty"`
+}
+
+// Returns the state layer pattern with 'remaining' of the 'total' idle time left.
+func (c remainingTimeLedConfig) Pattern(remaining, total time.Duration) LedPattern {
+	slow, fast := c.SlowMs, c.FastMs
+	if slow == 0 {
+		slow = 2000
+	}
+	if fast == 0 {
+		fast = 200
+	}
+	ratio := 0.
+	if total > 0 {
+		ratio = min(1, max(0, float64(remaining)/float64(total)))
+	}
+	half := uint32((float64(fast) + (float64(slow)-float64(fast))*ratio) / 2)
+	return LedPattern{Name: LED_PATTERN_STATE, Steps: []LedStep{{true, half}, {false, half}}}
+}
+
+// Shows the state and the alerts of the state machine on the LEDs and the
+// buzzer, following the bus.
+type LedFeedback struct {
+	config     *AuthboxConfig
+	green, red *LedModes
+	// Signals other than the state, red or green.
+	alert *LedModes
+	// Nil without a buzzer.
+	buzzer *LedModes
+	// Updates the remaining time pattern while idle.
+	remainingTime *BusTimer
+	// As last shown, and whether it was. The maps of the state are shared with
+	// the state machine: whether they were empty is kept aside.
+	last                                     State
+	shown                                    bool
+	overheated, wiringFaults, interlocksOpen bool
+}
+
+func NewLedFeedback(config *AuthboxConfig, green, red, buzzer *LedModes) *LedFeedback {
+	l := &LedFeedback{config: config, green: green, red: red, alert: red, buzzer: buzzer}
+	if config.AlertLed == LED_GREEN {
+		l.alert = green
+	}
+	return l
+}
+
+// Subscribes to the state machine events shown on the LEDs.
+func (l *LedFeedback) Subscribe(bus *Bus) {
+	l.remainingTime = bus.NewTimer(l.refresh)
+	Subscribe(bus, l.onStateChanged)
+	Subscribe(bus, func(e BadgeDenied) {
+		l.alert.Set(l.config.DeniedPattern())
+		if l.config.DeniedFeedback != nil && l.config.DeniedFeedback.Buzz {
+			l.buzz(l.config.DeniedPattern())
+		}
+	})
+	Subscribe(bus, func(e MqttConnection) {
+		l.setAlert(LED_PATTERN_NETWORK_DOWN, !e.Connected, false)
+	})
+	Subscribe(bus, func(e Tripped) {
+		switch e.Cause {
+		case TRIP_INTERLOCK:
+			l.setAlert(LED_PATTERN_INTERLOCK, true, false)
+		case TRIP_CUT_DEFERRED:
+			l.setAlert(LED_PATTERN_CUT_DEFERRED, true, true)
+		}
+	})
+	Subscribe(bus, func(CurfewWarning) {
+		l.setAlert(LED_PATTERN_CURFEW, true, true)
+	})
+}
+
+// Shows the last state again, for the remaining time pattern.
+func (l *LedFeedback) refresh() {
+	if l.last.state == STATE_IDLE {
+		l.showState(l.last)
+	}
+}
+
+func (l *LedFeedback) buzz(m LedMode) {
+	if l.buzzer != nil {
+		l.buzzer.Set(m)
+	}
+}
+
+// Sets or clears the named pattern on the alert LED, and on the buzzer if buzz.
+func (l *LedFeedback) setAlert(name string, on bool, buzz bool) {
+	var m LedMode = LedClear{Name: name}
+	if on {
+		m = l.config.LedPattern(name)
+	}
+	l.alert.Set(m)
+	if buzz {
+		l.buzz(m)
+	}
+}
+
+func (l *LedFeedback) showState(s State) {
+	g, r := l.config.StateLedPatterns(map[int]string{
+		STATE_OFF:    LED_STATE_OFF,
+		STATE_IDLE:   LED_STATE_IDLE,
+		STATE_IN_USE: LED_STATE_IN_USE,
+	}[s.state])
+	l.remainingTime.Stop()
+	if s.state == STATE_IDLE && l.config.RemainingTimeLed != nil && !s.idleDeadline.IsZero() {
+		g = l.config.RemainingTimeLed.Pattern(s.idleDeadline.Sub(Clk.Now()), s.idleTimeout)
+		l.remainingTime.Reset(REMAINING_TIME_LED_INTERVAL)
+	}
+	l.green.Set(g)
+	l.red.Set(r)
+}
+
+// Follows the changes since the last state.
+func (l *LedFeedback) onStateChanged(e StateChanged) {
+	s, last := e.State, l.last
+	l.last = s
+	if !l.shown || s.state != last.state || s.idleDeadline != last.idleDeadline {
+		l.shown = true
+		l.showState(s)
+	}
+	if s.warning != last.warning {
+		// Last chance to use the machine or badge again before power is cut.
+		var m LedMode = LedClear{Name: LED_PATTERN_IDLE_WARNING}
+		if s.warning {
+			m = l.config.LedPattern(LED_PATTERN_IDLE_WARNING)
+		}
+		l.green.Set(m)
+		l.red.Set(m)
+		l.buzz(m)
+	}
+	switch {
+	case last.doorClosed && !s.doorClosed && last.state == STATE_IN_USE:
+		l.setAlert(LED_PATTERN_DOOR_OPEN, true, false)
+	case !last.doorClosed && s.doorClosed:
+		l.setAlert(LED_PATTERN_DOOR_OPEN, false, false)
+	}
+	if last.cutDeferred && !s.cutDeferred {
+		l.setAlert(LED_PATTERN_CUT_DEFERRED, false, true)
+	}
+	if l.interlocksOpen && len(s.interlocksOpen) == 0 {
+		l.setAlert(LED_PATTERN_INTERLOCK, false, false)
+	}
+	l.interlocksOpen = len(s.interlocksOpen) > 0
+	if (s.lockout != "") != (last.lockout != "") {
+		l.setAlert(LED_PATTERN_LOCKOUT, s.lockout != "", false)
+	}
+	if s.bypass != last.bypass {
+		l.setAlert(LED_PATTERN_MAINTENANCE, s.bypass, false)
+	}
+	if overheated := len(s.overheated) > 0; overheated != l.overheated {
+		l.overheated = overheated
+		l.setAlert(LED_PATTERN_OVERHEAT, overheated, false)
+	}
+	if faults := len(s.wiringFaults) > 0; faults != l.wiringFaults {
+		l.wiringFaults = faults
+		l.setAlert(LED_PATTERN_WIRING_FAULT, faults, false)
+	}
+	if s.sessionOver != last.sessionOver {
+		// The session ends once the machine stops.
+		l.setAlert(LED_PATTERN_SESSION_OVER, s.sessionOver, true)
+	}
+}
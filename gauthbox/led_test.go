@@ -0,0 +1,71 @@
+package gauthbox
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeniedPattern(t *testing.T) {
+	custom := map[string]LedPattern{LED_PATTERN_DENIED: {Steps: []LedStep{{true, 500}, {false, 500}}, Repeat: 2, Priority: 70}}
+	held := map[string]LedPattern{LED_PATTERN_DENIED: {Steps: []LedStep{{On: true}}, Repeat: 1}}
+	tests := []struct {
+		name     string
+		patterns map[string]LedPattern
+		feedback *deniedFeedbackConfig
+		// Of the default pattern, 240ms long, unless overridden.
+		wantRepeat   int
+		wantPriority int
+	}{
+		{"default", nil, nil, 5, 50},
+		{"message only", nil, &deniedFeedbackConfig{Message: "Ask a host"}, 5, 50},
+		{"longer", nil, &deniedFeedbackConfig{DurationMs: 3000}, 13, 50},
+		{"rounded to the nearest", nil, &deniedFeedbackConfig{DurationMs: 2000}, 8, 50},
+		{"at least once", nil, &deniedFeedbackConfig{DurationMs: 10}, 1, 50},
+		{"overridden pattern", custom, nil, 2, 70},
+		{"overridden pattern, longer", custom, &deniedFeedbackConfig{DurationMs: 4000}, 4, 70},
+		{"pattern without duration", held, &deniedFeedbackConfig{DurationMs: 4000}, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &AuthboxConfig{LedPatterns: tt.patterns, DeniedFeedback: tt.feedback}
+			p := c.DeniedPattern()
+			if p.Name != LED_PATTERN_DENIED || p.Repeat != tt.wantRepeat || p.Priority != tt.wantPriority {
+				t.Errorf("got %+v, want repeat %d, priority %d", p, tt.wantRepeat, tt.wantPriority)
+			}
+			// The steps are left alone.
+			if want := c.LedPattern(LED_PATTERN_DENIED).Steps; !reflect.DeepEqual(p.Steps, want) {
+				t.Errorf("got steps %v, want %v", p.Steps, want)
+			}
+		})
+	}
+}
+
+func TestLedFeedbackDenied(t *testing.T) {
+	tests := []struct {
+		name     string
+		feedback *deniedFeedbackConfig
+		buzzed   bool
+	}{
+		{"default", nil, false},
+		{"buzz", &deniedFeedbackConfig{Buzz: true, DurationMs: 1000}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &AuthboxConfig{DeniedFeedback: tt.feedback}
+			green, red, buzzer := NewLedModes(), NewLedModes(), NewLedModes()
+			bus := NewBus()
+			NewLedFeedback(config, green, red, buzzer).Subscribe(bus)
+			Publish(bus, BadgeDenied{BadgeId: "999", Reason: "Access denied"})
+			want := []LedMode{config.DeniedPattern()}
+			if got := red.take(); !reflect.DeepEqual(got, want) {
+				t.Errorf("red LED got %v, want %v", got, want)
+			}
+			if got := green.take(); len(got) != 0 {
+				t.Errorf("green LED got %v", got)
+			}
+			if got := buzzer.take(); tt.buzzed != reflect.DeepEqual(got, want) || !tt.buzzed && len(got) != 0 {
+				t.Errorf("buzzer got %v, buzzed %v", got, tt.buzzed)
+			}
+		})
+	}
+}
@@ -2,6 +2,12 @@ package gauthbox
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,9 +15,11 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -33,6 +41,33 @@ const BADGE_ACTION_INITIAL = "initial"
 const BADGE_ACTION_EXTEND = "extend"
 const BADGE_ACTION_RETURN = "return"
 
+const BADGE_AUTH_DEFAULT_TIMEOUT = 10 * time.Second
+
+// Outcomes of a badge authentication, as in the metrics.
+const AUTH_OUTCOME_OK = "ok"
+const AUTH_OUTCOME_DENIED = "denied"
+const AUTH_OUTCOME_TIMEOUT = "timeout"
+const AUTH_OUTCOME_5XX = "5xx"
+const AUTH_OUTCOME_ERROR = "error"
+
+const RELAY_ROLE_MACHINE = "machine"
+const RELAY_ROLE_DUST_EXTRACTION = "dust_extraction"
+const RELAY_ROLE_WORK_LIGHT = "work_light"
+const RELAY_ROLE_SOFT_START = "soft_start"
+
+const DOOR_ACTION_WARN = "warn"
+const DOOR_ACTION_CUT = "cut"
+
+const RELAY_EXIT_OFF = "off"
+const RELAY_EXIT_ON = "on"
+const RELAY_EXIT_KEEP = "keep"
+
+// Stands for secrets when logging the config.
+const CONFIG_REDACTED = "redacted"
+
+const RELAY_MODE_LATCH = "latch"
+const RELAY_MODE_PULSE = "pulse"
+
 type badgeReaderConfig struct {
 	Vendor    uint16 `json:"vendor,omitempty"`
 	Product   uint16 `json:"product,omitempty"`
@@ -44,47 +79,287 @@ type badgeAuthConfig struct {
 	// .badgeId, .state, .duration
 	UrlTemplate  string `json:"url_template"`
 	UsageMinutes uint32 `json:"usage_duration_minutes"`
+	// Defaults to BADGE_AUTH_DEFAULT_TIMEOUT.
+	TimeoutMs uint32 `json:"timeout_ms,omitempty"`
 }
 
 type relayConfig struct {
-	Pin       int  `json:"pin"`
+	Pin       Pin  `json:"pin"`
 	ActiveLow bool `json:"active_low"`
 	Debounce  int  `json:"debounce_ms"`
+	// One of RELAY_ROLE_*. The main 'relay' is always the machine power.
+	Role       string `json:"role,omitempty"`
+	OnDelayMs  uint32 `json:"on_delay_ms,omitempty"`
+	OffDelayMs uint32 `json:"off_delay_ms,omitempty"`
+	// One of RELAY_MODE_*, defaults to latch.
+	Mode string `json:"mode,omitempty"`
+	// Required in pulse mode.
+	PulseMs uint32 `json:"pulse_ms,omitempty"`
+	// Optional auxiliary contact input. Ignored in pulse mode.
+	Feedback *relayFeedbackConfig `json:"feedback,omitempty"`
+	// Logical state at startup, until the state machine switches it.
+	InitialOn bool `json:"initial_on,omitempty"`
+	// Start with the last commanded state instead of InitialOn.
+	RestoreState bool `json:"restore_state,omitempty"`
+	// One of RELAY_EXIT_*, defaults to off.
+	OnExit string `json:"on_exit,omitempty"`
+	// How long the relay stays on after a session ends, e.g. fans or a laser
+	// chiller. Unlike OffDelayMs, this is not applied when power is cut for
+	// other reasons, e.g. the door opening.
+	CooldownS uint32 `json:"cooldown_s,omitempty"`
 }
 
-type currentSensingConfig struct {
-	Pin        int    `json:"pin"`
+type inputConfig struct {
+	Pin        Pin    `json:"pin"`
 	ActiveLow  bool   `json:"active_low"`
 	DebounceMs int    `json:"debounce_ms"`
 	Bias       string `json:"bias"`
 }
 
+// A step of the power-up sequence, e.g. soft-start resistor relay on, then main
+// contactor on 500 ms later, then soft-start relay off.
+type relayStep struct {
+	Role string `json:"role"`
+	On   bool   `json:"on"`
+	// Delay since the previous step.
+	DelayMs uint32 `json:"delay_ms"`
+}
+
+type currentSensingConfig struct {
+	inputConfig
+	// One of CURRENT_DRIVER_*, defaults to gpio.
+	Driver string     `json:"driver,omitempty"`
+	Adc    *adcConfig `json:"adc,omitempty"`
+	// How long the current must stay high (resp. low) before the machine is
+	// considered in use (resp. idle). Filters out motor inrush and VFD ripple.
+	MinHighMs uint32 `json:"min_high_ms,omitempty"`
+	MinLowMs  uint32 `json:"min_low_ms,omitempty"`
+}
+
+type doorContactConfig struct {
+	inputConfig
+	// One of DOOR_ACTION_*, applied when the door opens while the tool is in use.
+	OpenAction string `json:"open_action"`
+}
+
 type mqttConfig struct {
 	Broker string `json:"broker"`
 	Topic  string `json:"topic"`
+	// Whether the Home Assistant discovery messages are published centrally for
+	// the whole fleet, the box only publishing its state.
+	CentralDiscovery bool `json:"central_discovery,omitempty"`
 }
 
 type ledConfig struct {
-	Pin       int  `json:"pin"`
+	Pin       Pin  `json:"pin"`
 	ActiveLow bool `json:"active_low"`
 }
 
-type LedStatic struct {
-	On bool
-}
-type LedBlink struct {
-	Interval time.Duration
-}
-
 type AuthboxConfig struct {
+	// One of MODE_*, defaults to buttonless.
+	Mode          string       `json:"mode,omitempty"`
+	Button        *inputConfig `json:"button,omitempty"`
+	UnlockSeconds uint32       `json:"unlock_duration_s,omitempty"`
+	// Sessions end after that long regardless of extends, zero for no limit.
+	MaxSessionMinutes uint32 `json:"max_session_duration_minutes,omitempty"`
+	// Warning phase at the end of the idle timeout, zero to power off without warning.
+	IdleWarningSeconds uint32 `json:"idle_warning_s,omitempty"`
+	// Optional condition over the inputs for idle time to accrue, e.g.
+	// "door_closed && !spinning.spindle && interlock.vacuum". Inputs: current,
+	// spinning, spinning.<id>, door_closed, interlock.<id> and running.
+	// The idle timeout restarts once it holds again.
+	IdleWhen string `json:"idle_when,omitempty"`
+	// Switches the relay off after idling that long, until someone badges again,
+	// so nobody else uses a machine its member walked away from. The session
+	// still ends at the idle timeout. Zero to keep the relay on.
+	ReauthIdleMinutes uint32 `json:"reauth_idle_duration_minutes,omitempty"`
+	// Safety invariant: never switch the relay off while current sensing reads
+	// high for a timeout or a command. Powering off waits for the machine to stop,
+	// with an alarm after CUT_DEFERRED_ALARM_DELAY. The safety cutoffs (door,
+	// interlocks, over temperature) still power off right away.
+	NeverCutInUse bool `json:"never_cut_in_use,omitempty"`
+	// Whether to leave the relays on when the daemon stops while the machine is
+	// in use, so restarting does not interrupt it.
+	KeepOnExitInUse bool `json:"keep_on_exit_in_use,omitempty"`
+	// Optional command & control endpoint the state transitions are POSTed to as JSON.
+	EventsUrl string `json:"events_url,omitempty"`
+	// Optional URL the session summaries are POSTed to as JSON.
+	SessionWebhook string `json:"session_webhook,omitempty"`
+	// Whether to aggregate the sessions per day, published to MQTT and posted
+	// to command & control after midnight.
+	UsageStats bool `json:"usage_stats,omitempty"`
+	// Whether badging again with the active badge restarts the badge expiry
+	// window and extends right away. Badging out while idle takes precedence.
+	ExtendOnBadge bool `json:"extend_on_badge,omitempty"`
+	// Whether badging again while idle ends the session.
+	BadgeOut bool `json:"badge_out,omitempty"`
+	// Whether badging while the tool is in use hands the session over to the
+	// new badge once the machine stops.
+	TransferOnBadge bool `json:"transfer_on_badge,omitempty"`
+	// Non-empty to put the tool out of service, with that reason. Persists until
+	// cleared over MQTT or with the local key combo.
+	Lockout string `json:"lockout,omitempty"`
+	// Windows during which the tool is usable without badging, e.g. open house
+	// evenings. Ongoing sessions end once the machine stops after the window.
+	FreeAccess []scheduleWindow `json:"free_access,omitempty"`
+	// Optional nightly curfew.
+	Curfew *curfewConfig `json:"curfew,omitempty"`
+	// Whether to hold off the curfew and free access windows while the clock
+	// is not trusted, see ClockProblem.
+	ScheduleNeedsClock bool `json:"schedule_needs_clock,omitempty"`
+	// Optional local HTTP API.
+	Http *httpConfig `json:"http,omitempty"`
+	// Optional local debug console.
+	Console *consoleConfig `json:"console,omitempty"`
+	// Optional webhook notifications of failure conditions.
+	Alerts *alertsConfig `json:"alerts,omitempty"`
+	// Optional probing of command & control and the badge auth backend.
+	Connectivity *connectivityConfig `json:"connectivity,omitempty"`
+	// Optional Prometheus metrics listener.
+	Metrics *metricsConfig `json:"metrics,omitempty"`
+	// Optional log format, file and shipping, logs go to stderr as text
+	// otherwise.
+	Logging *loggingConfig `json:"logging,omitempty"`
+	// Optional OpenTelemetry trace export.
+	Tracing *tracingConfig `json:"tracing,omitempty"`
+	// Optional shared auxiliary equipment, requires MQTT.
+	AuxGroup *auxGroupConfig `json:"aux_group,omitempty"`
+	// Optional, requires MQTT.
+	AntiPassback *antiPassbackConfig `json:"anti_passback,omitempty"`
+	// Optional buzzer, driven with the same patterns as the LEDs.
+	Buzzer         *ledConfig           `json:"buzzer,omitempty"`
 	MqttBroker     *mqttConfig          `json:"mqtt,omitempty"`
 	BadgeReader    badgeReaderConfig    `json:"badge_reader"`
 	BadgeAuth      badgeAuthConfig      `json:"badge_auth"`
 	CurrentSensing currentSensingConfig `json:"current_sensing"`
+	DoorContact    *doorContactConfig   `json:"door_contact,omitempty"`
+	Expanders      []expanderConfig     `json:"expanders,omitempty"`
 	Relay          relayConfig          `json:"relay"`
-	GreenLed       ledConfig            `json:"green_led"`
-	RedLed         ledConfig            `json:"red_led"`
-	IdleSeconds    uint32               `json:"idle_duration_s"`
+	AuxRelays      []relayConfig        `json:"aux_relays,omitempty"`
+	// Optional run circuit, making 'relay' the standby circuit.
+	Run *runConfig `json:"run,omitempty"`
+	// Relays not part of the sequence use their own on delay.
+	PowerUpSequence []relayStep `json:"power_up_sequence,omitempty"`
+	GreenLed        ledConfig   `json:"green_led"`
+	RedLed          ledConfig   `json:"red_led"`
+	// Overrides of the built-in LED_PATTERN_* signals.
+	LedPatterns map[string]LedPattern `json:"led_patterns,omitempty"`
+	// Tweaks of the feedback when a badge is refused.
+	DeniedFeedback *deniedFeedbackConfig `json:"denied_feedback,omitempty"`
+	// Overrides of the built-in LED_STATE_* patterns, e.g. for single LED enclosures.
+	StateLeds map[string]stateLeds `json:"state_leds,omitempty"`
+	// Optional, encodes the remaining idle time in the green LED blink rate.
+	RemainingTimeLed *remainingTimeLedConfig `json:"remaining_time_led,omitempty"`
+	// LED_GREEN or LED_RED (default), showing all signals but the state.
+	AlertLed     string              `json:"alert_led,omitempty"`
+	Heartbeat    *heartbeatConfig    `json:"heartbeat,omitempty"`
+	Display      *displayConfig      `json:"display,omitempty"`
+	Eink         *einkConfig         `json:"eink,omitempty"`
+	Temperatures []temperatureConfig `json:"temperatures,omitempty"`
+	Interlocks   []interlockConfig   `json:"interlocks,omitempty"`
+	Bypass       *bypassConfig       `json:"bypass,omitempty"`
+	Tachometers  []tachometerConfig  `json:"tachometers,omitempty"`
+	IdleSeconds  uint32              `json:"idle_duration_s"`
+	// Fetches the config again that often, reloading once it changed; zero to never.
+	ConfigPollMinutes uint32 `json:"config_poll_minutes,omitempty"`
+	// Checks in with command & control that often, zero to never.
+	CheckInSeconds uint32 `json:"check_in_interval_s,omitempty"`
+
+	// Where the config was fetched from, and the version served (ETag or hash),
+	// empty for the local one.
+	ccUrl   string
+	version string
+}
+
+// Logs the config with its secrets blanked: the HTTP API token, the badge
+// pseudonymization key, and the passwords and query strings of URLs.
+func (c *AuthboxConfig) LogValue() slog.Value {
+	redacted := *c
+	redacted.BadgeAuth.UrlTemplate = redactUrl(c.BadgeAuth.UrlTemplate)
+	redacted.EventsUrl = redactUrl(c.EventsUrl)
+	redacted.SessionWebhook = redactUrl(c.SessionWebhook)
+	if c.Http != nil && c.Http.Token != "" {
+		h := *c.Http
+		h.Token = CONFIG_REDACTED
+		redacted.Http = &h
+	}
+	if c.MqttBroker != nil {
+		m := *c.MqttBroker
+		m.Broker = redactUrl(m.Broker)
+		redacted.MqttBroker = &m
+	}
+	if c.Logging != nil {
+		l := *c.Logging
+		if l.BadgePseudonyms != nil && l.BadgePseudonyms.Key != "" {
+			l.BadgePseudonyms = &badgePseudonymConfig{Key: CONFIG_REDACTED}
+		}
+		if l.Ship != nil {
+			l.Ship = &logShipConfig{Url: redactUrl(l.Ship.Url)}
+		}
+		redacted.Logging = &l
+	}
+	if c.Alerts != nil {
+		a := *c.Alerts
+		a.Webhooks = make([]alertWebhookConfig, len(c.Alerts.Webhooks))
+		for i, w := range c.Alerts.Webhooks {
+			w.Url = redactUrl(w.Url)
+			a.Webhooks[i] = w
+		}
+		redacted.Alerts = &a
+	}
+	if c.Eink != nil {
+		e := *c.Eink
+		e.ReservationUrl = redactUrl(e.ReservationUrl)
+		redacted.Eink = &e
+	}
+	if c.Tracing != nil {
+		redacted.Tracing = &tracingConfig{Endpoint: redactUrl(c.Tracing.Endpoint)}
+	}
+	// A value, which does not implement slog.LogValuer.
+	return slog.AnyValue(redacted)
+}
+
+// Returns the URL with its password and query string, if any, blanked. API
+// keys are often passed as query parameters.
+func redactUrl(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		// Cannot tell where the secrets are.
+		return CONFIG_REDACTED
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = CONFIG_REDACTED
+	}
+	return u.Redacted()
+}
+
+// Checks the mode and the schedules.
+func (c *AuthboxConfig) Validate() error {
+	switch c.Mode {
+	case "", MODE_BUTTONLESS, MODE_DOOR, MODE_ALWAYS_ON_METERED:
+	case MODE_BUTTON:
+		if c.Button == nil {
+			return fmt.Errorf("mode '%s' requires a 'button' section", c.Mode)
+		}
+	default:
+		return fmt.Errorf("unknown mode '%s'", c.Mode)
+	}
+	if err := validateSchedule(c.FreeAccess); err != nil {
+		return fmt.Errorf("free access: %w", err)
+	}
+	if c.Curfew != nil {
+		if err := c.Curfew.Validate(); err != nil {
+			return fmt.Errorf("curfew: %w", err)
+		}
+	}
+	return nil
+}
+
+// Returns all the configured relays, starting with the machine power relay.
+func (c *AuthboxConfig) Relays() []relayConfig {
+	machine := c.Relay
+	machine.Role = RELAY_ROLE_MACHINE
+	return append([]relayConfig{machine}, c.AuxRelays...)
 }
 
 type BadgingChan = <-chan string
@@ -111,9 +386,81 @@ type PublishFunc = func(topic string, payload interface{})
 
 type DeviceRet[Event any] struct {
 	Looper    func()
-	Events    chan Event
+	Events    chan DeviceEvent[Event]
 	OnEvent   func(payload Event, name string, publish PublishFunc)
 	Discovery MqttDiscovery
+	// Optional, puts the device in a safe state before the daemon exits.
+	Shutdown func()
+}
+
+// Deliveries slower than that are logged, e.g. a state machine busy with a
+// blocking call.
+const EVENT_SLOW_DELIVERY = 500 * time.Millisecond
+
+// An event of a device.
+type DeviceEvent[T any] struct {
+	Payload T
+	// When the device emitted it, with a monotonic clock reading.
+	Time time.Time
+	// Increments by one per event of the device, starting at 1, so consumers can
+	// detect dropped or reordered events. Zero for events injected, e.g. from
+	// the debug console.
+	Seq uint64
+}
+
+// Stamps the events sent on 'in' with their time and sequence number, as soon
+// as sent.
+func stampEvents[T any](in <-chan T) chan DeviceEvent[T] {
+	out := make(chan DeviceEvent[T])
+	go func() {
+		var seq uint64
+		for p := range in {
+			seq++
+			out <- DeviceEvent[T]{Payload: p, Time: Clk.Now(), Seq: seq}
+		}
+	}()
+	return out
+}
+
+// Merges the events of the devices, by ID, until ctx is done.
+func fanIn[T any](ctx context.Context, devs map[string]*DeviceRet[T]) <-chan DeviceEvent[T] {
+	out := make(chan DeviceEvent[T])
+	for _, dev := range devs {
+		go func(events <-chan DeviceEvent[T]) {
+			for {
+				select {
+				case e := <-events:
+					select {
+					case out <- e:
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(dev.Events)
+	}
+	return out
+}
+
+// Last sequence number received per device.
+type eventTracker map[string]uint64
+
+// Returns the payload of the event received from the device, logging if
+// events were dropped or reordered since the last one, or if it is late.
+func received[T any](t eventTracker, device string, e DeviceEvent[T]) T {
+	if e.Seq == 0 {
+		return e.Payload
+	}
+	if last := t[device]; e.Seq != last+1 {
+		slog.Warn("device events dropped or reordered", slog.String("device", device), slog.Uint64("expected", last+1), slog.Uint64("got", e.Seq))
+	}
+	t[device] = e.Seq
+	if latency := Clk.Now().Sub(e.Time); latency > EVENT_SLOW_DELIVERY {
+		slog.Warn("slow device event delivery", slog.String("device", device), slog.Duration("latency", latency))
+	}
+	return e.Payload
 }
 
 // Retrieves the config from command & control, falling back to the SD card if
@@ -123,14 +470,30 @@ func GetConfig(ccUrl string) (*AuthboxConfig, error) {
 	if err != nil {
 		return nil, err
 	}
-	if config, err := getConfigRemotely(hostname, ccUrl); err == nil {
+	_, span := StartSpan(context.Background(), "get_config")
+	config, err := getConfigRemotely(hostname, ccUrl, "")
+	span.End(err)
+	if err == nil {
 		return config, nil
 	}
-	return getConfigLocally()
+	slog.Warn("could not get config remotely, using the local one", slog.Any("err", err))
+	config, err = getConfigLocally()
+	if err != nil {
+		return nil, err
+	}
+	// Polling picks the remote config up once reachable.
+	config.ccUrl = ccUrl
+	return config, nil
 }
 
-// Retrieves and parses the config from ccUrl.
-func getConfigRemotely(hostname, ccUrl string) (*AuthboxConfig, error) {
+// Returned by getConfigRemotely when the config served does not parse or
+// validate.
+var ErrInvalidConfig = errors.New("invalid config")
+
+// Retrieves, parses and validates the config from ccUrl, authenticating with
+// the device token at path $CONFIG_TOKEN_FILE, if set. Returns nil if the config
+// version is still the given one.
+func getConfigRemotely(hostname, ccUrl, version string) (*AuthboxConfig, error) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
@@ -138,70 +501,199 @@ func getConfigRemotely(hostname, ccUrl string) (*AuthboxConfig, error) {
 	if err != nil {
 		return nil, err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	if path := os.Getenv("CONFIG_TOKEN_FILE"); path != "" {
+		token, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("device token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	if version != "" {
+		req.Header.Set("If-None-Match", version)
+	}
+	client, err := configHttpClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	observeServerDate(resp.Header)
+	if resp.StatusCode == http.StatusNotModified && version != "" {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		// E.g. the token is refused: do not run with an empty config.
+		return nil, fmt.Errorf("config: unexpected status %s", resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// Servers without ETag support are told apart by content.
+	served := resp.Header.Get("ETag")
+	if served == "" {
+		sum := sha256.Sum256(b)
+		served = hex.EncodeToString(sum[:])
+	}
+	if served == version {
+		return nil, nil
+	}
+	if err := verifyConfig(b, resp.Header.Get("X-Config-Signature")); err != nil {
+		return nil, err
+	}
 	var config AuthboxConfig
-	json.NewDecoder(resp.Body).Decode(&config)
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+	config.ccUrl, config.version = ccUrl, served
 	return &config, nil
 }
 
-// Retrieves the config from the local file at path $LOCAL_CONFIG_FILE.
+// Returns the client to fetch the config with. Over HTTPS, the server
+// certificate is verified against the CA certificates (PEM) at path
+// $CONFIG_CA_FILE if set, e.g. for a private CA, or the system ones otherwise.
+func configHttpClient() (*http.Client, error) {
+	path := os.Getenv("CONFIG_CA_FILE")
+	if path == "" {
+		return http.DefaultClient, nil
+	}
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("config CA: no certificate found in '%s'", path)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
+
+// Verifies the base64 Ed25519 signature of the config against the public key
+// at path $CONFIG_PUBLIC_KEY_FILE, provisioned at install time. Without a key,
+// configs are not signed.
+func verifyConfig(b []byte, signature string) error {
+	path := os.Getenv("CONFIG_PUBLIC_KEY_FILE")
+	if path == "" {
+		return nil
+	}
+	encoded, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config public key: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("config public key: expected %d bytes as base64", ed25519.PublicKeySize)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil || !ed25519.Verify(key, b, sig) {
+		return errors.New("config signature is missing or invalid")
+	}
+	return nil
+}
+
+// Retrieves the config from the local file at path $LOCAL_CONFIG_FILE, signed
+// by the file with the same path plus '.sig' if configs are signed.
 func getConfigLocally() (*AuthboxConfig, error) {
-	f, err := os.Open(os.Getenv("LOCAL_CONFIG_FILE"))
+	path := os.Getenv("LOCAL_CONFIG_FILE")
+	b, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	if os.Getenv("CONFIG_PUBLIC_KEY_FILE") != "" {
+		sig, err := os.ReadFile(path + ".sig")
+		if err != nil {
+			return nil, fmt.Errorf("config signature: %w", err)
+		}
+		if err := verifyConfig(b, string(sig)); err != nil {
+			return nil, err
+		}
+	}
 	var config AuthboxConfig
-	json.NewDecoder(f).Decode(&config)
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("local config: %w", err)
+	}
+	if config.Logging != nil && config.Logging.BadgePseudonyms != nil {
+		// The key is only trusted from command & control.
+		config.Logging.BadgePseudonyms.Key = ""
+	}
 	return &config, nil
 }
 
-// Badge reader logic. The event stream yields ASCII badge IDs.
+// Badge reader logic. The event stream yields ASCII badge IDs. The looper
+// returns once ctx is done, releasing the reader.
 // MQTT: registers as a tag scanner.
-func BadgeReader(c badgeReaderConfig) (*DeviceRet[string], error) {
-	device, err := findBadgeReader(c)
+func BadgeReader(ctx context.Context, c badgeReaderConfig) (*DeviceRet[string], error) {
+	device, err := Hw.OpenBadgeReader(c)
 	if err != nil {
 		return nil, err
 	}
 	if err := device.Grab(); err != nil {
 		return nil, err
 	}
+	badgeReaderHealthy.Store(true)
 	events := make(chan string)
 	looper := func() {
+		// Closing the device releases the grab and unblocks ReadOne.
+		defer device.Close()
 		keys := make(chan *evdev.InputEvent)
 		go func() {
 			for {
 				e, err := device.ReadOne()
+				if ctx.Err() != nil {
+					return
+				}
 				if err != nil {
 					slog.Warn("badge: could not read event", slog.Any("err", err))
+					badgeReaderHealthy.Store(false)
+					time.Sleep(time.Second)
+					continue
 				}
+				badgeReaderHealthy.Store(true)
 				if e.Type != evdev.EV_KEY {
 					continue
 				}
 				if e.Value == 0 {
 					continue
 				}
-				keys <- e
+				select {
+				case keys <- e:
+				case <-ctx.Done():
+					return
+				}
 			}
 		}()
 		timeout := time.NewTimer(0)
 		timeout.Stop()
+		alive := time.NewTicker(LIVENESS_INTERVAL)
 		s := ""
 		cap := false
+		Beat("badge_reader")
 		for {
 			select {
+			case <-ctx.Done():
+				return
+			case <-alive.C:
+				Beat("badge_reader")
 			case e := <-keys:
 				timeout.Reset(time.Duration(c.TimeoutMs) * time.Millisecond)
 				switch {
 				case e.Code == evdev.KEY_LEFTSHIFT, e.Code == evdev.KEY_RIGHTSHIFT:
 					cap = true
 				case e.Code == evdev.KEY_ENTER:
-					slog.Debug("badge: badged", slog.String("id", s))
-					events <- s
+					slog.Debug("badge: badged", BadgeAttr("id", s))
+					select {
+					case events <- s:
+					case <-ctx.Done():
+						return
+					}
 					s = ""
 					cap = false
 				case func() bool { _, ok := usKeyMap[e.Code]; return ok }():
@@ -240,9 +732,9 @@ func BadgeReader(c badgeReaderConfig) (*DeviceRet[string], error) {
 	}
 	return &DeviceRet[string]{
 		Looper: looper,
-		Events: events,
+		Events: stampEvents(events),
 		OnEvent: func(badgeId string, name string, publish PublishFunc) {
-			publish(name+"/badged", badgeId)
+			publish(name+"/badged", BadgePseudonym(badgeId))
 		},
 		Discovery: MqttDiscovery{
 			Component: "tag",
@@ -252,47 +744,49 @@ func BadgeReader(c badgeReaderConfig) (*DeviceRet[string], error) {
 	}, nil
 }
 
-// Current sensing logic (digital). The event stream yield high/low transitions.
+// Current sensing logic (digital, or analog through an ADC). The event stream yield high/low transitions,
+// starting with the level at startup for the digital driver.
+// The looper returns once ctx is done, releasing the input.
 // MQTT: registers as a switch with a 'current' device class. 0 Amps means no current, 42 Amps means some current.
-func CurrentSensing(c currentSensingConfig) (*DeviceRet[bool], error) {
-	chip, err := findGpioChip()
-	if err != nil {
-		return nil, err
-	}
+func CurrentSensing(ctx context.Context, c currentSensingConfig) (*DeviceRet[bool], error) {
 	events := make(chan bool)
-	bias := gpiocdev.LineBiasPullDown
-	if c.Bias == "pull_up" {
-		bias = gpiocdev.LineBiasPullUp
+	filtered := events
+	if c.MinHighMs != 0 || c.MinLowMs != 0 {
+		filtered = make(chan bool)
+		go holdFilter(ctx, events, filtered, time.Duration(c.MinHighMs)*time.Millisecond, time.Duration(c.MinLowMs)*time.Millisecond)
 	}
-	line, err := chip.RequestLine(
-		c.Pin,
-		gpiocdev.AsInput,
-		bias,
-		gpiocdev.WithBothEdges,
-		gpiocdev.DebounceOption(time.Duration(c.DebounceMs)*time.Millisecond),
-		gpiocdev.WithEventHandler(func(le gpiocdev.LineEvent) {
-			high := false
-			if le.Type == gpiocdev.LineEventRisingEdge {
-				high = true
-			}
-			if c.ActiveLow {
-				high = !high
-			}
-			slog.Debug("gpio: pin transition", slog.Int("pin", c.Pin), slog.Bool("high", high))
-			events <- high
-		}))
-	_ = line
-	if err != nil {
-		return nil, err
+	send := func(high bool) {
+		select {
+		case events <- high:
+		case <-ctx.Done():
+		}
 	}
-	looper := func() {
-		for {
-			time.Sleep(time.Second * 60)
+	var looper func()
+	switch c.Driver {
+	case "", CURRENT_DRIVER_GPIO:
+		watch, high, err := Hw.WatchInput(c.inputConfig, send)
+		if err != nil {
+			return nil, err
+		}
+		looper = func() {
+			defer watch.Close()
+			send(high)
+			<-ctx.Done()
+		}
+	case CURRENT_DRIVER_MCP3008:
+		if c.Adc == nil {
+			return nil, errors.New("mcp3008 current sensing requires an 'adc' section")
+		}
+		var err error
+		if looper, err = mcp3008CurrentSensing(ctx, *c.Adc, send); err != nil {
+			return nil, err
 		}
+	default:
+		return nil, fmt.Errorf("unknown current sensing driver '%s'", c.Driver)
 	}
 	return &DeviceRet[bool]{
 		Looper: looper,
-		Events: events,
+		Events: stampEvents(filtered),
 		OnEvent: func(isHigh bool, name string, publish func(string, interface{})) {
 			publish(name+"/current", map[bool]string{false: "0", true: "42"}[isHigh])
 		},
@@ -316,47 +810,300 @@ func CurrentSensing(c currentSensingConfig) (*DeviceRet[bool], error) {
 	}, nil
 }
 
+// Forwards the transitions of 'in' to 'out' once the new level has been held
+// continuously for minHigh (resp. minLow). Shorter excursions are dropped.
+// Starts low. Returns once ctx is done.
+func holdFilter(ctx context.Context, in <-chan bool, out chan<- bool, minHigh, minLow time.Duration) {
+	stable, pending := false, false
+	settled := Clk.NewTimer(0)
+	settled.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case high := <-in:
+			pending = high
+			if high == stable {
+				settled.Stop()
+				continue
+			}
+			settled.Reset(map[bool]time.Duration{false: minLow, true: minHigh}[high])
+		case <-settled.C():
+			stable = pending
+			slog.Debug("current: filtered transition", slog.Bool("high", stable))
+			select {
+			case out <- stable:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Push button logic (digital). The event stream yields true when pressed and
+// false when released.
+// The looper returns once ctx is done, releasing the input.
+// MQTT: registers as a binary sensor.
+func Button(ctx context.Context, c inputConfig) (*DeviceRet[bool], error) {
+	events := make(chan bool)
+	watch, _, err := Hw.WatchInput(c, func(high bool) {
+		select {
+		case events <- high:
+		case <-ctx.Done():
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceRet[bool]{
+		Looper: func() {
+			defer watch.Close()
+			<-ctx.Done()
+		},
+		Events: stampEvents(events),
+		OnEvent: func(pressed bool, name string, publish PublishFunc) {
+			publish(name+"/button", map[bool]string{false: "OFF", true: "ON"}[pressed])
+		},
+		Discovery: MqttDiscovery{
+			Component: "binary_sensor",
+			Id:        "button",
+			Announce: func(name, topic string) interface{} {
+				return struct {
+					Device     MqttDevice `json:"device"`
+					StateTopic string     `json:"state_topic"`
+				}{
+					Device:     MqttDevice{Name: "Button on " + name},
+					StateTopic: topic + "/" + name + "/button",
+				}
+			},
+		},
+	}, nil
+}
+
+// Door contact logic (digital). The event stream yields true when the door is closed,
+// starting with the state at startup.
+// The looper returns once ctx is done, releasing the input.
+// MQTT: registers as a binary sensor with a 'door' device class.
+func DoorContact(ctx context.Context, c doorContactConfig) (*DeviceRet[bool], error) {
+	events := make(chan bool)
+	send := func(high bool) {
+		select {
+		case events <- high:
+		case <-ctx.Done():
+		}
+	}
+	watch, closed, err := Hw.WatchInput(c.inputConfig, send)
+	if err != nil {
+		return nil, err
+	}
+	// Exempt from the liveness checks, see Beat.
+	looper := func() {
+		defer watch.Close()
+		send(closed)
+		<-ctx.Done()
+	}
+	return &DeviceRet[bool]{
+		Looper: looper,
+		Events: stampEvents(events),
+		OnEvent: func(isClosed bool, name string, publish PublishFunc) {
+			publish(name+"/door", map[bool]string{false: "ON", true: "OFF"}[isClosed])
+		},
+		Discovery: MqttDiscovery{
+			Component: "binary_sensor",
+			Id:        "door_contact",
+			Announce: func(name, topic string) interface{} {
+				return struct {
+					Device      MqttDevice `json:"device"`
+					DeviceClass string     `json:"device_class"`
+					StateTopic  string     `json:"state_topic"`
+				}{
+					Device:      MqttDevice{Name: "Door contact on " + name},
+					DeviceClass: "door",
+					StateTopic:  topic + "/" + name + "/door",
+				}
+			},
+		},
+	}, nil
+}
+
+// Requests an input line with events on both edges, calling onChange with the
+// logical (ActiveLow-adjusted) level on each debounced transition.
+// Also returns the logical level at request time.
+func watchInput(c inputConfig, onChange func(high bool)) (io.Closer, bool, error) {
+	debounce := time.Duration(c.DebounceMs) * time.Millisecond
+	if c.Pin.Expander != 0 {
+		closer, high, err := watchExpanderInput(c.Pin, debounce, func(high bool) {
+			high = high != c.ActiveLow
+			slog.Debug("gpio: pin transition", slog.String("pin", c.Pin.String()), slog.Bool("high", high))
+			onChange(high)
+		})
+		return closer, high != c.ActiveLow, err
+	}
+	chip, err := findGpioChip(c.Pin.Chip)
+	if err != nil {
+		return nil, false, err
+	}
+	bias := gpiocdev.LineBiasPullDown
+	if c.Bias == "pull_up" {
+		bias = gpiocdev.LineBiasPullUp
+	}
+	line, err := requestLine(
+		chip,
+		c.Pin.Offset,
+		gpiocdev.AsInput,
+		bias,
+		gpiocdev.WithBothEdges,
+		gpiocdev.DebounceOption(debounce),
+		gpiocdev.WithEventHandler(func(le gpiocdev.LineEvent) {
+			high := false
+			if le.Type == gpiocdev.LineEventRisingEdge {
+				high = true
+			}
+			if c.ActiveLow {
+				high = !high
+			}
+			slog.Debug("gpio: pin transition", slog.String("pin", c.Pin.String()), slog.Bool("high", high))
+			onChange(high)
+		}))
+	if err != nil {
+		return nil, false, err
+	}
+	value, err := line.Value()
+	if err != nil {
+		return nil, false, err
+	}
+	return line, (value == 1) != c.ActiveLow, nil
+}
+
 // Sets the line value according to 'on'.
-// The high/low logic if inverted if activeLow is true.
-func setLineValue(activeLow bool, line *gpiocdev.Line, on bool) error {
-	value := on
-	if activeLow {
-		value = !value
+// The high/low logic is inverted if activeLow is true.
+func setLineValue(activeLow bool, line OutputLine, on bool) error {
+	return line.SetValue(rawValue(activeLow, on))
+}
+
+// Returns the MQTT identifier of the relay, "relay" for the machine power relay
+// and "relay_<role>" for the others.
+func relayId(c relayConfig) string {
+	if c.Role == "" || c.Role == RELAY_ROLE_MACHINE {
+		return "relay"
+	}
+	return "relay_" + c.Role
+}
+
+// Returns the raw line value for the logical state 'on'.
+// The high/low logic is inverted if activeLow is true.
+func rawValue(activeLow bool, on bool) int {
+	return map[bool]int{false: 0, true: 1}[on != activeLow]
+}
+
+// Returns the logical state the relay starts in: its last commanded state if
+// restoring is enabled and known, InitialOn otherwise. Pulse relays always start off.
+func relayInitialState(c relayConfig) bool {
+	if c.Mode == RELAY_MODE_PULSE {
+		return false
 	}
-	return line.SetValue(map[bool]int{false: 0, true: 1}[value])
+	if c.RestoreState {
+		if b, err := os.ReadFile(StatePath(relayId(c) + ".state")); err == nil {
+			return strings.TrimSpace(string(b)) == "1"
+		}
+	}
+	return c.InitialOn
 }
 
 // Relay logic. Switches a GPIO pin according to 'isOn' booleans.
+// In pulse mode, switching on energizes the pin for PulseMs only (door strike,
+// contactor start coil) and switching off is a no-op.
+// The line is requested in its initial state, so there is no glitch at startup.
+// The looper returns once ctx is done, closing the line as is: call Shutdown
+// before to apply the exit action.
 // MQTT: registers as a switch.
-func Relay(c relayConfig, isOn <-chan bool) (*DeviceRet[bool], error) {
-	chip, err := findGpioChip()
-	if err != nil {
-		return nil, err
+func Relay(ctx context.Context, c relayConfig, isOn <-chan bool) (*DeviceRet[bool], error) {
+	if c.Mode == RELAY_MODE_PULSE && c.PulseMs == 0 {
+		return nil, fmt.Errorf("mode '%s' requires a positive 'pulse_ms'", c.Mode)
 	}
-	line, err := chip.RequestLine(c.Pin, gpiocdev.AsOutput(0))
+	line, err := Hw.RequestOutput(c.Pin, rawValue(c.ActiveLow, relayInitialState(c)))
 	if err != nil {
 		return nil, err
 	}
+	// Serializes switching with the exit action, which must win, and closing.
+	var mu sync.Mutex
+	exited, closed := false, false
+	set := func(on bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !exited {
+			setLineValue(c.ActiveLow, line, on)
+		}
+	}
 	looper := func() {
+		pulseEnd := Clk.NewTimer(0)
+		pulseEnd.Stop()
+		alive := time.NewTicker(LIVENESS_INTERVAL)
+		Beat(relayId(c))
 		for {
 			select {
+			case <-ctx.Done():
+				mu.Lock()
+				defer mu.Unlock()
+				exited, closed = true, true
+				line.Close()
+				return
+			case <-alive.C:
+				Beat(relayId(c))
 			case on := <-isOn:
-				setLineValue(c.ActiveLow, line, on)
+				if c.Mode != RELAY_MODE_PULSE {
+					set(on)
+					if c.RestoreState {
+						if err := writeStateFile(relayId(c)+".state", []byte(map[bool]string{false: "0", true: "1"}[on])); err != nil {
+							slog.Warn("relay: could not persist state", slog.String("relay", relayId(c)), slog.Any("err", err))
+						}
+					}
+					continue
+				}
+				if on {
+					slog.Debug("relay: pulse", slog.String("pin", c.Pin.String()), slog.Int("ms", int(c.PulseMs)))
+					set(true)
+					pulseEnd.Reset(time.Duration(c.PulseMs) * time.Millisecond)
+				}
+			case <-pulseEnd.C():
+				set(false)
 			}
 		}
 	}
+	shutdown := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		exited = true
+		if closed {
+			slog.Warn("relay: already closed on exit", slog.String("relay", relayId(c)))
+			return
+		}
+		switch c.OnExit {
+		case RELAY_EXIT_KEEP:
+			slog.Info("relay: left as is on exit", slog.String("relay", relayId(c)))
+		case RELAY_EXIT_ON:
+			setLineValue(c.ActiveLow, line, c.Mode != RELAY_MODE_PULSE)
+		default:
+			setLineValue(c.ActiveLow, line, false)
+		}
+	}
+	id := relayId(c)
+	deviceName := "Relay"
+	if id != "relay" {
+		deviceName += " (" + c.Role + ")"
+	}
 	discovery := MqttDiscovery{
 		Component: "switch",
-		Id:        "relay",
+		Id:        id,
 		Announce: func(name, topic string) interface{} {
 			return struct {
 				Device       MqttDevice `json:"device"`
 				CommandTopic string     `json:"command_topic"`
 				StateTopic   string     `json:"state_topic"`
 			}{
-				Device:       MqttDevice{Name: "Relay on " + name},
-				CommandTopic: topic + "/" + name + "/relay/set", // ignored, read-only
-				StateTopic:   topic + "/" + name + "/relay",
+				Device:       MqttDevice{Name: deviceName + " on " + name},
+				CommandTopic: topic + "/" + name + "/" + id + "/set", // ignored, read-only
+				StateTopic:   topic + "/" + name + "/" + id,
 			}
 		},
 	}
@@ -364,76 +1111,259 @@ func Relay(c relayConfig, isOn <-chan bool) (*DeviceRet[bool], error) {
 		Looper: looper,
 		Events: nil,
 		OnEvent: func(isOn bool, name string, publish func(string, interface{})) {
-			publish(name+"/relay", map[bool]string{false: "OFF", true: "ON"}[isOn])
+			publish(name+"/"+id, map[bool]string{false: "OFF", true: "ON"}[isOn])
 		},
 		Discovery: discovery,
+		Shutdown:  shutdown,
 	}, nil
 }
 
-// Blinker utility to set a GPIO LED in either static or blink mode.
-// To change the state, send either LedStatic{On: bool} or LedBlink{Interval: Duration} to chan 'mode'.
-// If sysLedName is non-empty, this also controls the on-board LED at /sys/class/leds/<sysLedName>.
-func Blinker(c ledConfig, sysLedName string, mode <-chan interface{}) (func(), error) {
-	if sysLedName != "" {
-		os.WriteFile("/sys/class/leds/"+sysLedName+"/trigger", []byte("none"), 0)
+type bankedRelay struct {
+	config relayConfig
+	dev    *DeviceRet[bool]
+	// Holds the latest switch the relay did not take yet.
+	isOn   chan bool
+	timers []Timer
+	// Nil without feedback.
+	feedback  *DeviceRet[bool]
+	commanded chan bool
+	// Incremented on each switch so that stale delayed switches are dropped.
+	generation uint64
+}
+
+// A set of relays switched together by the state machine, each with its own
+// on/off delay (e.g. the dust collector stopping 30 s after the machine).
+// If a power-up sequence is configured, switching on follows it instead.
+type RelayBank struct {
+	mu       sync.Mutex
+	relays   []*bankedRelay
+	sequence []relayStep
+	// Yields wiring faults detected by the relays' feedback inputs.
+	Faults chan RelayFault
+}
+
+// Relay bank logic. Creates one Relay per config, living until ctx is done.
+// MQTT: each relay registers as its own switch.
+func NewRelayBank(ctx context.Context, cs []relayConfig, sequence []relayStep) (*RelayBank, error) {
+	b := &RelayBank{sequence: sequence, Faults: make(chan RelayFault)}
+	for _, c := range cs {
+		isOn := make(chan bool, 1)
+		dev, err := Relay(ctx, c, isOn)
+		if err != nil {
+			return nil, fmt.Errorf("relay %s: %w", relayId(c), err)
+		}
+		r := &bankedRelay{config: c, dev: dev, isOn: isOn}
+		if c.Feedback != nil && c.Mode != RELAY_MODE_PULSE {
+			r.commanded = make(chan bool, 1)
+			if r.feedback, err = RelayFeedback(c, r.commanded); err != nil {
+				return nil, fmt.Errorf("relay %s feedback: %w", relayId(c), err)
+			}
+		}
+		b.relays = append(b.relays, r)
 	}
-	setPiLed := func(isOn bool) {
-		if sysLedName != "" {
-			os.WriteFile("/sys/class/leds/"+sysLedName+"/brightness", []byte(map[bool]string{false: "0", true: "1"}[isOn]), 0)
+	for _, step := range sequence {
+		if b.byRole(step.Role) == nil {
+			return nil, fmt.Errorf("power-up sequence: no relay with role '%s'", step.Role)
 		}
 	}
-	gpio, err := findGpioChip()
-	if err != nil {
-		return nil, err
+	return b, nil
+}
+
+func (b *RelayBank) byRole(role string) *bankedRelay {
+	for _, r := range b.relays {
+		if r.config.Role == role {
+			return r
+		}
 	}
-	line, err := gpio.RequestLine(c.Pin, gpiocdev.AsOutput(0))
-	if err != nil {
-		return nil, err
+	return nil
+}
+
+// Returns the initial state of the machine power relay.
+func (b *RelayBank) InitialState() bool {
+	return relayInitialState(b.relays[0].config)
+}
+
+// Applies the exit action of all relays. Further switching is ignored.
+func (b *RelayBank) Shutdown() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range b.relays {
+		r.generation++
+		for _, t := range r.timers {
+			t.Stop()
+		}
+		r.dev.Shutdown()
 	}
-	return func() {
-		timer := time.NewTicker(time.Millisecond)
-		timer.Stop()
-		isOn := false
-		for {
-			select {
-			case m := <-mode:
-				switch mm := m.(type) {
-				case LedStatic:
-					timer.Stop()
-					setLineValue(c.ActiveLow, line, mm.On)
-					go setPiLed(mm.On)
-				case LedBlink:
-					isOn = false
-					setLineValue(c.ActiveLow, line, false)
-					go setPiLed(isOn)
-					timer.Reset(mm.Interval)
+}
+
+// Starts the loopers of all relays, the relays' own with 'run'.
+func (b *RelayBank) Start(run func(name string, looper func())) {
+	for _, r := range b.relays {
+		run(relayId(r.config), r.dev.Looper)
+		if r.feedback != nil {
+			go Guard(relayId(r.config)+"_feedback", r.feedback.Looper)()
+			go func(r *bankedRelay) {
+				for e := range r.feedback.Events {
+					b.Faults <- RelayFault{Role: r.config.Role, Fault: e.Payload}
 				}
-			case <-timer.C:
-				isOn = !isOn
-				setLineValue(c.ActiveLow, line, isOn)
-				go setPiLed(isOn)
-			}
+			}(r)
 		}
-	}, nil
+	}
+}
+
+// Publishes the relay fault to MQTT.
+func (b *RelayBank) OnFault(f RelayFault, name string, publish PublishFunc) {
+	if r := b.byRole(f.Role); r != nil && r.feedback != nil {
+		r.feedback.OnEvent(f.Fault, name, publish)
+	}
+}
+
+// Returns the MQTT discoveries of all relays.
+func (b *RelayBank) Discoveries() []MqttDiscovery {
+	ds := []MqttDiscovery{}
+	for _, r := range b.relays {
+		ds = append(ds, r.dev.Discovery)
+		if r.feedback != nil {
+			ds = append(ds, r.feedback.Discovery)
+		}
+	}
+	return ds
+}
+
+// Switches all relays on or off, after their respective delay, or following
+// the power-up sequence when switching on.
+// Delayed switches that are still pending are cancelled.
+func (b *RelayBank) Set(on bool, name string, publish PublishFunc) {
+	b.set(on, false, name, publish)
+}
+
+// Switches all relays off at the end of a session, keeping those with a
+// cool-down on for that long if longer than their off delay.
+// Returns the longest cool-down.
+func (b *RelayBank) Cooldown(name string, publish PublishFunc) time.Duration {
+	b.set(false, true, name, publish)
+	longest := time.Duration(0)
+	for _, r := range b.relays {
+		longest = max(longest, time.Duration(r.config.CooldownS)*time.Second)
+	}
+	return longest
+}
+
+func (b *RelayBank) set(on bool, cooldown bool, name string, publish PublishFunc) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range b.relays {
+		r.generation++
+		for _, t := range r.timers {
+			t.Stop()
+		}
+		r.timers = nil
+	}
+	sequenced := map[*bankedRelay]bool{}
+	if on {
+		at := time.Duration(0)
+		for _, step := range b.sequence {
+			at += time.Duration(step.DelayMs) * time.Millisecond
+			r := b.byRole(step.Role)
+			sequenced[r] = true
+			b.schedule(r, step.On, at, name, publish)
+		}
+	}
+	for _, r := range b.relays {
+		if sequenced[r] {
+			continue
+		}
+		delay := time.Duration(r.config.OffDelayMs) * time.Millisecond
+		if on {
+			delay = time.Duration(r.config.OnDelayMs) * time.Millisecond
+		} else if cooldown {
+			delay = max(delay, time.Duration(r.config.CooldownS)*time.Second)
+		}
+		b.schedule(r, on, delay, name, publish)
+	}
+}
+
+// Switches the relay after delay, unless the bank is switched again in the meantime.
+// Must be called with the lock held.
+func (b *RelayBank) schedule(r *bankedRelay, on bool, delay time.Duration, name string, publish PublishFunc) {
+	if delay == 0 {
+		r.switchNow(on, name, publish)
+		return
+	}
+	generation := r.generation
+	r.timers = append(r.timers, Clk.AfterFunc(delay, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if r.generation != generation {
+			return
+		}
+		slog.Debug("relay: delayed switch", slog.String("role", r.config.Role), slog.Bool("on", on))
+		r.switchNow(on, name, publish)
+	}))
+}
+
+// Must be called with the lock held. Never waits on the relay and feedback
+// loopers, which may be busy or gone: only the latest state matters.
+func (r *bankedRelay) switchNow(on bool, name string, publish PublishFunc) {
+	sendLatest(r.isOn, on)
+	if r.commanded != nil {
+		sendLatest(r.commanded, on)
+	}
+	go r.dev.OnEvent(on, name, publish)
+}
+
+// Sends v on c, which must be buffered, replacing the value not received yet
+// if any. The caller must be the only sender.
+func sendLatest[T any](c chan T, v T) {
+	select {
+	case <-c:
+	default:
+	}
+	c <- v
 }
 
 type MqttEvent struct {
 	DisconnectedError error
+	// Set for commands received on '<topic>/<name>/<command>/set', in which case
+	// DisconnectedError is irrelevant.
+	Command string
+	Payload string
+	// Set for messages of another box on '<topic>/<peer>/<command>', for the
+	// ACTIVE_BADGE_TOPIC, AUX_GROUP_TOPIC and availability sub-topics.
+	Peer string
 }
 
-// Publish to MQTT logic. At connect time, publishes Home Assistant discovery messages.
+// Wraps a payload to publish it as retained.
+type MqttRetained struct {
+	Payload string
+}
+
+// Publish to MQTT logic. At connect time, publishes Home Assistant discovery messages
+// unless done centrally.
 // Use the returned PublishFunc to publish messages using the configured topic prefix.
-func MqttBroker(name string, c mqttConfig, discoveries []MqttDiscovery) (func(), <-chan MqttEvent, PublishFunc) {
+// The looper returns once ctx is done, after disconnecting.
+func MqttBroker(ctx context.Context, name string, c mqttConfig, discoveries []MqttDiscovery) (func(), <-chan MqttEvent, PublishFunc) {
+	availabilityTopic := c.Topic + "/" + name + "/availability"
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(c.Broker)
 	opts.SetClientID("authbox/" + name)
+	opts.SetWill(availabilityTopic, "offline", 1, true)
 	opts.SetAutoReconnect(true)
 	opts.SetConnectTimeout(time.Second * 2)
 	opts.SetConnectRetryInterval(time.Second * 2)
 
 	events := make(chan MqttEvent)
+	send := func(e MqttEvent) {
+		select {
+		case events <- e:
+		case <-ctx.Done():
+		}
+	}
 
 	sendDiscoveries := func(mc mqtt.Client) {
+		if c.CentralDiscovery {
+			return
+		}
 		for _, d := range discoveries {
 			bytes, err := json.Marshal(d.Announce(name, c.Topic))
 			if err != nil {
@@ -447,28 +1377,64 @@ func MqttBroker(name string, c mqttConfig, discoveries []MqttDiscovery) (func(),
 	}
 
 	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
-		events <- MqttEvent{DisconnectedError: err}
+		send(MqttEvent{DisconnectedError: err})
 	})
 	opts.SetOnConnectHandler(func(mc mqtt.Client) {
-		events <- MqttEvent{DisconnectedError: nil}
+		send(MqttEvent{DisconnectedError: nil})
+		mc.Publish(availabilityTopic, 1, true, "online")
 		sendDiscoveries(mc)
+		commandTopic := c.Topic + "/" + name + "/+/set"
+		if t := mc.Subscribe(commandTopic, 1, func(mc mqtt.Client, m mqtt.Message) {
+			command := strings.TrimSuffix(strings.TrimPrefix(m.Topic(), c.Topic+"/"+name+"/"), "/set")
+			send(MqttEvent{Command: command, Payload: string(m.Payload())})
+		}); t.Wait() && t.Error() != nil {
+			slog.Error("could not subscribe to mqtt commands", slog.Any("error", t.Error()))
+		}
+		peerTopics := map[string]byte{
+			c.Topic + "/+/" + ACTIVE_BADGE_TOPIC:     1,
+			c.Topic + "/+/" + AUX_GROUP_TOPIC + "/+": 1,
+			c.Topic + "/+/availability":              1,
+		}
+		if t := mc.SubscribeMultiple(peerTopics, func(mc mqtt.Client, m mqtt.Message) {
+			peer, command, _ := strings.Cut(strings.TrimPrefix(m.Topic(), c.Topic+"/"), "/")
+			if peer == name {
+				return
+			}
+			send(MqttEvent{Peer: peer, Command: command, Payload: string(m.Payload())})
+		}); t.Wait() && t.Error() != nil {
+			slog.Error("could not subscribe to other boxes", slog.Any("error", t.Error()))
+		}
 	})
 
 	mc := mqtt.NewClient(opts)
 
 	looper := func() {
 		for {
-			if t := mc.Connect(); t.Wait() && t.Error() != nil {
-				events <- MqttEvent{DisconnectedError: t.Error()}
-				time.Sleep(time.Second * 5)
-			} else {
+			t := mc.Connect()
+			if t.Wait() && t.Error() == nil {
+				break
+			}
+			send(MqttEvent{DisconnectedError: t.Error()})
+			select {
+			case <-ctx.Done():
 				return
+			case <-time.After(time.Second * 5):
 			}
 		}
+		<-ctx.Done()
+		// Publishes the offline availability, as the will is not sent on clean disconnects.
+		if mc.IsConnected() {
+			mc.Publish(availabilityTopic, 1, true, "offline").WaitTimeout(time.Second)
+		}
+		mc.Disconnect(250)
 	}
 
 	publish := func(topic string, payload interface{}) {
-		if t := mc.Publish(c.Topic+"/"+topic, 0, false, payload); t.Wait() && t.Error() != nil {
+		retained := false
+		if r, ok := payload.(MqttRetained); ok {
+			payload, retained = r.Payload, true
+		}
+		if t := mc.Publish(c.Topic+"/"+topic, 0, retained, payload); t.Wait() && t.Error() != nil {
 			slog.Error("could not publish to mqtt", slog.Any("error", t.Error()))
 		}
 	}
@@ -476,11 +1442,112 @@ func MqttBroker(name string, c mqttConfig, discoveries []MqttDiscovery) (func(),
 	return looper, events, publish
 }
 
-// Sends a HTTP request to check for badge access.
-func BadgeAuth(c badgeAuthConfig, badgeId string, state string) error {
+// Publishes the value derived from the state whenever it changes, and again on
+// each connection as the broker may have lost it.
+func SubscribeRetained[T comparable](bus *Bus, value func(State) T, publish func(T)) {
+	var last T
+	published := false
+	Subscribe(bus, func(e StateChanged) {
+		if v := value(e.State); !published || v != last {
+			published, last = true, v
+			go publish(v)
+		}
+	})
+	Subscribe(bus, func(e MqttConnection) {
+		if e.Connected && published {
+			go publish(last)
+		}
+	})
+}
+
+// Publishes the state machine events to MQTT, besides the devices' own.
+func SubscribeMqtt(bus *Bus, config *AuthboxConfig, name string, publish PublishFunc) {
+	SubscribeRetained(bus, func(s State) string { return s.lockout }, func(reason string) {
+		PublishLockout(reason, name, publish)
+	})
+	SubscribeRetained(bus, func(s State) string { return s.clockProblem }, func(problem string) {
+		PublishClockProblem(problem, name, publish)
+	})
+	if config.Curfew != nil {
+		SubscribeRetained(bus, func(s State) string { return s.curfew }, func(phase string) {
+			PublishCurfew(phase, name, publish)
+		})
+	}
+	if config.AntiPassback != nil {
+		SubscribeRetained(bus, func(s State) string { return s.badgeId }, func(badgeId string) {
+			PublishActiveBadge(badgeId, name, publish)
+		})
+	}
+	if config.AuxGroup != nil {
+		SubscribeRetained(bus, func(s State) bool { return s.state == STATE_IN_USE }, func(inUse bool) {
+			PublishAuxGroupInUse(config.AuxGroup.Group, inUse, name, publish)
+		})
+	}
+	Subscribe(bus, func(e Tripped) { go PublishTrip(e.Reason, name, publish) })
+}
+
+// Response of the badge authentication backend. All fields are optional.
+type BadgeAuthResult struct {
+	MemberName string `json:"member_name,omitempty"`
+	// Overrides the idle timeout for this session, e.g. for long CNC jobs.
+	IdleSeconds uint32 `json:"idle_duration_s,omitempty"`
+}
+
+// Sends a HTTP request to check for badge access. The outcome and latency are
+// recorded in the metrics.
+func BadgeAuth(c badgeAuthConfig, badgeId string, state string) (*BadgeAuthResult, error) {
+	return BadgeAuthContext(context.Background(), c, badgeId, state)
+}
+
+// Like BadgeAuth, traced as part of the span in ctx, if any.
+func BadgeAuthContext(ctx context.Context, c badgeAuthConfig, badgeId string, state string) (*BadgeAuthResult, error) {
+	ctx, span := StartSpan(ctx, "badge_auth")
+	span.SetAttr("action", state)
+	timeout := time.Duration(c.TimeoutMs) * time.Millisecond
+	if timeout == 0 {
+		timeout = BADGE_AUTH_DEFAULT_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	result, err := badgeAuth(ctx, c, badgeId, state)
+	span.End(err)
+	metricsAuth(state, AuthOutcome(err), time.Since(start))
+	return result, err
+}
+
+// Classifies the error of BadgeAuth as one of AUTH_OUTCOME_*.
+func AuthOutcome(err error) string {
+	var authErr *BadgeAuthError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return AUTH_OUTCOME_OK
+	case errors.As(err, &authErr) && authErr.Status >= 500:
+		return AUTH_OUTCOME_5XX
+	case errors.As(err, &authErr):
+		return AUTH_OUTCOME_DENIED
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return AUTH_OUTCOME_TIMEOUT
+	default:
+		return AUTH_OUTCOME_ERROR
+	}
+}
+
+// The backend refused the badge, or failed.
+type BadgeAuthError struct {
+	Status int
+	Reason string
+}
+
+func (e *BadgeAuthError) Error() string {
+	return "error authenticating badge: " + e.Reason
+}
+
+func badgeAuth(ctx context.Context, c badgeAuthConfig, badgeId string, state string) (*BadgeAuthResult, error) {
 	t, err := template.New("url").Parse(c.UrlTemplate)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	var url strings.Builder
 	err = t.Execute(&url, map[string]interface{}{
@@ -489,20 +1556,29 @@ func BadgeAuth(c badgeAuthConfig, badgeId string, state string) error {
 		"duration": c.UsageMinutes,
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	resp, err := http.Post(url.String(), "text/plain", strings.NewReader(""))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url.String(), strings.NewReader(""))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		var reason []byte
 		if reason, err = io.ReadAll(io.LimitReader(resp.Body, 256)); err != nil {
 			reason = []byte("(can't decode body)")
 		}
-		return errors.New("error authenticating badge: " + string(reason))
+		return nil, &BadgeAuthError{Status: resp.StatusCode, Reason: string(reason)}
 	}
-	return nil
+	var result BadgeAuthResult
+	// The backend is not required to send anything back.
+	json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&result)
+	return &result, nil
 }
 
 // Finds the badge reader input device by either name or numeric vendor & product IDs.
@@ -528,8 +1604,26 @@ func findBadgeReader(c badgeReaderConfig) (*evdev.InputDevice, error) {
 	return nil, fmt.Errorf("no badge reader found amongst %d devices with ID %04x:%04x", len(paths), c.Vendor, c.Product)
 }
 
-// Finds the GPIO chip by label prefix.
-func findGpioChip() (*gpiocdev.Chip, error) {
+// GPIO chips opened so far, by the label they were looked up with.
+var gpioChips = struct {
+	mu      sync.Mutex
+	byLabel map[string]*gpiocdev.Chip
+	// All requested lines, to release them on exit.
+	lines []*gpiocdev.Line
+}{byLabel: map[string]*gpiocdev.Chip{}}
+
+// Returns the GPIO chip whose name (e.g. "gpiochip1") is 'label' or whose label
+// starts with 'label'. The empty label is the SoC GPIO chip.
+func findGpioChip(label string) (*gpiocdev.Chip, error) {
+	gpioChips.mu.Lock()
+	defer gpioChips.mu.Unlock()
+	if c, ok := gpioChips.byLabel[label]; ok {
+		return c, nil
+	}
+	prefix := label
+	if prefix == "" {
+		prefix = GPIO_WANTED_PREFIX
+	}
 	paths, err := filepath.Glob("/dev/gpiochip*")
 	if err != nil {
 		return nil, err
@@ -539,31 +1633,13 @@ func findGpioChip() (*gpiocdev.Chip, error) {
 		if err != nil {
 			return nil, err
 		}
-		if strings.HasPrefix(c.Label, GPIO_WANTED_PREFIX) {
-			return c, err
+		if c.Name == prefix || strings.HasPrefix(c.Label, prefix) {
+			gpioChips.byLabel[label] = c
+			return c, nil
 		}
+		c.Close()
 	}
-	return nil, fmt.Errorf("no GPIO chip found amongst %d devices with prefix '%s'", len(paths), GPIO_WANTED_PREFIX)
-}
-
-// Sends a message to systemd notify socket.
-func SdNotify(state string) (bool, error) {
-	socketAddr := &net.UnixAddr{
-		Name: os.Getenv("NOTIFY_SOCKET"),
-		Net:  "unixgram",
-	}
-	if socketAddr.Name == "" {
-		return false, nil
-	}
-	conn, err := net.DialUnix(socketAddr.Net, nil, socketAddr)
-	if err != nil {
-		return false, err
-	}
-	defer conn.Close()
-	if _, err = conn.Write([]byte(state)); err != nil {
-		return false, err
-	}
-	return true, nil
+	return nil, fmt.Errorf("no GPIO chip found amongst %d devices with name or prefix '%s'", len(paths), prefix)
 }
 
 var usKeyMap = map[evdev.EvCode]struct {
@@ -0,0 +1,223 @@
+package gauthbox
+
+import (
+	"log/slog"
+	"time"
+)
+
+// The lifecycle of the sessions: starts and ends them as requested, follows
+// whether the machine is in use, and accounts for each session in its summary.
+// Owns the state, badgeId, memberName, openAccess, sessionId, sessionStart,
+// inUseSince, activeTime, cycles, sessionOver, currentHigh, spinning and
+// idleOverride fields of the state.
+type Lifecycle struct {
+	config *AuthboxConfig
+	state  *State
+	bus    *Bus
+	// Session persisted before the restart, resumed once started, if any.
+	restored *persistedSession
+}
+
+func NewLifecycle(config *AuthboxConfig, state *State, restored *persistedSession) *Lifecycle {
+	return &Lifecycle{config: config, state: state, restored: restored}
+}
+
+// Subscribes to the session requests and to the inputs telling whether the
+// machine is in use.
+func (l *Lifecycle) Subscribe(bus *Bus) {
+	l.bus = bus
+	Subscribe(bus, func(Started) { l.restore() })
+	Subscribe(bus, l.start)
+	Subscribe(bus, l.onEnd)
+	Subscribe(bus, func(e CurrentSensed) {
+		l.state.currentHigh = e.High
+		l.updateInUse()
+	})
+	Subscribe(bus, l.onTachometer)
+	Subscribe(bus, func(e ButtonPressed) {
+		if e.Pressed && l.config.Mode == MODE_BUTTON && l.state.state != STATE_OFF {
+			// The member is done.
+			l.end()
+		}
+	})
+	Subscribe(bus, func(e CommandReceived) {
+		if e.Command == "end_session" {
+			// Do not stop a machine in use: power off once it stops.
+			l.onEnd(EndSession{Graceful: true})
+		}
+	})
+}
+
+// Resumes the persisted session, if any.
+func (l *Lifecycle) restore() {
+	r := l.restored
+	if r == nil {
+		return
+	}
+	// Resume as idle: current sensing reports whether the machine is still in
+	// use. An in-use session has no idle deadline yet and starts a full idle
+	// timeout, like when the machine stops. The deadlines are recent, see
+	// loadSession.
+	slog.Info("restoring session", BadgeAttr("id", r.BadgeId), slog.Bool("in_use", r.InUse))
+	s := l.state
+	s.state = STATE_IDLE
+	s.badgeId = r.BadgeId
+	s.memberName = r.MemberName
+	s.sessionStart = r.Start
+	s.sessionId = r.SessionId
+	s.idleOverride = time.Duration(r.IdleSeconds) * time.Second
+	Publish(l.bus, SessionRestored{Session: *r})
+}
+
+// Starts or takes over a session, and powers the machine.
+func (l *Lifecycle) start(e StartSession) {
+	s := l.state
+	previous := ""
+	switch {
+	case s.state == STATE_OFF:
+		s.sessionStart = Clk.Now()
+		s.sessionId = NewSessionId()
+	case e.BadgeId != s.badgeId:
+		// Someone else takes over the machine.
+		l.summarize()
+		previous = s.badgeId
+	}
+	s.state = STATE_IDLE
+	s.badgeId = e.BadgeId
+	s.openAccess = e.BadgeId == ""
+	s.memberName = e.MemberName
+	s.idleOverride = e.IdleOverride
+	Publish(l.bus, SessionStarted{BadgeId: e.BadgeId, Previous: previous})
+	Publish(l.bus, UpdatePower{})
+	Publish(l.bus, StateUpdated{})
+	if s.openAccess {
+		// The machine may already be drawing current.
+		l.updateInUse()
+	}
+}
+
+func (l *Lifecycle) onEnd(e EndSession) {
+	s := l.state
+	switch {
+	case s.state == STATE_OFF:
+		return
+	case e.Graceful && s.state == STATE_IN_USE:
+		// Do not stop a machine in use: warn, and power off once it stops.
+		s.sessionOver = true
+		Publish(l.bus, StateUpdated{})
+	default:
+		l.end()
+	}
+	if e.Message != "" {
+		Publish(l.bus, DisplayMessage{Text: e.Message})
+	}
+}
+
+// Turns the power relay off, de-authenticates and returns unused minutes.
+func (l *Lifecycle) end() {
+	s := l.state
+	l.summarize()
+	s.state = STATE_OFF
+	s.sessionOver = false
+	Publish(l.bus, SessionEnded{BadgeId: s.badgeId})
+	s.badgeId = ""
+	s.memberName = ""
+	s.openAccess = false
+	s.sessionId = ""
+	s.idleOverride = 0
+	Publish(l.bus, StateUpdated{})
+}
+
+// Ends the session as the state machine exits, unless it keeps running through
+// the restart. Returns whether the relays are to be left on.
+func (l *Lifecycle) Exit(keepSession bool) bool {
+	s := l.state
+	if (keepSession && s.state != STATE_OFF) || (l.config.KeepOnExitInUse && s.state == STATE_IN_USE) || powerHeld(l.config, s) {
+		// Leave the machine running; a persisted session is resumed on restart.
+		slog.Warn("leaving relays on")
+		return true
+	}
+	if s.state != STATE_OFF {
+		l.summarize()
+		Publish(l.bus, SessionEnded{BadgeId: s.badgeId, Exiting: true})
+	}
+	return false
+}
+
+func (l *Lifecycle) onTachometer(e TachometerRead) {
+	s, r := l.state, e.Reading
+	if r.InUse == s.spinning[r.Id] {
+		return
+	}
+	if r.InUse {
+		s.spinning[r.Id] = true
+	} else {
+		delete(s.spinning, r.Id)
+	}
+	l.updateInUse()
+	// The idle condition may depend on it.
+	Publish(l.bus, StateUpdated{})
+}
+
+// The machine is in use while it draws current or spins.
+func (l *Lifecycle) updateInUse() {
+	if l.config.Mode == MODE_DOOR {
+		// A door is unlocked for a fixed duration.
+		return
+	}
+	s := l.state
+	switch inUse := s.currentHigh || len(s.spinning) > 0; {
+	case inUse:
+		if s.state != STATE_IDLE {
+			// Not supposed to happen, but anyway, bail.
+			return
+		}
+		// The machine is now in use, inhibit the idle timer.
+		s.state = STATE_IN_USE
+		s.inUseSince = Clk.Now()
+		s.cycles++
+		Publish(l.bus, MachineInUse{InUse: true})
+		Publish(l.bus, StateUpdated{})
+	case !inUse:
+		if s.state != STATE_IN_USE {
+			// Not supposed to happen, but anyway, bail.
+			return
+		}
+		// The machine stopped drawing current and spinning. Start the idle timer in preparation of shutting off.
+		s.activeTime += Clk.Now().Sub(s.inUseSince)
+		s.state = STATE_IDLE
+		if s.overheatCutoff() || s.sessionOver || s.lockout != "" {
+			// Too hot to keep going, time's up or out of service: do not wait for the idle timeout.
+			l.end()
+			return
+		}
+		Publish(l.bus, MachineInUse{InUse: false})
+		Publish(l.bus, StateUpdated{})
+	}
+}
+
+// Emits the summary of the running session and resets its accounting.
+func (l *Lifecycle) summarize() {
+	s := l.state
+	end := Clk.Now()
+	active := s.activeTime
+	if s.state == STATE_IN_USE {
+		active += end.Sub(s.inUseSince)
+	}
+	summary := SessionSummary{
+		SessionId:     s.sessionId,
+		OpenAccess:    s.openAccess,
+		Start:         s.sessionStart,
+		End:           end,
+		ActiveSeconds: int(active.Seconds()),
+		IdleSeconds:   int((end.Sub(s.sessionStart) - active).Seconds()),
+		Cycles:        s.cycles,
+	}
+	if s.badgeId != "" {
+		summary.BadgeHash = BadgeHash(s.badgeId)
+	}
+	Publish(l.bus, summary)
+	s.sessionStart, s.inUseSince = end, end
+	s.sessionId = NewSessionId()
+	s.activeTime, s.cycles = 0, 0
+}
@@ -0,0 +1,125 @@
+package gauthbox
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Loopers report in at least that often.
+const LIVENESS_INTERVAL = 5 * time.Second
+
+// A looper that has not reported in for that long is considered wedged.
+const LIVENESS_TIMEOUT = 30 * time.Second
+
+var liveness = struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}{last: map[string]time.Time{}}
+
+// Reports that the looper 'name' is alive. Loopers call this at least every
+// LIVENESS_INTERVAL. Those that only wait for ctx while the hardware layer
+// watches their input (door contact, interlocks, buttons…) are exempt: nothing
+// of theirs can wedge, and the state machine taking their events beats itself.
+func Beat(name string) {
+	liveness.mu.Lock()
+	defer liveness.mu.Unlock()
+	liveness.last[name] = time.Now()
+}
+
+// Returns the sorted names of the loopers that did not report in time, if any.
+func Wedged() []string {
+	liveness.mu.Lock()
+	defer liveness.mu.Unlock()
+	wedged := []string{}
+	for name, last := range liveness.last {
+		if time.Since(last) > LIVENESS_TIMEOUT {
+			wedged = append(wedged, name)
+		}
+	}
+	sort.Strings(wedged)
+	return wedged
+}
+
+type heartbeatConfig struct {
+	Pin        Pin    `json:"pin"`
+	IntervalMs uint32 `json:"interval_ms"`
+}
+
+// External watchdog heartbeat logic. Toggles a GPIO pin every interval, but only
+// while all loopers are alive, so an external watchdog timer can power-cycle the
+// Pi if gauthbox wedges. The looper returns once ctx is done, releasing the pin.
+func Heartbeat(ctx context.Context, c heartbeatConfig) (func(), error) {
+	line, err := Hw.RequestOutput(c.Pin, 0)
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Duration(c.IntervalMs) * time.Millisecond
+	if interval == 0 {
+		interval = time.Second
+	}
+	return func() {
+		defer line.Close()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		value := 0
+		wasWedged := false
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if wedged := Wedged(); len(wedged) > 0 {
+				if !wasWedged {
+					slog.Error("liveness: loopers wedged, stopping heartbeat", slog.Any("loopers", wedged))
+				}
+				wasWedged = true
+				continue
+			}
+			wasWedged = false
+			value = 1 - value
+			line.SetValue(value)
+		}
+	}, nil
+}
+
+// systemd watchdog logic. Sends WATCHDOG=1 at half the watchdog interval, but
+// only while the main loop and all loopers are alive, so systemd restarts
+// gauthbox if it wedges. Returns nil if the watchdog is not enabled, see
+// WatchdogSec= in systemd.service(5). The looper returns once ctx is done.
+func SdWatchdog(ctx context.Context) func() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	return func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		wasWedged := false
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if wedged := Wedged(); len(wedged) > 0 {
+				if !wasWedged {
+					slog.Error("liveness: loopers wedged, stopping systemd watchdog keepalives", slog.Any("loopers", wedged))
+				}
+				wasWedged = true
+				continue
+			}
+			wasWedged = false
+			SdNotifyWatchdog()
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package gauthbox
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// State file holding the lockout reason, absent when not locked out.
+const LOCKOUT_STATE_FILE = "lockout"
+
+// How long the button must be held, with the bypass key on, to toggle the lockout.
+const LOCKOUT_BUTTON_HOLD = 5 * time.Second
+
+// Returns the persisted lockout reason, empty if the tool is in service.
+func LoadLockout() string {
+	b, err := os.ReadFile(StatePath(LOCKOUT_STATE_FILE))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// Persists the lockout reason, or clears the lockout if empty.
+func SaveLockout(reason string) error {
+	if reason == "" {
+		if err := os.Remove(StatePath(LOCKOUT_STATE_FILE)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return writeStateFile(LOCKOUT_STATE_FILE, []byte(reason+"\n"))
+}
+
+// Puts the tool out of service and back, as configured, commanded, or with
+// the key combo. Owns the lockout and buttonPressedAt fields of the state.
+type Lockout struct {
+	config *AuthboxConfig
+	state  *State
+	bus    *Bus
+}
+
+func NewLockout(config *AuthboxConfig, state *State) *Lockout {
+	return &Lockout{config: config, state: state}
+}
+
+// Subscribes to the lockout commands and to the button for the key combo. Must
+// come before the session lifecycle, for a persisted lockout to be set before a
+// session is restored.
+func (l *Lockout) Subscribe(bus *Bus) {
+	l.bus = bus
+	Subscribe(bus, func(Started) {
+		if l.config.Lockout != "" {
+			l.set(l.config.Lockout)
+		} else if reason := LoadLockout(); reason != "" {
+			l.set(reason)
+		}
+	})
+	Subscribe(bus, func(e CommandReceived) {
+		if e.Command != "lockout" {
+			return
+		}
+		switch e.Payload {
+		case "", "OFF":
+			l.set("")
+		case "ON":
+			l.set("out of service")
+		default:
+			l.set(e.Payload)
+		}
+	})
+	Subscribe(bus, l.onButton)
+}
+
+func (l *Lockout) onButton(e ButtonPressed) {
+	s := l.state
+	if e.Pressed {
+		s.buttonPressedAt = Clk.Now()
+		return
+	}
+	if s.bypass && !s.buttonPressedAt.IsZero() && Clk.Now().Sub(s.buttonPressedAt) >= LOCKOUT_BUTTON_HOLD {
+		// Key combo: long press with the maintenance key on toggles the lockout.
+		if s.lockout == "" {
+			l.set("locked out locally")
+		} else {
+			l.set("")
+		}
+	}
+	s.buttonPressedAt = time.Time{}
+}
+
+// Puts the tool out of service with the reason, or back in service if empty.
+// A running session ends once the machine stops.
+func (l *Lockout) set(reason string) {
+	s := l.state
+	if reason == s.lockout {
+		return
+	}
+	if err := SaveLockout(reason); err != nil {
+		slog.Error("could not persist lockout", slog.Any("err", err))
+	}
+	s.lockout = reason
+	if reason == "" {
+		slog.Info("lockout cleared")
+		Publish(l.bus, StateUpdated{})
+		return
+	}
+	slog.Warn("locked out", slog.String("reason", reason))
+	if s.state == STATE_IDLE {
+		Publish(l.bus, EndSession{})
+	}
+	Publish(l.bus, StateUpdated{})
+}
+
+// Publishes whether the tool is out of service.
+func PublishLockout(reason string, name string, publish PublishFunc) {
+	publish(name+"/lockout", map[bool]string{false: "OFF", true: "ON"}[reason != ""])
+}
+
+// MQTT: the lockout, as a switch. Turning it on with a plain "ON" uses a generic
+// reason; any other payload is the reason.
+func LockoutDiscovery() MqttDiscovery {
+	return MqttDiscovery{
+		Component: "switch",
+		Id:        "lockout",
+		Announce: func(name, topic string) interface{} {
+			return struct {
+				Device       MqttDevice `json:"device"`
+				StateTopic   string     `json:"state_topic"`
+				CommandTopic string     `json:"command_topic"`
+			}{
+				Device:       MqttDevice{Name: "Out of service lockout on " + name},
+				StateTopic:   topic + "/" + name + "/lockout",
+				CommandTopic: topic + "/" + name + "/lockout/set",
+			}
+		},
+	}
+}
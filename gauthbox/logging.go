@@ -0,0 +1,180 @@
+package gauthbox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const LOG_FORMAT_TEXT = "text"
+const LOG_FORMAT_JSON = "json"
+
+// Logging, in addition to stderr, e.g. when journald rate limiting loses lines.
+type loggingConfig struct {
+	// One of LOG_FORMAT_*, defaults to text.
+	Format string `json:"format,omitempty"`
+	// Optional file to also log to, e.g. on the SD card.
+	File string `json:"file,omitempty"`
+	// The file is rotated once that large or that old, whichever comes first;
+	// zero for no limit.
+	MaxSizeKB   uint32 `json:"max_size_kb,omitempty"`
+	MaxAgeHours uint32 `json:"max_age_hours,omitempty"`
+	// Rotated files kept as '<file>.1' (most recent) to '<file>.<n>', defaults to 3.
+	MaxFiles int `json:"max_files,omitempty"`
+	// Optional forwarding to a central syslog or Loki server.
+	Ship *logShipConfig `json:"ship,omitempty"`
+	// Optional pseudonymization of badge IDs, also on MQTT and in the history.
+	BadgePseudonyms *badgePseudonymConfig `json:"badge_pseudonyms,omitempty"`
+}
+
+// A log file rotated by size and age. Write errors are reported on stderr and
+// otherwise ignored, so logging to stderr goes on.
+type rotatingFile struct {
+	c      loggingConfig
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(c loggingConfig) (*rotatingFile, error) {
+	if c.MaxFiles == 0 {
+		c.MaxFiles = 3
+	}
+	r := &rotatingFile{c: c}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.c.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.opened = f, info.Size(), Clk.Now()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	for i := r.c.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.c.File, i), fmt.Sprintf("%s.%d", r.c.File, i+1))
+	}
+	if err := os.Rename(r.c.File, r.c.File+".1"); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tooLarge := r.c.MaxSizeKB > 0 && r.size+int64(len(p)) > int64(r.c.MaxSizeKB)*1024
+	tooOld := r.c.MaxAgeHours > 0 && Clk.Now().Sub(r.opened) > time.Duration(r.c.MaxAgeHours)*time.Hour
+	if r.f != nil && r.size > 0 && (tooLarge || tooOld) {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "could not rotate log file: %v\n", err)
+		}
+	}
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return len(p), nil
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not write log file: %v\n", err)
+	}
+	return len(p), nil
+}
+
+// Returns the log handler writing to stderr and the configured file, if any,
+// in the configured format, and shipping to the configured server, if any.
+func NewLogHandler(name string, c loggingConfig, stderr io.Writer) (slog.Handler, error) {
+	w := stderr
+	if c.File != "" {
+		f, err := openRotatingFile(c)
+		if err != nil {
+			return nil, fmt.Errorf("log file: %w", err)
+		}
+		w = io.MultiWriter(stderr, f)
+	}
+	// Levels are filtered by the caller.
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var h slog.Handler
+	switch c.Format {
+	case "", LOG_FORMAT_TEXT:
+		h = slog.NewTextHandler(w, opts)
+	case LOG_FORMAT_JSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format '%s'", c.Format)
+	}
+	if c.Ship != nil {
+		shipper, err := newLogShipper(name, *c.Ship)
+		if err != nil {
+			return nil, fmt.Errorf("log shipping: %w", err)
+		}
+		go shipper.loop()
+		h = fanoutHandler{h, shipHandler{shipper: shipper}}
+	}
+	return h, nil
+}
+
+// Log level set at runtime, e.g. from the debug console, nil to filter as
+// configured.
+var logLevelOverride atomic.Pointer[slog.Level]
+
+// Overrides the log level, or goes back to the configured filtering if nil.
+func SetLogLevel(l *slog.Level) {
+	logLevelOverride.Store(l)
+}
+
+type levelOverrideHandler struct {
+	filtered, unfiltered slog.Handler
+}
+
+// Wraps the handler filtering levels, e.g. per GO_LOG, so the level can be
+// overridden with SetLogLevel. The records are then handled by unfiltered.
+func LevelOverrideHandler(filtered, unfiltered slog.Handler) slog.Handler {
+	return levelOverrideHandler{filtered, unfiltered}
+}
+
+func (h levelOverrideHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	if level := logLevelOverride.Load(); level != nil {
+		return l >= *level
+	}
+	return h.filtered.Enabled(ctx, l)
+}
+
+func (h levelOverrideHandler) Handle(ctx context.Context, r slog.Record) error {
+	if level := logLevelOverride.Load(); level != nil {
+		if r.Level < *level {
+			return nil
+		}
+		return h.unfiltered.Handle(ctx, r)
+	}
+	return h.filtered.Handle(ctx, r)
+}
+
+func (h levelOverrideHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelOverrideHandler{h.filtered.WithAttrs(attrs), h.unfiltered.WithAttrs(attrs)}
+}
+
+func (h levelOverrideHandler) WithGroup(name string) slog.Handler {
+	return levelOverrideHandler{h.filtered.WithGroup(name), h.unfiltered.WithGroup(name)}
+}
@@ -0,0 +1,102 @@
+package gauthbox
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a log line n bytes long.
+func line(n int) string {
+	return strings.Repeat("x", n-1) + "\n"
+}
+
+func TestRotatingFile(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		write   string
+	}
+	tests := []struct {
+		name string
+		c    loggingConfig
+		// Contents of the file before opening it, if any.
+		existing string
+		steps    []step
+		// Contents of the file, then of '<file>.1', '<file>.2'…
+		want []string
+	}{{
+		name:  "no limit",
+		steps: []step{{write: "a\n"}, {advance: 1000 * time.Hour, write: "b\n"}},
+		want:  []string{"a\nb\n"},
+	}, {
+		name:  "by size",
+		c:     loggingConfig{MaxSizeKB: 1},
+		steps: []step{{write: line(1000)}, {write: "a\n"}, {write: "b\n"}, {write: line(1020)}, {write: line(4)}},
+		want:  []string{line(1020) + line(4), line(1000) + "a\nb\n"},
+	}, {
+		name:  "up to the limit",
+		c:     loggingConfig{MaxSizeKB: 1},
+		steps: []step{{write: line(1000)}, {write: line(24)}, {write: "a\n"}},
+		want:  []string{"a\n", line(1000) + line(24)},
+	}, {
+		name:  "larger than the limit",
+		c:     loggingConfig{MaxSizeKB: 1},
+		steps: []step{{write: line(2000)}, {write: "a\n"}},
+		want:  []string{"a\n", line(2000)},
+	}, {
+		name:     "existing file",
+		c:        loggingConfig{MaxSizeKB: 1},
+		existing: line(1023),
+		steps:    []step{{write: "a\n"}, {write: "b\n"}},
+		want:     []string{"a\nb\n", line(1023)},
+	}, {
+		name:  "by age",
+		c:     loggingConfig{MaxAgeHours: 24},
+		steps: []step{{write: "a\n"}, {advance: 24 * time.Hour, write: "b\n"}, {advance: time.Second, write: "c\n"}, {advance: 24 * time.Hour, write: "d\n"}},
+		want:  []string{"c\nd\n", "a\nb\n"},
+	}, {
+		name:  "keeps max files",
+		c:     loggingConfig{MaxAgeHours: 1, MaxFiles: 2},
+		steps: []step{{write: "a\n"}, {advance: 2 * time.Hour, write: "b\n"}, {advance: 2 * time.Hour, write: "c\n"}, {advance: 2 * time.Hour, write: "d\n"}},
+		want:  []string{"d\n", "c\n", "b\n"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.c.File = filepath.Join(dir, "gauthbox.log")
+			if tt.existing != "" {
+				if err := os.WriteFile(tt.c.File, []byte(tt.existing), 0o640); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f, err := openRotatingFile(tt.c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.f.Close()
+			for _, s := range tt.steps {
+				testClock.Advance(s.advance)
+				if n, err := f.Write([]byte(s.write)); n != len(s.write) || err != nil {
+					t.Fatalf("wrote %d, %v", n, err)
+				}
+			}
+			got := []string{}
+			for _, path := range []string{"", ".1", ".2", ".3", ".4"} {
+				b, err := os.ReadFile(tt.c.File + path)
+				if os.IsNotExist(err) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, string(b))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got files %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
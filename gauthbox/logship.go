@@ -0,0 +1,267 @@
+package gauthbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many records are kept until shipped; older ones are dropped, e.g. during
+// long outages of the log server.
+const LOG_SHIP_QUEUE_SIZE = 2000
+const LOG_SHIP_INTERVAL = 5 * time.Second
+
+// Forwarding of the logs to a central server, with the device name attached.
+type logShipConfig struct {
+	// "udp://host:514" or "tcp://host:514" for RFC 5424 syslog, or a Loki base
+	// URL, e.g. "http://loki:3100".
+	Url string `json:"url"`
+}
+
+type shippedRecord struct {
+	time  time.Time
+	level slog.Level
+	line  string
+}
+
+// Batches records and ships them every LOG_SHIP_INTERVAL. Records that could
+// not be shipped are retried with the next batch.
+type logShipper struct {
+	c     logShipConfig
+	url   *url.URL
+	name  string
+	mu    sync.Mutex
+	queue []shippedRecord
+	// Whether the last batch failed, to only report outages once.
+	failing bool
+}
+
+func newLogShipper(name string, c logShipConfig) (*logShipper, error) {
+	u, err := url.Parse(c.Url)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "udp", "tcp", "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported log shipping URL scheme '%s'", u.Scheme)
+	}
+	return &logShipper{c: c, url: u, name: name}, nil
+}
+
+func (s *logShipper) add(r shippedRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = append(s.queue, r)
+	if len(s.queue) > LOG_SHIP_QUEUE_SIZE {
+		s.queue = s.queue[len(s.queue)-LOG_SHIP_QUEUE_SIZE:]
+	}
+}
+
+// Ships the queued records. Errors are reported on stderr, not logged, as
+// they would be shipped in turn.
+func (s *logShipper) loop() {
+	for {
+		time.Sleep(LOG_SHIP_INTERVAL)
+		s.mu.Lock()
+		batch := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+		if len(batch) == 0 {
+			continue
+		}
+		var err error
+		if s.url.Scheme == "http" || s.url.Scheme == "https" {
+			err = s.shipLoki(batch)
+		} else {
+			err = s.shipSyslog(batch)
+		}
+		if err != nil {
+			if !s.failing {
+				fmt.Fprintf(os.Stderr, "could not ship logs, retrying: %v\n", err)
+			}
+			s.failing = true
+			s.mu.Lock()
+			s.queue = append(batch, s.queue...)
+			if len(s.queue) > LOG_SHIP_QUEUE_SIZE {
+				s.queue = s.queue[len(s.queue)-LOG_SHIP_QUEUE_SIZE:]
+			}
+			s.mu.Unlock()
+			continue
+		}
+		if s.failing {
+			fmt.Fprintf(os.Stderr, "shipping logs again\n")
+		}
+		s.failing = false
+	}
+}
+
+// RFC 5424 severity of the level.
+func syslogSeverity(l slog.Level) int {
+	switch {
+	case l >= slog.LevelError:
+		return 3
+	case l >= slog.LevelWarn:
+		return 4
+	case l >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+func (s *logShipper) shipSyslog(batch []shippedRecord) error {
+	conn, err := net.DialTimeout(s.url.Scheme, s.url.Host, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	for _, r := range batch {
+		// Facility 3 is "system daemons".
+		msg := fmt.Sprintf("<%d>1 %s %s gauthbox %d - - %s",
+			3*8+syslogSeverity(r.level), r.time.Format(time.RFC3339Nano), s.name, os.Getpid(), r.line)
+		if s.url.Scheme == "tcp" {
+			// Octet counting framing, RFC 6587.
+			msg = strconv.Itoa(len(msg)) + " " + msg
+		}
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *logShipper) shipLoki(batch []shippedRecord) error {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	streams := map[string]*stream{}
+	for _, r := range batch {
+		level := strings.ToLower(r.level.String())
+		if streams[level] == nil {
+			streams[level] = &stream{Stream: map[string]string{"job": "gauthbox", "host": s.name, "level": level}}
+		}
+		streams[level].Values = append(streams[level].Values, [2]string{strconv.FormatInt(r.time.UnixNano(), 10), r.line})
+	}
+	push := struct {
+		Streams []*stream `json:"streams"`
+	}{}
+	for _, st := range streams {
+		push.Streams = append(push.Streams, st)
+	}
+	b, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(s.c.Url, "/")+"/loki/api/v1/push", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("loki: %s", resp.Status)
+	}
+	return nil
+}
+
+// Formats records as text lines, without the time which both syslog and Loki
+// carry separately, and queues them for shipping.
+type shipHandler struct {
+	shipper *logShipper
+	// Replayed on a fresh formatter for each record.
+	with []func(slog.Handler) slog.Handler
+}
+
+func (h shipHandler) Enabled(context.Context, slog.Level) bool {
+	// Levels are filtered by the caller.
+	return true
+}
+
+func (h shipHandler) Handle(ctx context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	var f slog.Handler = slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	for _, w := range h.with {
+		f = w(f)
+	}
+	if err := f.Handle(ctx, r); err != nil {
+		return err
+	}
+	h.shipper.add(shippedRecord{time: r.Time, level: r.Level, line: strings.TrimSuffix(buf.String(), "\n")})
+	return nil
+}
+
+func (h shipHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h.with = append(h.with[:len(h.with):len(h.with)], func(f slog.Handler) slog.Handler { return f.WithAttrs(attrs) })
+	return h
+}
+
+func (h shipHandler) WithGroup(name string) slog.Handler {
+	h.with = append(h.with[:len(h.with):len(h.with)], func(f slog.Handler) slog.Handler { return f.WithGroup(name) })
+	return h
+}
+
+// Sends records to all handlers.
+type fanoutHandler []slog.Handler
+
+func (h fanoutHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range h {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var first error
+	for _, h := range h {
+		if h.Enabled(ctx, r.Level) {
+			if err := h.Handle(ctx, r.Clone()); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+func (h fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := fanoutHandler{}
+	for _, h := range h {
+		out = append(out, h.WithAttrs(attrs))
+	}
+	return out
+}
+
+func (h fanoutHandler) WithGroup(name string) slog.Handler {
+	out := fanoutHandler{}
+	for _, h := range h {
+		out = append(out, h.WithGroup(name))
+	}
+	return out
+}
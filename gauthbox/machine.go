@@ -0,0 +1,824 @@
+package gauthbox
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Badge to power the machine, which stays on while it is in use and for the
+// idle duration after.
+const MODE_BUTTONLESS = "buttonless"
+
+// Like buttonless, but the session can also be ended with a button.
+const MODE_BUTTON = "button"
+
+// Badge to unlock a door (strike or magnetic lock) for the unlock duration.
+const MODE_DOOR = "door"
+
+// The machine is always powered; badging only attributes its usage to a member.
+// Safety features (door, interlocks, temperature) still end the session.
+const MODE_ALWAYS_ON_METERED = "always-on-metered"
+
+const DEFAULT_UNLOCK_DURATION = 5 * time.Second
+
+// Member name of the sessions during free access windows.
+const OPEN_ACCESS_MEMBER = "Open access"
+
+// How long powering off may be deferred by current flowing before raising an alarm.
+const CUT_DEFERRED_ALARM_DELAY = time.Minute
+
+const (
+	STATE_OFF    = iota
+	STATE_IDLE   = iota
+	STATE_IN_USE = iota
+)
+
+// The state machine state. Each field is written by the one handler owning
+// it, see the handlers subscribed in RunStateMachine; the others only read it.
+type State struct {
+	// One of MODE_*.
+	mode       string
+	state      int
+	badgeId    string
+	memberName string
+	// Zero when the idle timer is not running.
+	idleDeadline time.Time
+	// Length of the idle timeout ending at idleDeadline.
+	idleTimeout time.Duration
+
+	relay         bool
+	mqttConnected bool
+	doorClosed    bool
+	// Sensor ID → its last reading, while over its temperature threshold.
+	overheated map[string]TemperatureReading
+	// Roles of the relays whose feedback disagrees with the commanded state.
+	wiringFaults map[string]bool
+	// IDs of the interlocks that are not satisfied.
+	interlocksOpen map[string]bool
+	// When the relays were last switched on, for interlock grace periods.
+	relayOnSince time.Time
+	// The maintenance bypass key forces the relay on.
+	bypass bool
+	// When the next extend call and the maximum session duration are due, zero if not running.
+	extendDeadline  time.Time
+	sessionDeadline time.Time
+	// Session without a badge, during a free access window.
+	openAccess bool
+	// One of CURFEW_*, and whether new sessions are refused.
+	curfew       string
+	curfewClosed bool
+	// Why the clock is not trusted, empty if it is.
+	clockProblem string
+	// Switching the relay off waits for the machine to stop drawing current.
+	cutDeferred bool
+	// Two-stage power: whether the run relay is on, the gate input, and
+	// whether the start button was pressed since the standby circuit went on.
+	running    bool
+	runGate    bool
+	runLatched bool
+	// Idle timer held as the idle condition does not hold.
+	idleHeld bool
+	// Idle for long enough that the relay is off until someone badges again.
+	dormant bool
+	// Idle timeout of the running session if set by the backend or MQTT, zero for the default.
+	idleOverride time.Duration
+	// Badges active on the other boxes, for anti-passback.
+	peerBadges PeerBadges
+	// Random, to correlate the state transitions and summary of a session.
+	sessionId string
+	// Accounting of the running session, for its summary.
+	sessionStart time.Time
+	inUseSince   time.Time
+	activeTime   time.Duration
+	cycles       int
+	// In the last seconds of the idle timeout, about to power off.
+	warning bool
+	// Badge taking over the session once the machine stops, if any.
+	pendingBadgeId string
+	// Non-empty while out of service, with the reason.
+	lockout string
+	// When the button was pressed, zero if released.
+	buttonPressedAt time.Time
+	// The maximum session duration is reached; the session ends when the machine stops.
+	sessionOver bool
+	// Auxiliary relays are kept on until then after a session ended.
+	cooldownUntil time.Time
+	// Whether the machine draws current, and the IDs of the tachometers above their in use rate.
+	currentHigh bool
+	spinning    map[string]bool
+}
+
+// Whether any temperature sensor requires powering off.
+func (s State) overheatCutoff() bool {
+	for _, r := range s.overheated {
+		if r.Cutoff {
+			return true
+		}
+	}
+	return false
+}
+
+// Relays the termination signals to c until the returned function is called.
+// Replaced in tests, which stop the state machine through its context instead.
+var NotifySignals = func(c chan<- os.Signal) func() {
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	return func() { signal.Stop(c) }
+}
+
+// Runs the authbox state machine in the configured mode. Returns an error on
+// initialization failure, ErrReload or ErrRestart when asked to over MQTT or
+// HTTP, or nil once terminated by SIGTERM, SIGINT or ctx being done.
+func RunStateMachine(ctx context.Context, name string, config *AuthboxConfig) error {
+	defer reportPanic("main")
+	var err error
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	if config.Logging != nil {
+		if err := SetBadgePseudonyms(config.Logging.BadgePseudonyms); err != nil {
+			return fmt.Errorf("badge pseudonyms: %w", err)
+		}
+	}
+
+	mqttDisco := []MqttDiscovery{}
+
+	// The devices that hold hardware or connections live until shutdown, which
+	// waits for them to release it. Not derived from ctx: relays must get their
+	// exit action before their lines are closed.
+	devices, stopDevices := context.WithCancel(context.Background())
+	defer stopDevices()
+	var loopers sync.WaitGroup
+	run := func(name string, looper func()) {
+		loopers.Add(1)
+		go func() {
+			defer loopers.Done()
+			Guard(name, looper)()
+		}()
+	}
+
+	if err := SetupExpanders(config.Expanders); err != nil {
+		return fmt.Errorf("expanders init: %w", err)
+	}
+
+	badgeDev, err := BadgeReader(devices, config.BadgeReader)
+	if err != nil {
+		return fmt.Errorf("badge init: %w", err)
+	}
+	mqttDisco = append(mqttDisco, badgeDev.Discovery)
+	run("badge_reader", badgeDev.Looper)
+
+	currentSenseDev, err := CurrentSensing(devices, config.CurrentSensing)
+	if err != nil {
+		return fmt.Errorf("current sensing init: %w", err)
+	}
+	mqttDisco = append(mqttDisco, currentSenseDev.Discovery)
+	run("current_sensing", currentSenseDev.Looper)
+
+	var doorDev *DeviceRet[bool]
+	if config.DoorContact != nil {
+		doorDev, err = DoorContact(devices, *config.DoorContact)
+		if err != nil {
+			return fmt.Errorf("door contact init: %w", err)
+		}
+		mqttDisco = append(mqttDisco, doorDev.Discovery)
+		run("door_contact", doorDev.Looper)
+	} else {
+		// Never yields, and the door is considered always closed.
+		doorDev = &DeviceRet[bool]{}
+	}
+
+	var buttonDev *DeviceRet[bool]
+	if config.Button != nil {
+		buttonDev, err = Button(devices, *config.Button)
+		if err != nil {
+			return fmt.Errorf("button init: %w", err)
+		}
+		mqttDisco = append(mqttDisco, buttonDev.Discovery)
+		run("button", buttonDev.Looper)
+	} else {
+		// Never yields.
+		buttonDev = &DeviceRet[bool]{}
+	}
+
+	var bypassDev *DeviceRet[bool]
+	if config.Bypass != nil {
+		bypassDev, err = Bypass(devices, *config.Bypass)
+		if err != nil {
+			return fmt.Errorf("bypass init: %w", err)
+		}
+		mqttDisco = append(mqttDisco, bypassDev.Discovery)
+		run("bypass", bypassDev.Looper)
+	} else {
+		// Never yields.
+		bypassDev = &DeviceRet[bool]{}
+	}
+
+	// By sensor ID.
+	temperatureDevs := map[string]*DeviceRet[TemperatureReading]{}
+	for _, c := range config.Temperatures {
+		dev, err := TemperatureSensor(devices, c)
+		if err != nil {
+			return fmt.Errorf("temperature sensor %s init: %w", c.Id, err)
+		}
+		mqttDisco = append(mqttDisco, dev.Discovery)
+		run("temperature_"+c.Id, dev.Looper)
+		temperatureDevs[c.Id] = dev
+	}
+	temperatures := fanIn(devices, temperatureDevs)
+
+	interlockDevs := map[string]*DeviceRet[InterlockState]{}
+	for _, c := range config.Interlocks {
+		dev, err := Interlock(devices, c)
+		if err != nil {
+			return fmt.Errorf("interlock %s init: %w", c.Id, err)
+		}
+		mqttDisco = append(mqttDisco, dev.Discovery)
+		run("interlock_"+c.Id, dev.Looper)
+		interlockDevs[c.Id] = dev
+	}
+	interlocks := fanIn(devices, interlockDevs)
+	mqttDisco = append(mqttDisco, TripDiscovery(), LockoutDiscovery(), ClockDiscovery(), AuthOutcomeDiscovery(), AuthLatencyDiscovery())
+	mqttDisco = append(mqttDisco, LifetimeDiscovery()...)
+	if config.Curfew != nil {
+		mqttDisco = append(mqttDisco, CurfewDiscovery())
+	}
+
+	tachometerDevs := map[string]*DeviceRet[TachometerReading]{}
+	for _, c := range config.Tachometers {
+		dev, err := Tachometer(devices, c)
+		if err != nil {
+			return fmt.Errorf("tachometer %s init: %w", c.Id, err)
+		}
+		mqttDisco = append(mqttDisco, dev.Discovery, TachometerCountDiscovery(c))
+		run("tachometer_"+c.Id, dev.Looper)
+		tachometerDevs[c.Id] = dev
+	}
+	tachometers := fanIn(devices, tachometerDevs)
+
+	// Keep the machine powered through the restart if a session was running, but
+	// not after a reboot or a long downtime.
+	restored, stale := loadSession(Clk.Now())
+	relayConfigs := config.Relays()
+	if restored != nil || stale {
+		for i := range relayConfigs {
+			relayConfigs[i].InitialOn, relayConfigs[i].RestoreState = restored != nil, false
+		}
+	}
+	relays, err := NewRelayBank(devices, relayConfigs, config.PowerUpSequence)
+	if err != nil {
+		return fmt.Errorf("relay init: %w", err)
+	}
+	mqttDisco = append(mqttDisco, relays.Discoveries()...)
+	relays.Start(run)
+
+	runRelay := &DeviceRet[bool]{}
+	runIsOn := make(chan bool)
+	runDev := &DeviceRet[RunInput]{}
+	runInitial := false
+	if config.Run != nil {
+		c := config.Run.RelayConfig()
+		if restored != nil || stale {
+			c.InitialOn, c.RestoreState = restored != nil, false
+		}
+		runInitial = relayInitialState(c)
+		if runRelay, err = Relay(devices, c, runIsOn); err != nil {
+			return fmt.Errorf("run relay init: %w", err)
+		}
+		mqttDisco = append(mqttDisco, runRelay.Discovery)
+		run("run_relay", runRelay.Looper)
+		if runDev, err = RunGate(devices, *config.Run); err != nil {
+			return fmt.Errorf("run gate init: %w", err)
+		}
+		mqttDisco = append(mqttDisco, runDev.Discovery)
+		run("run_gate", runDev.Looper)
+	}
+
+	// Shared auxiliary equipment driven by this box, if any.
+	auxRelay := &DeviceRet[bool]{}
+	auxIsOn := make(chan bool)
+	auxOn := false
+	if config.AuxGroup != nil && config.AuxGroup.Relay != nil {
+		c := config.AuxGroup.RelayConfig()
+		if auxRelay, err = Relay(devices, c, auxIsOn); err != nil {
+			return fmt.Errorf("shared relay init: %w", err)
+		}
+		auxOn = relayInitialState(c)
+		mqttDisco = append(mqttDisco, auxRelay.Discovery)
+		run("aux_relay", auxRelay.Looper)
+	}
+
+	green := NewLedModes()
+	greenLed, err := Blinker(devices, config.GreenLed, "ACT", green)
+	if err != nil {
+		return fmt.Errorf("green led init: %w", err)
+	}
+	run("green_led", greenLed)
+
+	red := NewLedModes()
+	redLed, err := Blinker(devices, config.RedLed, "PWR", red)
+	if err != nil {
+		return fmt.Errorf("red led init: %w", err)
+	}
+	run("red_led", redLed)
+
+	var buzzer *LedModes
+	if config.Buzzer != nil {
+		buzzer = NewLedModes()
+		buzzerLooper, err := Blinker(devices, *config.Buzzer, "", buzzer)
+		if err != nil {
+			return fmt.Errorf("buzzer init: %w", err)
+		}
+		run("buzzer", buzzerLooper)
+	}
+	leds := NewLedFeedback(config, green, red, buzzer)
+
+	displays := []chan DisplayStatus{}
+	if config.Display != nil {
+		display := NewDisplayChannel()
+		displayLooper, err := Display(devices, *config.Display, display)
+		if err != nil {
+			return fmt.Errorf("display init: %w", err)
+		}
+		displays = append(displays, display)
+		run("display", displayLooper)
+	}
+	if config.Eink != nil {
+		eink := NewDisplayChannel()
+		einkLooper, err := EinkDisplay(devices, *config.Eink, name, eink)
+		if err != nil {
+			return fmt.Errorf("eink init: %w", err)
+		}
+		displays = append(displays, eink)
+		run("eink", einkLooper)
+	}
+
+	if config.Heartbeat != nil {
+		heartbeatLooper, err := Heartbeat(devices, *config.Heartbeat)
+		if err != nil {
+			return fmt.Errorf("heartbeat init: %w", err)
+		}
+		run("heartbeat", heartbeatLooper)
+	}
+	if watchdogLooper := SdWatchdog(devices); watchdogLooper != nil {
+		run("watchdog", watchdogLooper)
+	}
+
+	connectivityDev := &DeviceRet[Reachability]{}
+	if config.Connectivity != nil {
+		targets := map[string]string{}
+		if config.ccUrl != "" {
+			targets[CONNECTIVITY_COMMAND_CONTROL] = config.ccUrl
+		}
+		if base, err := authBackendUrl(config.BadgeAuth); err != nil {
+			slog.Warn("connectivity: not probing the auth backend", slog.Any("err", err))
+		} else {
+			targets[CONNECTIVITY_AUTH_BACKEND] = base
+		}
+		for target := range targets {
+			mqttDisco = append(mqttDisco, ConnectivityDiscovery(target))
+		}
+		connectivityDev = ConnectivityMonitor(devices, *config.Connectivity, targets)
+		run("connectivity", connectivityDev.Looper)
+	}
+
+	var publish PublishFunc = func(string, interface{}) {}
+	var mqttEvents <-chan MqttEvent
+	if config.MqttBroker != nil {
+		var mqttLooper func()
+		mqttLooper, mqttEvents, publish = MqttBroker(devices, name, *config.MqttBroker, mqttDisco)
+		run("mqtt", mqttLooper)
+	}
+
+	reportEvent := func(StateEvent) {}
+	if config.EventsUrl != "" {
+		var eventsLooper func()
+		eventsLooper, reportEvent = StateEvents(config.EventsUrl)
+		go Guard("events", eventsLooper)()
+	}
+
+	reportCheckIn := func(string) {}
+	if config.CheckInSeconds > 0 && config.ccUrl != "" {
+		var checkInLooper func()
+		checkInLooper, reportCheckIn = CheckIns(config.ccUrl+"/checkin/"+name, time.Duration(config.CheckInSeconds)*time.Second, config.version)
+		go Guard("check_in", checkInLooper)()
+	}
+
+	checkAlerts, raiseAlert := func(Health) {}, func(string, string) {}
+	if config.Alerts != nil {
+		var alertsLooper func()
+		alertsLooper, checkAlerts, raiseAlert = AlertWebhooks(*config.Alerts, name)
+		go Guard("alerts", alertsLooper)()
+	}
+
+	if config.ccUrl != "" {
+		go UploadCrashReports(config.ccUrl + "/crash/" + name)
+	}
+
+	metricsDev := &DeviceRet[struct{}]{}
+	if config.Metrics != nil {
+		var err error
+		if metricsDev, err = MetricsServer(*config.Metrics); err != nil {
+			return fmt.Errorf("metrics init: %w", err)
+		}
+		go Guard("metrics", metricsDev.Looper)()
+	}
+
+	if config.Tracing != nil {
+		run("tracing", Tracing(devices, name, *config.Tracing))
+	} else {
+		DisableTracing()
+	}
+
+	configPoll := &DeviceRet[string]{}
+	if config.ConfigPollMinutes > 0 && config.ccUrl != "" {
+		configPoll = ConfigPoller(name, config)
+		go Guard("config_poll", configPoll.Looper)()
+	}
+
+	httpDev := &DeviceRet[MqttEvent]{}
+	reportHttp := func(HttpStatus) {}
+	if config.Http != nil {
+		var err error
+		httpDev, reportHttp, err = HttpServer(*config.Http)
+		if err != nil {
+			return fmt.Errorf("http init: %w", err)
+		}
+		go Guard("http", httpDev.Looper)()
+	}
+
+	consoleDev := &DeviceRet[ConsoleCommand]{}
+	reportConsole := func(HttpStatus) {}
+	if config.Console != nil {
+		var err error
+		consoleDev, reportConsole, err = DebugConsole(*config.Console)
+		if err != nil {
+			return fmt.Errorf("console init: %w", err)
+		}
+		go Guard("console", consoleDev.Looper)()
+	}
+
+	state := State{mode: config.Mode, state: STATE_OFF, badgeId: "", relay: relays.InitialState(), mqttConnected: false, doorClosed: true, overheated: map[string]TemperatureReading{}, wiringFaults: map[string]bool{}, interlocksOpen: map[string]bool{}, spinning: map[string]bool{}, peerBadges: PeerBadges{}, curfew: CURFEW_OFF, running: runInitial, runLatched: runInitial}
+
+	// Idle time only accrues while the condition holds, if any.
+	idleCondition, err := compileIdleCondition(config, &state)
+	if err != nil {
+		return fmt.Errorf("idle condition: %w", err)
+	}
+
+	// The decisions, each following the events with the fields of the state it
+	// owns. Subscribed in the order they react to an event.
+	bus := NewBus()
+	NewIdleTimer(config, &state, idleCondition).Subscribe(bus)
+	NewSessionAuth(config, name, publish, &state).Subscribe(bus)
+	NewLockout(config, &state).Subscribe(bus)
+	lifecycle := NewLifecycle(config, &state, restored)
+	lifecycle.Subscribe(bus)
+	NewClockCheck(config, &state).Subscribe(bus)
+	NewPower(config, name, publish, &state, relays, runRelay, runIsOn).Subscribe(bus)
+	if config.Curfew != nil {
+		NewCurfew(config, &state).Subscribe(bus)
+	}
+	if len(config.FreeAccess) > 0 {
+		NewFreeAccess(config, &state).Subscribe(bus)
+	}
+	if config.DoorContact != nil {
+		NewDoor(config, &state).Subscribe(bus)
+	}
+	NewInterlocks(config, &state).Subscribe(bus)
+	NewTemperatures(&state).Subscribe(bus)
+	NewMaintenanceBypass(config.Bypass, bypassDev, name, publish, &state).Subscribe(bus)
+	if config.AuxGroup != nil && config.AuxGroup.Relay != nil {
+		NewAuxGroup(*config.AuxGroup, name, publish, auxRelay, auxIsOn, auxOn).Subscribe(bus)
+	}
+	store := NewSessionStore(&state)
+	store.Subscribe(bus)
+	// Published once the idle timer followed the update.
+	Subscribe(bus, func(StateUpdated) { Publish(bus, StateChanged{State: state}) })
+	Subscribe(bus, func(e MqttConnection) {
+		state.mqttConnected = e.Connected
+		Publish(bus, StateUpdated{})
+	})
+
+	// The outputs.
+	SubscribeMqtt(bus, config, name, publish)
+	leds.Subscribe(bus)
+	SubscribeDisplays(bus, config, displays)
+	Subscribe(bus, func(e StateChanged) {
+		status := e.State.HttpStatus()
+		status.Health = e.State.Health(config.MqttBroker != nil)
+		reportHttp(status)
+		reportConsole(status)
+	})
+	Subscribe(bus, func(e StateChanged) { reportEvent(e.State.StateEvent()) })
+	Subscribe(bus, func(e StateChanged) { checkAlerts(e.State.Health(config.MqttBroker != nil).Refresh()) })
+	Subscribe(bus, func(e AlertRaised) { raiseAlert(e.Condition, e.Detail) })
+	Subscribe(bus, func(e Tripped) {
+		if e.Cause == TRIP_INTERLOCK {
+			raiseAlert(ALERT_INTERLOCK_TRIPPED, e.Reason)
+		}
+	})
+	Subscribe(bus, func(e StateChanged) { reportCheckIn(e.State.ShortString()) })
+	Subscribe(bus, func(e StateChanged) { metricsState(e.State) })
+	lastRecorded := ""
+	Subscribe(bus, func(e StateChanged) {
+		if state := e.State.ShortString(); state != lastRecorded {
+			lastRecorded = state
+			Record(HISTORY_STATE, state)
+		}
+	})
+	Subscribe(bus, func(e BadgeDenied) { Record(HISTORY_DENIED, e.Reason) })
+	Subscribe(bus, func(e StateChanged) {
+		stateStr := e.State.String()
+		slog.Debug("state changed", slog.String("state", stateStr))
+		go SdNotifyStatus(stateStr)
+	})
+	Subscribe(bus, SessionSummaryHandler(name, config.SessionWebhook, publish))
+	lifetime := NewLifetimeCounters()
+	lifetime.Subscribe(bus, name, publish)
+	if config.UsageStats {
+		usageUrl := ""
+		if config.ccUrl != "" {
+			usageUrl = config.ccUrl + "/usage/" + name
+		}
+		NewUsageStats().Subscribe(bus, name, usageUrl, publish)
+	}
+
+	// Remote reload or restart, handled like a signal.
+	restart := make(chan string, 1)
+	Subscribe(bus, func(e CommandReceived) {
+		switch e.Command {
+		case "end_session", "idle_timeout", "lockout":
+			// Handled by the session lifecycle, the idle timer and the lockout.
+		case HISTORY_TOPIC:
+			// Request/response: the history since the payload time is published.
+			since, err := parseHistorySince(e.Payload)
+			if err != nil {
+				slog.Warn("ignoring history request", slog.String("payload", e.Payload), slog.Any("err", err))
+				return
+			}
+			go PublishHistory(since, name, publish)
+		case "reload", "restart":
+			// A running session resumes once restarted.
+			select {
+			case restart <- e.Command:
+			default:
+				// Already exiting.
+			}
+		case "reboot":
+			slog.Warn("rebooting")
+			go func() {
+				if err := Reboot(); err != nil {
+					slog.Error("could not reboot", slog.Any("err", err))
+				}
+			}()
+		default:
+			slog.Warn("unknown command", slog.String("command", e.Command))
+		}
+	})
+
+	signals := make(chan os.Signal, 1)
+	stopSignals := NotifySignals(signals)
+	defer stopSignals()
+
+	Publish(bus, Started{})
+	SdNotifyReady()
+	Publish(bus, StateUpdated{})
+
+	// Releases the hardware before exiting. Unless keeping the running session
+	// through a restart, it ends and the relays go to their exit state.
+	shutdown := func(keepSession bool) {
+		if lifecycle.Exit(keepSession) {
+			store.Save(true)
+		} else {
+			// Put the relays in their configured exit state.
+			relays.Shutdown()
+			if runRelay.Shutdown != nil {
+				runRelay.Shutdown()
+			}
+			if auxRelay.Shutdown != nil {
+				auxRelay.Shutdown()
+			}
+		}
+		if httpDev.Shutdown != nil {
+			httpDev.Shutdown()
+		}
+		if metricsDev.Shutdown != nil {
+			metricsDev.Shutdown()
+		}
+		if consoleDev.Shutdown != nil {
+			consoleDev.Shutdown()
+		}
+		// Counts the relay-on time so far, whether or not the relays stay on.
+		lifetime.Relay(false, Clk.Now())
+		// Disconnects from MQTT and closes the lines and the badge reader.
+		stopDevices()
+		loopers.Wait()
+		CloseGpio()
+	}
+
+	alive := time.NewTicker(LIVENESS_INTERVAL)
+	defer alive.Stop()
+	Beat("main")
+	events := eventTracker{}
+
+	// Publishes the inputs of the devices; the timers of the decisions run here too.
+	for {
+		select {
+		case <-alive.C:
+			Beat("main")
+		case sig := <-signals:
+			slog.Info("exiting", slog.String("signal", sig.String()))
+			SdNotifyStopping()
+			shutdown(false)
+			return nil
+		case <-ctx.Done():
+			slog.Info("exiting", slog.Any("reason", ctx.Err()))
+			SdNotifyStopping()
+			shutdown(false)
+			return nil
+		case command := <-restart:
+			slog.Info("exiting", slog.String("command", command))
+			if command == "reload" {
+				SdNotifyReloading()
+				shutdown(true)
+				return ErrReload
+			}
+			SdNotifyStopping()
+			shutdown(true)
+			return ErrRestart
+		case <-bus.TimersDue():
+			bus.RunTimers()
+		case ev := <-httpDev.Events:
+			e := received(events, "http", ev)
+			Publish(bus, CommandReceived{Command: e.Command, Payload: e.Payload})
+		case ev := <-connectivityDev.Events:
+			// A probed target became reachable or unreachable.
+			r := received(events, "connectivity", ev)
+			go connectivityDev.OnEvent(r, name, publish)
+		case ev := <-configPoll.Events:
+			version := received(events, "config_poll", ev)
+			// Apply the new config, keeping the running session.
+			slog.Info("config changed", slog.String("version", version))
+			Publish(bus, CommandReceived{Command: "reload"})
+		case e := <-mqttEvents:
+			switch {
+			case e.Peer != "":
+				Publish(bus, PeerUpdated{Event: e})
+			case e.Command != "":
+				Publish(bus, CommandReceived{Command: e.Command, Payload: e.Payload})
+			default:
+				// Not being able to communicate with MQTT is non-fatal.
+				metricsMqttConnected(e.DisconnectedError == nil)
+				Publish(bus, MqttConnection{Connected: e.DisconnectedError == nil})
+			}
+		case ev := <-badgeDev.Events:
+			badgeId := received(events, "badge_reader", ev)
+			go badgeDev.OnEvent(badgeId, name, publish)
+			metricsBadgeScan()
+			Record(HISTORY_SCAN, BadgeHash(badgeId))
+			Publish(bus, BadgeScanned{BadgeId: badgeId, Time: ev.Time})
+		case ev := <-currentSenseDev.Events:
+			currentIsHigh := received(events, "current_sensing", ev)
+			go currentSenseDev.OnEvent(currentIsHigh, name, publish)
+			metricsCurrentHigh(currentIsHigh)
+			Publish(bus, CurrentSensed{High: currentIsHigh})
+		case ev := <-tachometers:
+			r := received(events, "tachometer_"+ev.Payload.Id, ev)
+			go tachometerDevs[r.Id].OnEvent(r, name, publish)
+			Publish(bus, TachometerRead{Reading: r})
+		case ev := <-doorDev.Events:
+			doorClosed := received(events, "door_contact", ev)
+			go doorDev.OnEvent(doorClosed, name, publish)
+			Publish(bus, DoorSensed{Closed: doorClosed})
+		case ev := <-buttonDev.Events:
+			pressed := received(events, "button", ev)
+			go buttonDev.OnEvent(pressed, name, publish)
+			Publish(bus, ButtonPressed{Pressed: pressed})
+		case ev := <-bypassDev.Events:
+			keyOn := received(events, "bypass", ev)
+			Publish(bus, BypassSwitched{On: keyOn, Reason: "key turned off"})
+		case ev := <-consoleDev.Events:
+			c := received(events, "console", ev)
+			switch c.Command {
+			case "badge":
+				// Handled like a real scan.
+				go func() { badgeDev.Events <- DeviceEvent[string]{Payload: c.Arg, Time: Clk.Now()} }()
+			case "relay":
+				switch c.Arg {
+				case "on":
+					Publish(bus, BypassSwitched{On: true})
+				case "off":
+					Publish(bus, BypassSwitched{On: false, Reason: "console"})
+				}
+			default:
+				Publish(bus, CommandReceived{Command: c.Command, Payload: c.Arg})
+			}
+		case ev := <-runDev.Events:
+			e := received(events, "run_gate", ev)
+			go runDev.OnEvent(e, name, publish)
+			Publish(bus, RunGateSensed{Input: e})
+		case ev := <-temperatures:
+			r := received(events, "temperature_"+ev.Payload.Id, ev)
+			go temperatureDevs[r.Id].OnEvent(r, name, publish)
+			Publish(bus, TemperatureRead{Reading: r})
+		case ev := <-interlocks:
+			s := received(events, "interlock_"+ev.Payload.Id, ev)
+			go interlockDevs[s.Id].OnEvent(s, name, publish)
+			Publish(bus, InterlockSensed{State: s})
+		case f := <-relays.Faults:
+			go relays.OnFault(f, name, publish)
+			Publish(bus, RelayFaulted{Fault: f})
+		}
+	}
+}
+
+// Returns the state name, short enough for the status display.
+func (s State) ShortString() string {
+	if s.bypass {
+		return "BYPASS"
+	}
+	if s.lockout != "" && s.state == STATE_OFF {
+		return "OUT OF SERVICE"
+	}
+	if s.state == STATE_OFF && !s.cooldownUntil.IsZero() {
+		return "COOLING"
+	}
+	if s.state == STATE_OFF && s.curfewClosed {
+		return "CURFEW"
+	}
+	if s.cutDeferred {
+		return "STOP MACHINE"
+	}
+	if s.warning {
+		return "WARNING"
+	}
+	if s.dormant {
+		return "DORMANT"
+	}
+	if s.mode == MODE_DOOR && s.state != STATE_OFF {
+		return "UNLOCKED"
+	}
+	return map[int]string{
+		STATE_OFF:    "OFF",
+		STATE_IDLE:   "IDLE",
+		STATE_IN_USE: "IN USE",
+	}[s.state]
+}
+
+func (s State) HttpStatus() HttpStatus {
+	status := HttpStatus{
+		State:           s.ShortString(),
+		Details:         s.describe(BadgeHash),
+		MemberName:      s.memberName,
+		Relay:           s.relay,
+		Lockout:         s.lockout,
+		IdleDeadline:    s.idleDeadline,
+		SessionDeadline: s.sessionDeadline,
+	}
+	if s.badgeId != "" {
+		status.BadgeHash = BadgeHash(s.badgeId)
+	}
+	return status
+}
+
+func (s State) StateEvent() StateEvent {
+	e := StateEvent{Time: Clk.Now(), SessionId: s.sessionId, State: s.ShortString()}
+	if s.badgeId != "" {
+		e.BadgeHash = BadgeHash(s.badgeId)
+	}
+	return e
+}
+
+// Describes the state for logs, with the badge ID pseudonymized if enabled.
+func (s State) String() string {
+	return s.describe(BadgePseudonym)
+}
+
+// Describes the state, showing the badge as returned by 'badge'.
+func (s State) describe(badge func(badgeId string) string) string {
+	badged := "n/a"
+	if s.badgeId != "" {
+		badged = badge(s.badgeId)
+	}
+	return fmt.Sprintf("state: %s, badged: %s, relay: %s, door: %s, overheated: %d, wiring faults: %d, interlocks open: %d, bypass: %s, lockout: %s, mqtt: %s",
+		map[int]string{
+			STATE_OFF:    "OFF (unauthenticated)",
+			STATE_IDLE:   "IDLE (authenticated)",
+			STATE_IN_USE: "IN USE (authenticated, drawing current)",
+		}[s.state],
+		badged,
+		map[bool]string{false: "off", true: "on"}[s.relay],
+		map[bool]string{false: "open", true: "closed"}[s.doorClosed],
+		len(s.overheated),
+		len(s.wiringFaults),
+		len(s.interlocksOpen),
+		map[bool]string{false: "off", true: "ON"}[s.bypass],
+		map[bool]string{false: "none", true: s.lockout}[s.lockout != ""],
+		map[bool]string{false: "disconnected", true: "connected"}[s.mqttConnected])
+}
@@ -0,0 +1,254 @@
+package gauthbox
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	testGreenPin   = 5
+	testRedPin     = 6
+	testRelayPin   = 23
+	testCurrentPin = 24
+	testDoorPin    = 25
+	// Active low: satisfied while the input is low, as at startup.
+	testVacuumPin = 26
+	testGuardPin  = 27
+)
+
+const testMember = "1234"
+
+// Shared by all runs and never restored: devices without a shutdown keep
+// reading the clock after the state machine returned.
+var testClock = NewMockClock(time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+
+func init() {
+	Clk = testClock
+	// Runs are stopped through their context.
+	NotifySignals = func(chan<- os.Signal) func() { return func() {} }
+}
+
+// A running state machine on mock hardware and a mock clock.
+type machineTest struct {
+	t     *testing.T
+	hw    *MockHardware
+	clock *MockClock
+	start time.Time
+}
+
+// A step of a state machine scenario.
+type machineStep func(m *machineTest)
+
+func badge(id string) machineStep {
+	return func(m *machineTest) {
+		if err := m.hw.TypeBadge(id); err != nil {
+			m.t.Fatal(err)
+		}
+	}
+}
+
+func current(high bool) machineStep {
+	return func(m *machineTest) { m.hw.SetInput(Pin{Offset: testCurrentPin}, high) }
+}
+
+func doorClosed(closed bool) machineStep {
+	return func(m *machineTest) { m.hw.SetInput(Pin{Offset: testDoorPin}, closed) }
+}
+
+func interlock(pin int, satisfied bool) machineStep {
+	return func(m *machineTest) { m.hw.SetInput(Pin{Offset: pin}, !satisfied) }
+}
+
+func advance(d time.Duration) machineStep {
+	return func(m *machineTest) { m.clock.Advance(d) }
+}
+
+// Waits for the state, as shown on the displays, and the machine relay.
+func want(state string, relay bool) machineStep {
+	return func(m *machineTest) {
+		m.t.Helper()
+		m.waitFor(func() bool {
+			return m.lastState() == state && m.hw.Output(Pin{Offset: testRelayPin}).Value() == map[bool]int{false: 0, true: 1}[relay]
+		}, "state %s with relay %t", state, relay)
+	}
+}
+
+// Waits for the LEDs to be on or off. Blinking patterns start on.
+func wantLeds(green, red bool) machineStep {
+	return func(m *machineTest) {
+		m.t.Helper()
+		m.waitFor(func() bool {
+			return m.hw.Output(Pin{Offset: testGreenPin}).Value() == map[bool]int{false: 0, true: 1}[green] &&
+				m.hw.Output(Pin{Offset: testRedPin}).Value() == map[bool]int{false: 0, true: 1}[red]
+		}, "green LED %t and red LED %t", green, red)
+	}
+}
+
+// Waits for a badge to be refused.
+func wantDenied() machineStep {
+	return func(m *machineTest) {
+		m.t.Helper()
+		m.waitFor(func() bool {
+			for _, e := range History(m.start) {
+				if e.Kind == HISTORY_DENIED {
+					return true
+				}
+			}
+			return false
+		}, "a denied badge")
+	}
+}
+
+func (m *machineTest) lastState() string {
+	s := ""
+	for _, e := range History(m.start) {
+		if e.Kind == HISTORY_STATE {
+			s = e.Detail
+		}
+	}
+	return s
+}
+
+func (m *machineTest) waitFor(cond func() bool, format string, args ...any) {
+	m.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			m.t.Fatalf("timed out waiting for "+format+", last state %s", append(args, m.lastState())...)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Runs the state machine with the config, which is completed with the pins
+// above and an authentication server only accepting testMember.
+func runMachine(t *testing.T, config string) *machineTest {
+	c := &AuthboxConfig{}
+	if err := json.Unmarshal([]byte(config), c); err != nil {
+		t.Fatal(err)
+	}
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("b") != testMember {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"member_name":"Alice"}`))
+	}))
+	t.Cleanup(auth.Close)
+	c.BadgeAuth.UrlTemplate = auth.URL + "/auth?b={{.badgeId}}"
+	c.BadgeAuth.UsageMinutes = 24 * 60
+	// Between the keys of a badge ID, in real time.
+	c.BadgeReader.TimeoutMs = 1000
+	c.Relay.Pin = Pin{Offset: testRelayPin}
+	c.CurrentSensing.Pin = Pin{Offset: testCurrentPin}
+	c.GreenLed.Pin, c.RedLed.Pin = Pin{Offset: testGreenPin}, Pin{Offset: testRedPin}
+
+	m := &machineTest{t: t, hw: NewMockHardware(), clock: testClock, start: time.Now()}
+	hw, stateDir := Hw, StateDir
+	Hw, StateDir = m.hw, t.TempDir()
+	// The door starts closed.
+	m.hw.SetInput(Pin{Offset: testDoorPin}, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- RunStateMachine(ctx, "test", c) }()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("state machine: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("state machine did not stop")
+		}
+		Hw, StateDir = hw, stateDir
+	})
+	want("OFF", false)(m)
+	return m
+}
+
+func TestStateMachine(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		steps  []machineStep
+	}{{
+		name:   "idle timeout",
+		config: `{"idle_duration_s": 60}`,
+		steps: []machineStep{
+			badge(testMember), want("IDLE", true),
+			advance(59 * time.Second), want("IDLE", true),
+			advance(time.Second), want("OFF", false),
+		},
+	}, {
+		name:   "unknown badge",
+		config: `{"idle_duration_s": 60}`,
+		steps: []machineStep{
+			badge("5678"), wantDenied(), want("OFF", false),
+		},
+	}, {
+		name:   "in use then stopped",
+		config: `{"idle_duration_s": 60}`,
+		steps: []machineStep{
+			badge(testMember), want("IDLE", true),
+			current(true), want("IN USE", true), wantLeds(true, false),
+			advance(time.Hour), want("IN USE", true),
+			current(false), want("IDLE", true),
+			advance(time.Minute), want("OFF", false), wantLeds(false, true),
+		},
+	}, {
+		name:   "idle warning then resumed",
+		config: `{"idle_duration_s": 60, "idle_warning_s": 10}`,
+		steps: []machineStep{
+			badge(testMember), want("IDLE", true),
+			advance(50 * time.Second), want("WARNING", true), wantLeds(true, true),
+			current(true), want("IN USE", true), wantLeds(true, false),
+			current(false), want("IDLE", true),
+			advance(50 * time.Second), want("WARNING", true),
+			advance(10 * time.Second), want("OFF", false),
+		},
+	}, {
+		name:   "door opened in use with the cut action",
+		config: `{"idle_duration_s": 60, "door_contact": {"pin": 25, "open_action": "cut"}}`,
+		steps: []machineStep{
+			badge(testMember), want("IDLE", true),
+			current(true), want("IN USE", true),
+			doorClosed(false), want("OFF", false),
+			doorClosed(true), current(false), want("OFF", false),
+		},
+	}, {
+		name:   "door cut while current flows and never cutting in use",
+		config: `{"idle_duration_s": 60, "never_cut_in_use": true, "door_contact": {"pin": 25, "open_action": "cut"}}`,
+		steps: []machineStep{
+			badge(testMember), want("IDLE", true),
+			current(true), want("IN USE", true),
+			doorClosed(false), want("OFF", false),
+		},
+	}, {
+		name: "interlocks tripped after their grace period",
+		config: `{"idle_duration_s": 60, "interlocks": [
+			{"id": "vacuum", "pin": 26, "active_low": true, "grace_ms": 1000},
+			{"id": "guard", "pin": 27, "active_low": true, "grace_ms": 1000}]}`,
+		steps: []machineStep{
+			badge(testMember), want("IDLE", true),
+			interlock(testVacuumPin, false), advance(time.Second), want("OFF", false),
+			interlock(testVacuumPin, true),
+			badge(testMember), want("IDLE", true),
+			interlock(testGuardPin, false), advance(time.Second), want("OFF", false),
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := runMachine(t, tt.config)
+			for _, step := range tt.steps {
+				step(m)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package gauthbox
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the badge authentication latency histogram, in seconds.
+var AUTH_LATENCY_BUCKETS = []float64{0.1, 0.25, 0.5, 1, 2, 3, 5, 10}
+
+// Optional Prometheus metrics listener, unauthenticated.
+type metricsConfig struct {
+	// Address to listen on, e.g. ":9100".
+	Listen string `json:"listen"`
+}
+
+type histogram struct {
+	// Cumulative, per bucket of AUTH_LATENCY_BUCKETS.
+	buckets []int64
+	count   int64
+	sum     float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.buckets == nil {
+		h.buckets = make([]int64, len(AUTH_LATENCY_BUCKETS))
+	}
+	for i, le := range AUTH_LATENCY_BUCKETS {
+		if v <= le {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Process-wide metrics, updated by the state machine and BadgeAuth.
+var metrics = struct {
+	mu         sync.Mutex
+	badgeScans int64
+	// By action and outcome, e.g. "initial", "ok".
+	authResults map[[2]string]int64
+	// By action.
+	authLatency map[string]*histogram
+	// From the badge scan to the relay switching on.
+	badgeToPower histogram
+	// Of the last badge authentication, for the health.
+	lastAuthOutcome   string
+	lastAuthAt        time.Time
+	relayOn           bool
+	currentHigh       bool
+	currentHighSince  time.Time
+	currentHighTotal  time.Duration
+	mqttConnected     bool
+	mqttEverConnected bool
+	mqttReconnects    int64
+	// By state, as in ShortString.
+	stateTransitions map[string]int64
+	lastState        string
+}{
+	authResults:      map[[2]string]int64{},
+	authLatency:      map[string]*histogram{},
+	stateTransitions: map[string]int64{},
+}
+
+func metricsBadgeScan() {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.badgeScans++
+}
+
+func metricsAuth(action, outcome string, d time.Duration) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.authResults[[2]string{action, outcome}]++
+	metrics.lastAuthOutcome, metrics.lastAuthAt = outcome, Clk.Now()
+	h, ok := metrics.authLatency[action]
+	if !ok {
+		h = &histogram{}
+		metrics.authLatency[action] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func metricsBadgeToPower(d time.Duration) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.badgeToPower.observe(d.Seconds())
+}
+
+func metricsCurrentHigh(high bool) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	switch {
+	case high && !metrics.currentHigh:
+		metrics.currentHighSince = Clk.Now()
+	case !high && metrics.currentHigh:
+		metrics.currentHighTotal += Clk.Now().Sub(metrics.currentHighSince)
+	}
+	metrics.currentHigh = high
+}
+
+func metricsMqttConnected(connected bool) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if connected && !metrics.mqttConnected && metrics.mqttEverConnected {
+		metrics.mqttReconnects++
+	}
+	metrics.mqttConnected = connected
+	metrics.mqttEverConnected = metrics.mqttEverConnected || connected
+}
+
+func metricsState(s State) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.relayOn = s.relay
+	if state := s.ShortString(); state != metrics.lastState {
+		metrics.stateTransitions[state]++
+		metrics.lastState = state
+	}
+}
+
+// Writes the metrics in the Prometheus text format.
+func writeMetrics(w io.Writer) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	asInt := map[bool]int{false: 0, true: 1}
+
+	fmt.Fprintf(w, "# TYPE gauthbox_badge_scans_total counter\ngauthbox_badge_scans_total %d\n", metrics.badgeScans)
+
+	fmt.Fprintf(w, "# TYPE gauthbox_auth_results_total counter\n")
+	keys := [][2]string{}
+	for k := range metrics.authResults {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b [2]string) int {
+		return cmp.Or(cmp.Compare(a[0], b[0]), cmp.Compare(a[1], b[1]))
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "gauthbox_auth_results_total{action=%q,outcome=%q} %d\n", k[0], k[1], metrics.authResults[k])
+	}
+
+	fmt.Fprintf(w, "# TYPE gauthbox_auth_latency_seconds histogram\n")
+	actions := []string{}
+	for a := range metrics.authLatency {
+		actions = append(actions, a)
+	}
+	slices.Sort(actions)
+	for _, a := range actions {
+		h := metrics.authLatency[a]
+		for i, le := range AUTH_LATENCY_BUCKETS {
+			fmt.Fprintf(w, "gauthbox_auth_latency_seconds_bucket{action=%q,le=\"%g\"} %d\n", a, le, h.buckets[i])
+		}
+		fmt.Fprintf(w, "gauthbox_auth_latency_seconds_bucket{action=%q,le=\"+Inf\"} %d\n", a, h.count)
+		fmt.Fprintf(w, "gauthbox_auth_latency_seconds_sum{action=%q} %g\n", a, h.sum)
+		fmt.Fprintf(w, "gauthbox_auth_latency_seconds_count{action=%q} %d\n", a, h.count)
+	}
+
+	fmt.Fprintf(w, "# TYPE gauthbox_badge_to_power_seconds histogram\n")
+	if h := metrics.badgeToPower; h.count > 0 {
+		for i, le := range AUTH_LATENCY_BUCKETS {
+			fmt.Fprintf(w, "gauthbox_badge_to_power_seconds_bucket{le=\"%g\"} %d\n", le, h.buckets[i])
+		}
+		fmt.Fprintf(w, "gauthbox_badge_to_power_seconds_bucket{le=\"+Inf\"} %d\n", h.count)
+		fmt.Fprintf(w, "gauthbox_badge_to_power_seconds_sum %g\n", h.sum)
+		fmt.Fprintf(w, "gauthbox_badge_to_power_seconds_count %d\n", h.count)
+	}
+
+	fmt.Fprintf(w, "# TYPE gauthbox_relay_on gauge\ngauthbox_relay_on %d\n", asInt[metrics.relayOn])
+
+	currentHigh := metrics.currentHighTotal
+	if metrics.currentHigh {
+		currentHigh += Clk.Now().Sub(metrics.currentHighSince)
+	}
+	fmt.Fprintf(w, "# TYPE gauthbox_current_high_seconds_total counter\ngauthbox_current_high_seconds_total %g\n", currentHigh.Seconds())
+
+	fmt.Fprintf(w, "# TYPE gauthbox_mqtt_connected gauge\ngauthbox_mqtt_connected %d\n", asInt[metrics.mqttConnected])
+	fmt.Fprintf(w, "# TYPE gauthbox_mqtt_reconnects_total counter\ngauthbox_mqtt_reconnects_total %d\n", metrics.mqttReconnects)
+
+	fmt.Fprintf(w, "# TYPE gauthbox_state_transitions_total counter\n")
+	states := []string{}
+	for s := range metrics.stateTransitions {
+		states = append(states, s)
+	}
+	slices.Sort(states)
+	for _, s := range states {
+		fmt.Fprintf(w, "gauthbox_state_transitions_total{state=%q} %d\n", s, metrics.stateTransitions[s])
+	}
+}
+
+// MQTT: publishes the outcome and round-trip time of a badge authentication.
+func PublishAuthOutcome(outcome string, latency time.Duration, name string, publish PublishFunc) {
+	publish(name+"/auth/outcome", outcome)
+	publish(name+"/auth/latency", strconv.FormatInt(latency.Milliseconds(), 10))
+}
+
+// MQTT: the outcome of the last badge authentication, as a diagnostic enum
+// sensor.
+func AuthOutcomeDiscovery() MqttDiscovery {
+	return MqttDiscovery{
+		Component: "sensor",
+		Id:        "auth_outcome",
+		Announce: func(name, topic string) interface{} {
+			return struct {
+				Device         MqttDevice `json:"device"`
+				DeviceClass    string     `json:"device_class"`
+				EntityCategory string     `json:"entity_category"`
+				Options        []string   `json:"options"`
+				StateTopic     string     `json:"state_topic"`
+			}{
+				Device:         MqttDevice{Name: "Badge auth outcome on " + name},
+				DeviceClass:    "enum",
+				EntityCategory: "diagnostic",
+				Options:        []string{AUTH_OUTCOME_OK, AUTH_OUTCOME_DENIED, AUTH_OUTCOME_TIMEOUT, AUTH_OUTCOME_5XX, AUTH_OUTCOME_ERROR},
+				StateTopic:     topic + "/" + name + "/auth/outcome",
+			}
+		},
+	}
+}
+
+// MQTT: the round-trip time of the last badge authentication, as a diagnostic
+// sensor.
+func AuthLatencyDiscovery() MqttDiscovery {
+	return MqttDiscovery{
+		Component: "sensor",
+		Id:        "auth_latency",
+		Announce: func(name, topic string) interface{} {
+			return struct {
+				Device         MqttDevice `json:"device"`
+				DeviceClass    string     `json:"device_class"`
+				EntityCategory string     `json:"entity_category"`
+				StateClass     string     `json:"state_class"`
+				StateTopic     string     `json:"state_topic"`
+				Unit           string     `json:"unit_of_measurement"`
+			}{
+				Device:         MqttDevice{Name: "Badge auth latency on " + name},
+				DeviceClass:    "duration",
+				EntityCategory: "diagnostic",
+				StateClass:     "measurement",
+				StateTopic:     topic + "/" + name + "/auth/latency",
+				Unit:           "ms",
+			}
+		},
+	}
+}
+
+// Prometheus metrics listener logic. Serves GET /metrics.
+func MetricsServer(c metricsConfig) (*DeviceRet[struct{}], error) {
+	listener, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	return &DeviceRet[struct{}]{
+		Looper: func() {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("metrics: stopped serving", slog.Any("error", err))
+			}
+		},
+		Shutdown: func() { server.Close() },
+	}, nil
+}
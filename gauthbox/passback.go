@@ -0,0 +1,66 @@
+package gauthbox
+
+// Sub-topic on which each box publishes the hash of its active badge, retained,
+// empty when no session is running.
+const ACTIVE_BADGE_TOPIC = "active_badge"
+
+// Prevents a badge from being active on too many tools at once. Coordinated
+// over MQTT between boxes sharing the same topic; best effort while disconnected.
+type antiPassbackConfig struct {
+	// How many tools, including this one, a badge may be active on. Defaults to 1.
+	MaxTools int `json:"max_tools,omitempty"`
+}
+
+func (c antiPassbackConfig) maxTools() int {
+	if c.MaxTools <= 0 {
+		return 1
+	}
+	return c.MaxTools
+}
+
+// What is known of another box: the hash of its active badge and whether it is
+// online, as retained messages arrive in any order.
+type peerBadge struct {
+	Hash   string
+	Online bool
+}
+
+// Badges active on the other boxes, by box name.
+type PeerBadges map[string]peerBadge
+
+// Tracks the active badge or availability of another box.
+func (p PeerBadges) Update(e MqttEvent) {
+	peer := p[e.Peer]
+	switch e.Command {
+	case ACTIVE_BADGE_TOPIC:
+		peer.Hash = e.Payload
+	case "availability":
+		peer.Online = e.Payload == "online"
+	default:
+		return
+	}
+	p[e.Peer] = peer
+}
+
+// Returns whether the badge may not start a session here, as it is active on
+// too many other boxes.
+func (p PeerBadges) Denies(c antiPassbackConfig, badgeId string) bool {
+	hash, active := BadgeHash(badgeId), 0
+	for _, peer := range p {
+		// An offline box keeps its retained badge, but cannot be in use.
+		if peer.Online && peer.Hash == hash {
+			active++
+		}
+	}
+	return active >= c.maxTools()
+}
+
+// Publishes the hash of the active badge, retained so that boxes starting later
+// know about it. Empty clears it.
+func PublishActiveBadge(badgeId string, name string, publish PublishFunc) {
+	hash := ""
+	if badgeId != "" {
+		hash = BadgeHash(badgeId)
+	}
+	publish(name+"/"+ACTIVE_BADGE_TOPIC, MqttRetained{Payload: hash})
+}
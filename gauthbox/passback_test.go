@@ -0,0 +1,59 @@
+package gauthbox
+
+import "testing"
+
+func TestPeerBadges(t *testing.T) {
+	active := func(peer, badgeId string) MqttEvent {
+		hash := ""
+		if badgeId != "" {
+			hash = BadgeHash(badgeId)
+		}
+		return MqttEvent{Peer: peer, Command: ACTIVE_BADGE_TOPIC, Payload: hash}
+	}
+	online := func(peer string, online bool) MqttEvent {
+		return MqttEvent{Peer: peer, Command: "availability", Payload: map[bool]string{false: "offline", true: "online"}[online]}
+	}
+	tests := []struct {
+		name     string
+		maxTools int
+		events   []MqttEvent
+		denied   bool
+	}{
+		{"no peer", 0, nil, false},
+		{"active elsewhere", 0, []MqttEvent{online("lathe", true), active("lathe", testMember)}, true},
+		{"retained badge before availability", 0, []MqttEvent{active("lathe", testMember), online("lathe", true)}, true},
+		{"another badge elsewhere", 0, []MqttEvent{online("lathe", true), active("lathe", "5678")}, false},
+		{"session ended elsewhere", 0, []MqttEvent{online("lathe", true), active("lathe", testMember), active("lathe", "")}, false},
+		{"peer offline", 0, []MqttEvent{online("lathe", true), active("lathe", testMember), online("lathe", false)}, false},
+		{"availability unknown", 0, []MqttEvent{active("lathe", testMember)}, false},
+		{"other commands ignored", 0, []MqttEvent{online("lathe", true), {Peer: "lathe", Command: AUX_GROUP_TOPIC, Payload: BadgeHash(testMember)}}, false},
+		{"below the limit", 2, []MqttEvent{online("lathe", true), active("lathe", testMember)}, false},
+		{"at the limit", 2, []MqttEvent{online("lathe", true), active("lathe", testMember), online("mill", true), active("mill", testMember)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peers := PeerBadges{}
+			for _, e := range tt.events {
+				peers.Update(e)
+			}
+			if denied := peers.Denies(antiPassbackConfig{MaxTools: tt.maxTools}, testMember); denied != tt.denied {
+				t.Errorf("denied %v, want %v", denied, tt.denied)
+			}
+		})
+	}
+}
+
+func TestPublishActiveBadge(t *testing.T) {
+	for _, badgeId := range []string{testMember, ""} {
+		var topic string
+		var payload interface{}
+		PublishActiveBadge(badgeId, "mill", func(tp string, p interface{}) { topic, payload = tp, p })
+		want := MqttRetained{}
+		if badgeId != "" {
+			want.Payload = BadgeHash(badgeId)
+		}
+		if topic != "mill/"+ACTIVE_BADGE_TOPIC || payload != want {
+			t.Errorf("published %v on %s, want %v", payload, topic, want)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package gauthbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/warthog618/go-gpiocdev"
+)
+
+const EXPANDER_DRIVER_MCP23017 = "mcp23017"
+const EXPANDER_DRIVER_PCF8574 = "pcf8574"
+
+// Expanders have no usable interrupt line here, inputs are polled.
+const EXPANDER_POLL_INTERVAL = 10 * time.Millisecond
+
+// A GPIO pin: either a line offset on the SoC GPIO chip, written as a plain
+// JSON number, a line offset on another GPIO chip (USB GPIO, HAT), written
+// "chip:<name or label prefix>:<offset>", or a pin on an I2C GPIO expander,
+// written "expander:<addr>:<pin>".
+type Pin struct {
+	// GPIO chip name or label prefix, empty for the SoC GPIO chip.
+	Chip string
+	// I2C address of the expander, zero for a GPIO chip.
+	Expander uint16
+	Offset   int
+}
+
+func (p *Pin) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &p.Offset); err == nil {
+		p.Chip, p.Expander = "", 0
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("pin must be a number or a string: %w", err)
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) == 3 && parts[0] == "chip" {
+		offset, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return fmt.Errorf("invalid chip offset in pin '%s': %w", s, err)
+		}
+		p.Chip, p.Expander, p.Offset = parts[1], 0, offset
+		return nil
+	}
+	if len(parts) != 3 || parts[0] != "expander" {
+		return fmt.Errorf("invalid pin '%s', want chip:<label>:<offset> or expander:<addr>:<pin>", s)
+	}
+	addr, err := strconv.ParseUint(parts[1], 0, 16)
+	if err != nil {
+		return fmt.Errorf("invalid expander address in pin '%s': %w", s, err)
+	}
+	offset, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return fmt.Errorf("invalid expander pin in pin '%s': %w", s, err)
+	}
+	p.Chip, p.Expander, p.Offset = "", uint16(addr), offset
+	return nil
+}
+
+func (p Pin) MarshalJSON() ([]byte, error) {
+	if p.Chip == "" && p.Expander == 0 {
+		return json.Marshal(p.Offset)
+	}
+	return json.Marshal(p.String())
+}
+
+func (p Pin) String() string {
+	if p.Chip != "" {
+		return fmt.Sprintf("chip:%s:%d", p.Chip, p.Offset)
+	}
+	if p.Expander == 0 {
+		return strconv.Itoa(p.Offset)
+	}
+	return fmt.Sprintf("expander:0x%02x:%d", p.Expander, p.Offset)
+}
+
+type expanderConfig struct {
+	// One of EXPANDER_DRIVER_*.
+	Driver  string `json:"driver"`
+	I2cBus  int    `json:"i2c_bus"`
+	Address uint16 `json:"address"`
+}
+
+type expander struct {
+	mu     sync.Mutex
+	dev    *i2cDevice
+	driver string
+	// Output latch and direction, one bit per pin. Inputs are 1 in 'inputs'.
+	latch  uint16
+	inputs uint16
+}
+
+var expanders = struct {
+	mu     sync.Mutex
+	byAddr map[uint16]*expander
+}{byAddr: map[uint16]*expander{}}
+
+// Opens the configured I2C GPIO expanders. Must be called before requesting
+// any "expander:" pin.
+func SetupExpanders(cs []expanderConfig) error {
+	expanders.mu.Lock()
+	defer expanders.mu.Unlock()
+	for _, c := range cs {
+		if c.Driver != EXPANDER_DRIVER_MCP23017 && c.Driver != EXPANDER_DRIVER_PCF8574 {
+			return fmt.Errorf("unknown expander driver '%s'", c.Driver)
+		}
+		dev, err := openI2cDevice(c.I2cBus, c.Address)
+		if err != nil {
+			return err
+		}
+		// Everything starts as an input, which is the power-on state of both chips.
+		e := &expander{dev: dev, driver: c.Driver, inputs: 0xffff}
+		if err := e.flush(); err != nil {
+			return fmt.Errorf("expander 0x%02x: %w", c.Address, err)
+		}
+		expanders.byAddr[c.Address] = e
+	}
+	return nil
+}
+
+func findExpander(p Pin) (*expander, error) {
+	expanders.mu.Lock()
+	defer expanders.mu.Unlock()
+	if e, ok := expanders.byAddr[p.Expander]; ok {
+		return e, nil
+	}
+	return nil, fmt.Errorf("no expander configured at address 0x%02x for pin %s", p.Expander, p)
+}
+
+// Writes the latch and direction registers. Must be called with the lock held.
+func (e *expander) flush() error {
+	switch e.driver {
+	case EXPANDER_DRIVER_MCP23017:
+		// IODIRA/B, then OLATA/B, in the default IOCON.BANK=0 layout.
+		if err := e.dev.Write([]byte{0x00, byte(e.inputs), byte(e.inputs >> 8)}); err != nil {
+			return err
+		}
+		return e.dev.Write([]byte{0x14, byte(e.latch), byte(e.latch >> 8)})
+	default:
+		// Quasi-bidirectional: inputs must be written high.
+		return e.dev.Write([]byte{byte(e.latch | e.inputs)})
+	}
+}
+
+// Reads the level of all pins.
+func (e *expander) read() (uint16, error) {
+	switch e.driver {
+	case EXPANDER_DRIVER_MCP23017:
+		b := make([]byte, 2)
+		if err := e.dev.ReadRegister(0x12, b); err != nil {
+			return 0, err
+		}
+		return uint16(b[0]) | uint16(b[1])<<8, nil
+	default:
+		b := make([]byte, 1)
+		_, err := e.dev.f.Read(b)
+		return uint16(b[0]), err
+	}
+}
+
+func (e *expander) setup(offset int, input bool, value int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	mask := uint16(1) << offset
+	if input {
+		e.inputs |= mask
+	} else {
+		e.inputs &^= mask
+	}
+	if value != 0 {
+		e.latch |= mask
+	} else {
+		e.latch &^= mask
+	}
+	return e.flush()
+}
+
+type expanderLine struct {
+	e      *expander
+	offset int
+}
+
+func (l *expanderLine) SetValue(value int) error {
+	return l.e.setup(l.offset, false, value)
+}
+
+func (l *expanderLine) Value() (int, error) {
+	levels, err := l.e.read()
+	if err != nil {
+		return 0, err
+	}
+	return int(levels>>l.offset) & 1, nil
+}
+
+func (l *expanderLine) Close() error {
+	return nil
+}
+
+// An input line read on demand, e.g. a busy signal, either on a GPIO chip or on
+// an expander.
+type PolledLine interface {
+	Value() (int, error)
+	Close() error
+}
+
+// Requests an input line, read by polling its raw value.
+func requestPolledInput(p Pin) (PolledLine, error) {
+	if p.Expander == 0 {
+		chip, err := findGpioChip(p.Chip)
+		if err != nil {
+			return nil, err
+		}
+		return requestLine(chip, p.Offset, gpiocdev.AsInput)
+	}
+	e, err := findExpander(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.setup(p.Offset, true, 0); err != nil {
+		return nil, err
+	}
+	return &expanderLine{e: e, offset: p.Offset}, nil
+}
+
+// Requests an output line with the given initial raw value.
+func requestOutput(p Pin, value int) (OutputLine, error) {
+	if p.Expander == 0 {
+		chip, err := findGpioChip(p.Chip)
+		if err != nil {
+			return nil, err
+		}
+		return requestLine(chip, p.Offset, gpiocdev.AsOutput(value))
+	}
+	e, err := findExpander(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.setup(p.Offset, false, value); err != nil {
+		return nil, err
+	}
+	return &expanderLine{e: e, offset: p.Offset}, nil
+}
+
+// Polls an expander input pin, calling onChange with the raw level once it has
+// been stable for 'debounce'. Returns the raw level at request time.
+func watchExpanderInput(p Pin, debounce time.Duration, onChange func(high bool)) (io.Closer, bool, error) {
+	e, err := findExpander(p)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := e.setup(p.Offset, true, 0); err != nil {
+		return nil, false, err
+	}
+	levels, err := e.read()
+	if err != nil {
+		return nil, false, err
+	}
+	mask := uint16(1) << p.Offset
+	initial := levels&mask != 0
+	done := make(chan struct{})
+	go func() {
+		stable, last, since := initial, initial, time.Now()
+		ticker := time.NewTicker(EXPANDER_POLL_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			levels, err := e.read()
+			if err != nil {
+				slog.Warn("expander: could not read pins", slog.String("pin", p.String()), slog.Any("err", err))
+				continue
+			}
+			high := levels&mask != 0
+			if high != last {
+				last, since = high, time.Now()
+			}
+			if high != stable && time.Since(since) >= debounce {
+				stable = high
+				onChange(high)
+			}
+		}
+	}()
+	return closerFunc(func() error { close(done); return nil }), initial, nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
@@ -0,0 +1,238 @@
+package gauthbox
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Returns the ID of an interlock that is not satisfied although it should be,
+// and the time until the next grace period ends, if any.
+func trippedInterlock(config *AuthboxConfig, s *State) (string, time.Duration) {
+	next := time.Duration(0)
+	for _, c := range config.Interlocks {
+		grace := time.Duration(c.GraceMs)*time.Millisecond - Clk.Now().Sub(s.relayOnSince)
+		if c.GraceMs != 0 && !s.relay {
+			// The grace period starts with the relays.
+			continue
+		}
+		if grace > 0 {
+			if next == 0 || grace < next {
+				next = grace
+			}
+			continue
+		}
+		if s.interlocksOpen[c.Id] {
+			return c.Id, 0
+		}
+	}
+	return "", next
+}
+
+// Whether a safety feature requires the relay off, whatever the machine is doing.
+func safetyCutoff(config *AuthboxConfig, s *State) bool {
+	if !s.doorClosed && config.DoorContact.OpenAction == DOOR_ACTION_CUT {
+		return true
+	}
+	id, _ := trippedInterlock(config, s)
+	return id != "" || s.overheatCutoff()
+}
+
+// Whether the relay must stay on as the machine draws current. Only defers
+// the timeouts and commands, never the safety cutoffs.
+func powerHeld(config *AuthboxConfig, s *State) bool {
+	return config.NeverCutInUse && s.currentHigh && !safetyCutoff(config, s)
+}
+
+// Switches the relays, and the run relay of two-stage power, as the state
+// requires. Owns the relay, relayOnSince, cutDeferred, cooldownUntil, running,
+// runGate, runLatched and wiringFaults fields of the state.
+type Power struct {
+	config  *AuthboxConfig
+	name    string
+	publish PublishFunc
+	state   *State
+	bus     *Bus
+	relays  *RelayBank
+	// The run relay and its commanded state, with two-stage power.
+	runRelay *DeviceRet[bool]
+	runIsOn  chan<- bool
+	// Fires when powering off was deferred for too long.
+	cutAlarm *BusTimer
+	// Fires when the auxiliary relays are off after a cool-down.
+	cooldownOver *BusTimer
+}
+
+func NewPower(config *AuthboxConfig, name string, publish PublishFunc, state *State, relays *RelayBank, runRelay *DeviceRet[bool], runIsOn chan<- bool) *Power {
+	return &Power{config: config, name: name, publish: publish, state: state, relays: relays, runRelay: runRelay, runIsOn: runIsOn}
+}
+
+// Subscribes to the requests to update the power and to the inputs of the
+// relays. Must come after the session lifecycle: a deferred power off is
+// applied once the machine is known to have stopped.
+func (p *Power) Subscribe(bus *Bus) {
+	p.bus = bus
+	p.cutAlarm = bus.NewTimer(p.onCutAlarm)
+	p.cooldownOver = bus.NewTimer(func() {
+		// Auxiliary relays are now off, just report the state.
+		p.state.cooldownUntil = time.Time{}
+		Publish(bus, StateUpdated{})
+	})
+	Subscribe(bus, func(Started) {
+		// The relays start in their configured initial state; bring them in line
+		// with the state machine, honoring their off delays.
+		p.update()
+		p.updateRun()
+	})
+	Subscribe(bus, func(UpdatePower) { p.update() })
+	Subscribe(bus, func(e SessionEnded) {
+		if e.Exiting {
+			// The relays go to their exit state.
+			return
+		}
+		s := p.state
+		if s.relay && !s.bypass && !powerHeld(p.config, s) {
+			p.cut()
+		}
+		p.update()
+	})
+	Subscribe(bus, p.onCurrent)
+	Subscribe(bus, p.onRunGate)
+	Subscribe(bus, func(e RelayFaulted) {
+		if e.Fault.Fault {
+			p.state.wiringFaults[e.Fault.Role] = true
+		} else {
+			delete(p.state.wiringFaults, e.Fault.Role)
+		}
+		Publish(bus, StateUpdated{})
+	})
+}
+
+// Energizes the relay iff a session that is not dormant or the maintenance bypass is active, or
+// in always-on mode, and the door interlock allows it.
+// The relay may only be switched on while the door is closed; opening the door
+// while the relay is on only cuts power with the 'cut' action, which also ends
+// the session if in use.
+// With never_cut_in_use, switching off waits for the machine to stop drawing
+// current, unless for a safety cutoff.
+func (p *Power) update() {
+	s := p.state
+	on := (s.state != STATE_OFF && !s.dormant) || s.bypass || p.config.Mode == MODE_ALWAYS_ON_METERED
+	if !s.doorClosed && (!s.relay || p.config.DoorContact.OpenAction == DOOR_ACTION_CUT) {
+		on = false
+	}
+	switch {
+	case on == s.relay:
+		p.cancelDeferredCut()
+	case !on && powerHeld(p.config, s):
+		p.deferCut()
+	default:
+		p.set(on)
+	}
+}
+
+func (p *Power) set(on bool) {
+	defer p.updateRun()
+	p.cancelDeferredCut()
+	s := p.state
+	s.relay = on
+	p.cooldownOver.Stop()
+	s.cooldownUntil = time.Time{}
+	p.relays.Set(on, p.name, p.publish)
+	if on {
+		s.relayOnSince = Clk.Now()
+	}
+	Publish(p.bus, RelaySwitched{On: on})
+}
+
+// Switches the relay off, keeping auxiliary power for the configured cool-down.
+func (p *Power) cut() {
+	defer p.updateRun()
+	p.cancelDeferredCut()
+	s := p.state
+	s.relay = false
+	if cooldown := p.relays.Cooldown(p.name, p.publish); cooldown > 0 {
+		s.cooldownUntil = Clk.Now().Add(cooldown)
+		p.cooldownOver.Reset(cooldown)
+	}
+	Publish(p.bus, RelaySwitched{On: false})
+}
+
+// Defers switching the relay off until the machine stops drawing current.
+func (p *Power) deferCut() {
+	if p.state.cutDeferred {
+		return
+	}
+	slog.Warn("current flowing, deferring power off")
+	p.state.cutDeferred = true
+	p.cutAlarm.Reset(CUT_DEFERRED_ALARM_DELAY)
+}
+
+func (p *Power) cancelDeferredCut() {
+	if !p.state.cutDeferred {
+		return
+	}
+	p.state.cutDeferred = false
+	p.cutAlarm.Stop()
+}
+
+// The machine should have been powered off long ago.
+func (p *Power) onCutAlarm() {
+	if !p.state.cutDeferred {
+		return
+	}
+	slog.Error("current still flowing, power off deferred for too long")
+	Publish(p.bus, Tripped{Cause: TRIP_CUT_DEFERRED, Reason: "power off deferred, current still flowing"})
+}
+
+func (p *Power) onCurrent(e CurrentSensed) {
+	s := p.state
+	if !s.cutDeferred || e.High {
+		return
+	}
+	// The machine stopped: power off as decided earlier.
+	slog.Info("current stopped, applying deferred power off")
+	if s.state == STATE_OFF && !s.bypass && p.config.Mode != MODE_ALWAYS_ON_METERED {
+		p.cut()
+	}
+	p.update()
+	Publish(p.bus, StateUpdated{})
+}
+
+// The run gate or stop button changed.
+func (p *Power) onRunGate(e RunGateSensed) {
+	s := p.state
+	switch {
+	case e.Input.Stop && e.Input.On:
+		s.runLatched = false
+	case !e.Input.Stop:
+		s.runGate = e.Input.On
+		if e.Input.On && s.relay {
+			s.runLatched = true
+		}
+	}
+	p.updateRun()
+	Publish(p.bus, StateUpdated{})
+}
+
+// Energizes the run relay iff the standby circuit (the main relay) is on and
+// the gate allows it.
+func (p *Power) updateRun() {
+	if p.config.Run == nil {
+		return
+	}
+	s := p.state
+	if !s.relay {
+		s.runLatched = false
+	}
+	on := s.relay && s.runLatched
+	if p.config.Run.GateType == RUN_GATE_INTERLOCK {
+		on = s.relay && s.runGate
+	}
+	if on == s.running {
+		return
+	}
+	slog.Info("run circuit", slog.Bool("on", on))
+	s.running = on
+	p.runIsOn <- on
+	go p.runRelay.OnEvent(on, p.name, p.publish)
+}
@@ -0,0 +1,76 @@
+package gauthbox
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+)
+
+// Stands for badge IDs while pseudonymizing without a key.
+const BADGE_REDACTED = "redacted"
+
+// Pseudonymization of badge IDs in logs, MQTT and the history, for data
+// minimization. Events stay correlatable through the keyed hash, which only
+// command & control can relate to members.
+type badgePseudonymConfig struct {
+	// Hex-encoded HMAC key. Only honored from command & control: it is dropped
+	// from the local config, and badge IDs are then redacted.
+	Key string `json:"key"`
+}
+
+var pseudonyms = struct {
+	mu      sync.RWMutex
+	enabled bool
+	// Nil while pseudonymizing without a key.
+	key []byte
+}{}
+
+// Enables badge pseudonymization, or disables it if c is nil.
+func SetBadgePseudonyms(c *badgePseudonymConfig) error {
+	var key []byte
+	if c != nil && c.Key != "" {
+		var err error
+		if key, err = hex.DecodeString(c.Key); err != nil {
+			return err
+		}
+	}
+	pseudonyms.mu.Lock()
+	defer pseudonyms.mu.Unlock()
+	pseudonyms.enabled, pseudonyms.key = c != nil, key
+	return nil
+}
+
+// Returns the keyed hash of the badge, nil without a key.
+func badgeHmac(badgeId string) []byte {
+	pseudonyms.mu.RLock()
+	defer pseudonyms.mu.RUnlock()
+	if pseudonyms.key == nil {
+		return nil
+	}
+	m := hmac.New(sha256.New, pseudonyms.key)
+	m.Write([]byte(badgeId))
+	return m.Sum(nil)
+}
+
+// Returns the badge ID as it may be logged or published: itself, unless
+// pseudonymizing.
+func BadgePseudonym(badgeId string) string {
+	pseudonyms.mu.RLock()
+	enabled := pseudonyms.enabled
+	pseudonyms.mu.RUnlock()
+	switch {
+	case !enabled || badgeId == "":
+		return badgeId
+	case badgeHmac(badgeId) == nil:
+		return BADGE_REDACTED
+	default:
+		return BadgeHash(badgeId)
+	}
+}
+
+// Like slog.String, with the badge ID pseudonymized if enabled.
+func BadgeAttr(key, badgeId string) slog.Attr {
+	return slog.String(key, BadgePseudonym(badgeId))
+}
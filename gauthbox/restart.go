@@ -0,0 +1,36 @@
+package gauthbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Returned by RunStateMachine when asked to reload the config. The running
+// session is persisted and its relays left on; the caller should start over
+// with Reexec.
+var ErrReload = errors.New("config reload requested")
+
+// Returned by RunStateMachine when asked to restart. The running session is
+// persisted and its relays left on; systemd restarts the daemon.
+var ErrRestart = errors.New("restart requested")
+
+// Replaces the process with a fresh one of the same executable and arguments,
+// which fetches the config again. Keeps the PID, as systemd expects on reload.
+func Reexec() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(executable, os.Args, os.Environ())
+}
+
+// Reboots the host. systemd then stops the daemon as usual.
+func Reboot() error {
+	if out, err := exec.Command("systemctl", "reboot").CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package gauthbox
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+const RELAY_ROLE_RUN = "run"
+
+// Latches the run circuit on when pressed, until the standby circuit goes off
+// or the stop button is pressed.
+const RUN_GATE_START_BUTTON = "start_button"
+
+// Allows running while closed.
+const RUN_GATE_INTERLOCK = "interlock"
+
+// Two-stage power, for tools with a standby circuit (controls, coolant…) and
+// a run circuit (spindle, motor). The main relay is the standby circuit,
+// energized at badge-in; the run relay is only energized while the standby
+// circuit is on and the gate allows it.
+type runConfig struct {
+	Relay relayConfig `json:"relay"`
+	Gate  inputConfig `json:"gate"`
+	// One of RUN_GATE_*, defaults to a start button.
+	GateType string `json:"gate_type,omitempty"`
+	// Optional, with a start button.
+	Stop *inputConfig `json:"stop,omitempty"`
+}
+
+// Returns the run relay config, with its role.
+func (c runConfig) RelayConfig() relayConfig {
+	r := c.Relay
+	r.Role = RELAY_ROLE_RUN
+	return r
+}
+
+type RunInput struct {
+	// Whether this is the stop button rather than the gate.
+	Stop bool
+	// Pressed, or closed for an interlock.
+	On bool
+}
+
+// Run circuit gate logic. The event stream yields the gate and stop button
+// inputs, starting with the gate state at startup.
+// The looper returns once ctx is done, releasing the inputs.
+// MQTT: registers the gate as a binary sensor.
+func RunGate(ctx context.Context, c runConfig) (*DeviceRet[RunInput], error) {
+	switch c.GateType {
+	case "", RUN_GATE_START_BUTTON, RUN_GATE_INTERLOCK:
+	default:
+		return nil, fmt.Errorf("unknown gate type '%s'", c.GateType)
+	}
+	events := make(chan RunInput)
+	send := func(e RunInput) {
+		select {
+		case events <- e:
+		case <-ctx.Done():
+		}
+	}
+	gate, on, err := Hw.WatchInput(c.Gate, func(high bool) {
+		send(RunInput{On: high})
+	})
+	if err != nil {
+		return nil, err
+	}
+	watches := []io.Closer{gate}
+	if c.Stop != nil {
+		stop, _, err := Hw.WatchInput(*c.Stop, func(high bool) {
+			send(RunInput{Stop: true, On: high})
+		})
+		if err != nil {
+			gate.Close()
+			return nil, fmt.Errorf("stop button: %w", err)
+		}
+		watches = append(watches, stop)
+	}
+	return &DeviceRet[RunInput]{
+		Looper: func() {
+			defer func() {
+				for _, w := range watches {
+					w.Close()
+				}
+			}()
+			send(RunInput{On: on})
+			<-ctx.Done()
+		},
+		Events: stampEvents(events),
+		OnEvent: func(e RunInput, name string, publish PublishFunc) {
+			if !e.Stop {
+				publish(name+"/run_gate", map[bool]string{false: "OFF", true: "ON"}[e.On])
+			}
+		},
+		Discovery: MqttDiscovery{
+			Component: "binary_sensor",
+			Id:        "run_gate",
+			Announce: func(name, topic string) interface{} {
+				return struct {
+					Device     MqttDevice `json:"device"`
+					StateTopic string     `json:"state_topic"`
+				}{
+					Device:     MqttDevice{Name: "Run gate on " + name},
+					StateTopic: topic + "/" + name + "/run_gate",
+				}
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,157 @@
+package gauthbox
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A recurring window of local time.
+type scheduleWindow struct {
+	// Days of the week the window starts on, e.g. ["fri", "sat"]; empty for every day.
+	Days []string `json:"days,omitempty"`
+	// Time of day as "HH:MM". A window ending before it starts ends the next day.
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// Parses "HH:MM" as the duration since midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day '%s', expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
+
+func (w scheduleWindow) onDay(d time.Weekday) bool {
+	return len(w.Days) == 0 || slices.Contains(w.Days, strings.ToLower(d.String()[:3]))
+}
+
+// Validates the time of day and days of the windows.
+func validateSchedule(windows []scheduleWindow) error {
+	for _, w := range windows {
+		if _, err := parseTimeOfDay(w.Start); err != nil {
+			return err
+		}
+		if _, err := parseTimeOfDay(w.End); err != nil {
+			return err
+		}
+		for _, d := range w.Days {
+			if !slices.Contains([]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}, d) {
+				return fmt.Errorf("invalid day '%s', expected mon, tue…", d)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns whether t is within any of the windows, which must be valid.
+func inSchedule(windows []scheduleWindow, t time.Time) bool {
+	now := sinceMidnight(t)
+	for _, w := range windows {
+		start, _ := parseTimeOfDay(w.Start)
+		end, _ := parseTimeOfDay(w.End)
+		switch {
+		case start <= end:
+			if w.onDay(t.Weekday()) && start <= now && now < end {
+				return true
+			}
+		case w.onDay(t.Weekday()) && now >= start:
+			return true
+		case w.onDay(t.AddDate(0, 0, -1).Weekday()) && now < end:
+			return true
+		}
+	}
+	return false
+}
+
+// Returns how long until the next minute, when schedules are checked again.
+func untilNextMinute(t time.Time) time.Duration {
+	return t.Truncate(time.Minute).Add(time.Minute).Sub(t)
+}
+
+// Returns how long until the next local midnight.
+func untilNextDay(t time.Time) time.Duration {
+	y, m, d := t.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, t.Location()).Sub(t)
+}
+
+// Whether schedules wait for the clock to be trusted.
+func scheduleHeld(config *AuthboxConfig, s *State) bool {
+	return config.ScheduleNeedsClock && s.clockProblem != ""
+}
+
+// Starts a session without a badge when a free access window starts, and ends
+// it once the window ends, checking every minute.
+type FreeAccess struct {
+	config *AuthboxConfig
+	state  *State
+	bus    *Bus
+	// Whether within a window, as of the last check.
+	open  bool
+	check *BusTimer
+}
+
+func NewFreeAccess(config *AuthboxConfig, state *State) *FreeAccess {
+	return &FreeAccess{config: config, state: state}
+}
+
+func (f *FreeAccess) Subscribe(bus *Bus) {
+	f.bus = bus
+	f.check = bus.NewTimer(f.onCheck)
+	Subscribe(bus, func(Started) {
+		f.check.Reset(untilNextMinute(Clk.Now()))
+		f.open = inSchedule(f.config.FreeAccess, Clk.Now()) && !scheduleHeld(f.config, f.state)
+		if f.open {
+			f.start()
+		}
+	})
+	Subscribe(bus, func(e ClockTrustChanged) {
+		if e.Problem == "" && f.config.ScheduleNeedsClock && !f.open && inSchedule(f.config.FreeAccess, Clk.Now()) {
+			// Catch up with the held schedule.
+			f.open = true
+			f.start()
+		}
+	})
+}
+
+// A free access window may have started or ended.
+func (f *FreeAccess) onCheck() {
+	f.check.Reset(untilNextMinute(Clk.Now()))
+	if scheduleHeld(f.config, f.state) {
+		return
+	}
+	now := inSchedule(f.config.FreeAccess, Clk.Now())
+	switch {
+	case now && !f.open:
+		f.start()
+	case !now && f.open:
+		f.end()
+	}
+	f.open = now
+}
+
+// Starts a session without a badge for the free access window.
+func (f *FreeAccess) start() {
+	s := f.state
+	if s.state != STATE_OFF || s.lockout != "" || len(s.wiringFaults) > 0 || s.curfewClosed {
+		return
+	}
+	slog.Info("free access window started")
+	Publish(f.bus, StartSession{MemberName: OPEN_ACCESS_MEMBER})
+}
+
+// Ends the open access session, once the machine stops if in use.
+func (f *FreeAccess) end() {
+	slog.Info("free access window ended")
+	if f.state.openAccess {
+		Publish(f.bus, EndSession{Graceful: true})
+	}
+}
@@ -0,0 +1,93 @@
+package gauthbox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInSchedule(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+	// 2024-03-01 is a Friday.
+	at := func(day, hour, min int) time.Time { return time.Date(2024, 3, day, hour, min, 0, 0, paris) }
+	friday := []scheduleWindow{{Days: []string{"fri"}, Start: "18:00", End: "22:00"}}
+	overnight := []scheduleWindow{{Days: []string{"fri", "sat"}, Start: "22:00", End: "02:00"}}
+	tests := []struct {
+		name    string
+		windows []scheduleWindow
+		t       time.Time
+		want    bool
+	}{
+		{"no window", nil, at(1, 19, 0), false},
+		{"before", friday, at(1, 17, 59), false},
+		{"start", friday, at(1, 18, 0), true},
+		{"end", friday, at(1, 22, 0), false},
+		{"another day", friday, at(2, 19, 0), false},
+		{"every day", []scheduleWindow{{Start: "18:00", End: "22:00"}}, at(5, 19, 0), true},
+		{"overnight, evening", overnight, at(1, 23, 0), true},
+		{"overnight, next morning", overnight, at(2, 1, 59), true},
+		{"overnight, end", overnight, at(2, 2, 0), false},
+		{"overnight, starting the day before", overnight, at(3, 1, 0), true},
+		{"overnight, not started the day before", overnight, at(1, 1, 0), false},
+		{"any window", append([]scheduleWindow{{Days: []string{"mon"}, Start: "08:00", End: "09:00"}}, friday...), at(1, 20, 0), true},
+		// Windows follow the wall clock through the DST change of 2024-03-31,
+		// a Sunday, skipping 02:00 to 03:00.
+		{"spring forward, before", []scheduleWindow{{Days: []string{"sun"}, Start: "03:00", End: "04:00"}}, at(31, 1, 59), false},
+		{"spring forward, start", []scheduleWindow{{Days: []string{"sun"}, Start: "03:00", End: "04:00"}}, at(31, 1, 59).Add(time.Minute), true},
+		{"spring forward, overnight", []scheduleWindow{{Days: []string{"sat"}, Start: "22:00", End: "03:00"}}, at(31, 3, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateSchedule(tt.windows); err != nil {
+				t.Fatal(err)
+			}
+			if got := inSchedule(tt.windows, tt.t); got != tt.want {
+				t.Errorf("got %v at %s, want %v", got, tt.t, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	for _, w := range []scheduleWindow{
+		{Start: "18:00", End: "25:00"},
+		{Start: "6pm", End: "22:00"},
+		{Days: []string{"friday"}, Start: "18:00", End: "22:00"},
+	} {
+		if err := validateSchedule([]scheduleWindow{w}); err == nil {
+			t.Errorf("%+v is valid", w)
+		}
+	}
+}
+
+func TestFreeAccessHandler(t *testing.T) {
+	advanceToTimeOfDay(17*time.Hour + 58*time.Minute)
+	config := &AuthboxConfig{FreeAccess: []scheduleWindow{{Start: "18:00", End: "19:00"}}}
+	state := &State{state: STATE_OFF}
+	bus := NewBus()
+	var started, ended []time.Time
+	Subscribe(bus, func(e StartSession) {
+		started = append(started, testClock.Now())
+		state.state, state.openAccess = STATE_IDLE, e.BadgeId == ""
+	})
+	Subscribe(bus, func(e EndSession) {
+		ended = append(ended, testClock.Now())
+		state.state, state.openAccess = STATE_OFF, false
+	})
+	access := NewFreeAccess(config, state)
+	access.Subscribe(bus)
+	Publish(bus, Started{})
+	defer access.check.Stop()
+	for range 63 {
+		testClock.Advance(time.Minute)
+		bus.RunTimers()
+	}
+	if len(started) != 1 || sinceMidnight(started[0]) != 18*time.Hour {
+		t.Errorf("started at %v, want 18:00", started)
+	}
+	if len(ended) != 1 || sinceMidnight(ended[0]) != 19*time.Hour {
+		t.Errorf("ended at %v, want 19:00", ended)
+	}
+}
@@ -0,0 +1,67 @@
+package gauthbox
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Sends a message to systemd notify socket, see sd_notify(3). Returns false
+// when not run by systemd.
+func sdNotify(state string) (bool, error) {
+	socketAddr := &net.UnixAddr{
+		Name: os.Getenv("NOTIFY_SOCKET"),
+		Net:  "unixgram",
+	}
+	if socketAddr.Name == "" {
+		return false, nil
+	}
+	conn, err := net.DialUnix(socketAddr.Net, nil, socketAddr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Tells systemd the daemon is started.
+func SdNotifyReady() (bool, error) {
+	return sdNotify("READY=1")
+}
+
+// Tells systemd the daemon is shutting down.
+func SdNotifyStopping() (bool, error) {
+	return sdNotify("STOPPING=1")
+}
+
+// Tells systemd the daemon is reloading; it is ready again once the new
+// process sends READY=1.
+func SdNotifyReloading() (bool, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return false, err
+	}
+	return sdNotify(fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", ts.Nano()/1000))
+}
+
+// Sets the status shown by 'systemctl status'.
+func SdNotifyStatus(status string) (bool, error) {
+	return sdNotify("STATUS=" + status)
+}
+
+// Keeps the systemd watchdog from restarting the daemon.
+func SdNotifyWatchdog() (bool, error) {
+	return sdNotify("WATCHDOG=1")
+}
+
+// Asks systemd for that long from now before timing out starting, reloading
+// or stopping, e.g. while waiting for slow hardware.
+func SdNotifyExtendTimeout(d time.Duration) (bool, error) {
+	return sdNotify(fmt.Sprintf("EXTEND_TIMEOUT_USEC=%d", d.Microseconds()))
+}
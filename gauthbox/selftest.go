@@ -0,0 +1,192 @@
+package gauthbox
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// How long the self-test waits for the operator to make something happen,
+// e.g. scan a badge.
+const SELFTEST_TIMEOUT = 30 * time.Second
+
+// Outcome of a self-test step.
+type selfTestResult struct {
+	Device string
+	// Why it failed, empty otherwise.
+	Failure string
+	Skipped bool
+	Detail  string
+}
+
+// Commissioning self-test, for installing a new box: exercises every
+// configured device, asking the operator on 'in' to confirm what can only be
+// seen or heard, and prints a pass/fail report to 'out'. Relays are only
+// switched once the operator agreed. Returns whether all steps passed.
+func SelfTest(c *AuthboxConfig, in io.Reader, out io.Writer) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if c.Logging != nil {
+		// The results are reported like logs.
+		if err := SetBadgePseudonyms(c.Logging.BadgePseudonyms); err != nil {
+			fmt.Fprintf(out, "badge pseudonyms: %s\n", err)
+		}
+	}
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			lines <- strings.TrimSpace(scanner.Text())
+		}
+		close(lines)
+	}()
+	ask := func(question string) bool {
+		fmt.Fprintf(out, "%s [y/N] ", question)
+		answer := <-lines
+		return strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes")
+	}
+
+	results := []selfTestResult{}
+	pass := func(device, detail string) {
+		results = append(results, selfTestResult{Device: device, Detail: detail})
+	}
+	fail := func(device string, format string, args ...any) {
+		results = append(results, selfTestResult{Device: device, Failure: fmt.Sprintf(format, args...)})
+	}
+	skip := func(device, why string) {
+		results = append(results, selfTestResult{Device: device, Skipped: true, Detail: why})
+	}
+
+	// Blinks the output a few times, then asks whether it was seen or heard.
+	blink := func(device string, c ledConfig, question string) {
+		line, err := Hw.RequestOutput(c.Pin, rawValue(c.ActiveLow, false))
+		if err != nil {
+			fail(device, "%s", err)
+			return
+		}
+		fmt.Fprintf(out, "%s: blinking %s\n", device, c.Pin)
+		for i := 0; i < 6; i++ {
+			setLineValue(c.ActiveLow, line, i%2 == 0)
+			time.Sleep(300 * time.Millisecond)
+		}
+		setLineValue(c.ActiveLow, line, false)
+		if ask(question) {
+			pass(device, "confirmed by the operator")
+		} else {
+			fail(device, "not confirmed by the operator")
+		}
+	}
+	blink("green_led", c.GreenLed, "Did the green LED blink 3 times?")
+	blink("red_led", c.RedLed, "Did the red LED blink 3 times?")
+	if c.Buzzer != nil {
+		blink("buzzer", *c.Buzzer, "Did the buzzer beep 3 times?")
+	}
+
+	// Opens a relay, off, for the steps below.
+	openRelay := func(r relayConfig) (OutputLine, error) {
+		return Hw.RequestOutput(r.Pin, rawValue(r.ActiveLow, false))
+	}
+	relays := c.Relays()
+	if c.Run != nil {
+		relays = append(relays, c.Run.RelayConfig())
+	}
+	machineRelay := OutputLine(nil)
+	for _, r := range relays {
+		id := relayId(r)
+		line, err := openRelay(r)
+		if err != nil {
+			fail(id, "%s", err)
+			continue
+		}
+		if id == "relay" {
+			machineRelay = line
+		}
+		if !ask(fmt.Sprintf("Pulse %s on %s for 1s? Whatever it powers will start.", id, r.Pin)) {
+			skip(id, "declined by the operator")
+			continue
+		}
+		setLineValue(r.ActiveLow, line, true)
+		time.Sleep(time.Second)
+		setLineValue(r.ActiveLow, line, false)
+		if ask(fmt.Sprintf("Did %s click on then off?", id)) {
+			pass(id, "confirmed by the operator")
+		} else {
+			fail(id, "not confirmed by the operator")
+		}
+	}
+
+	current, err := CurrentSensing(ctx, c.CurrentSensing)
+	switch {
+	case err != nil:
+		fail("current_sensing", "%s", err)
+	case machineRelay == nil || !ask("Switch the machine relay on to test current sensing? Start the machine then."):
+		skip("current_sensing", "machine relay not switched on")
+	default:
+		go current.Looper()
+		setLineValue(c.Relay.ActiveLow, machineRelay, true)
+		fmt.Fprintf(out, "current_sensing: start the machine within %s\n", SELFTEST_TIMEOUT)
+		timeout := time.After(SELFTEST_TIMEOUT)
+	wait:
+		for {
+			select {
+			case e := <-current.Events:
+				if e.Payload {
+					pass("current_sensing", "current detected")
+					break wait
+				}
+			case <-timeout:
+				fail("current_sensing", "no current detected within %s", SELFTEST_TIMEOUT)
+				break wait
+			}
+		}
+		setLineValue(c.Relay.ActiveLow, machineRelay, false)
+	}
+
+	badge, err := BadgeReader(ctx, c.BadgeReader)
+	if err != nil {
+		fail("badge_reader", "%s", err)
+	} else {
+		go badge.Looper()
+		fmt.Fprintf(out, "badge_reader: scan a badge within %s\n", SELFTEST_TIMEOUT)
+		select {
+		case e := <-badge.Events:
+			pass("badge_reader", "read badge "+BadgePseudonym(e.Payload))
+		case <-time.After(SELFTEST_TIMEOUT):
+			fail("badge_reader", "no badge read within %s", SELFTEST_TIMEOUT)
+		}
+	}
+
+	if c.DoorContact != nil {
+		door, err := DoorContact(ctx, *c.DoorContact)
+		if err != nil {
+			fail("door_contact", "%s", err)
+		} else {
+			go door.Looper()
+			select {
+			case e := <-door.Events:
+				pass("door_contact", map[bool]string{false: "open", true: "closed"}[e.Payload])
+			case <-time.After(time.Second):
+				fail("door_contact", "no reading")
+			}
+		}
+	}
+	CloseGpio()
+
+	fmt.Fprintln(out, "\nself-test report:")
+	ok := true
+	for _, r := range results {
+		switch {
+		case r.Skipped:
+			fmt.Fprintf(out, "  SKIP %-16s %s\n", r.Device, r.Detail)
+		case r.Failure != "":
+			ok = false
+			fmt.Fprintf(out, "  FAIL %-16s %s\n", r.Device, r.Failure)
+		default:
+			fmt.Fprintf(out, "  PASS %-16s %s\n", r.Device, r.Detail)
+		}
+	}
+	return ok
+}
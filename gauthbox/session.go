@@ -0,0 +1,251 @@
+package gauthbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// State file holding the running session, so it survives daemon restarts.
+const SESSION_STATE_FILE = "session.json"
+
+// How long posting a session summary to the webhook may take.
+const SESSION_WEBHOOK_TIMEOUT = 10 * time.Second
+
+// Random ID of the current boot, as exposed by the kernel.
+const BOOT_ID_FILE = "/proc/sys/kernel/random/boot_id"
+
+// A persisted session is only resumed if saved during the same boot and that
+// recently, so that the machine does not power up by itself after a power cut,
+// a reboot or a long downtime.
+const SESSION_RESTORE_MAX_AGE = 5 * time.Minute
+
+// How often the running session is persisted again, to stay recent enough.
+const SESSION_REFRESH_INTERVAL = 2 * time.Minute
+
+// A session as persisted to disk. Deadlines are absolute so the time spent
+// restarting counts.
+type persistedSession struct {
+	BadgeId    string    `json:"badge_id"`
+	MemberName string    `json:"member_name,omitempty"`
+	InUse      bool      `json:"in_use"`
+	SessionId  string    `json:"session_id,omitempty"`
+	Start      time.Time `json:"start"`
+	// Idle timeout override, zero for the default.
+	IdleSeconds uint32 `json:"idle_duration_s,omitempty"`
+	// Zero when not running.
+	IdleDeadline    time.Time `json:"idle_deadline"`
+	ExtendDeadline  time.Time `json:"extend_deadline"`
+	SessionDeadline time.Time `json:"session_deadline"`
+	// Boot during which, and when, the session was persisted.
+	BootId string    `json:"boot_id"`
+	Saved  time.Time `json:"saved"`
+}
+
+// Returns the ID of the current boot, empty if unknown.
+func bootId() string {
+	b, err := os.ReadFile(BOOT_ID_FILE)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// Returns the persisted session if it may be resumed as of now, nil if there is
+// none. A session that may not is cleared, and 'stale' is then true.
+func loadSession(now time.Time) (s *persistedSession, stale bool) {
+	b, err := os.ReadFile(StatePath(SESSION_STATE_FILE))
+	if err != nil {
+		return nil, false
+	}
+	s = &persistedSession{}
+	reason := ""
+	switch boot := bootId(); {
+	case json.Unmarshal(b, s) != nil:
+		reason = "unreadable"
+	case s.BadgeId == "":
+		// No session, or an open access one, which resumes with its window.
+		return nil, false
+	case boot == "" || s.BootId != boot:
+		reason = "saved before a reboot"
+	case now.Sub(s.Saved) > SESSION_RESTORE_MAX_AGE || now.Before(s.Saved):
+		reason = "too old"
+	default:
+		return s, false
+	}
+	slog.Warn("not restoring the persisted session", slog.String("reason", reason), slog.Time("saved", s.Saved))
+	if err := saveSession(nil, now); err != nil {
+		slog.Warn("could not clear persisted session", slog.Any("err", err))
+	}
+	return nil, true
+}
+
+// Persists the session as of now, or clears it if nil.
+func saveSession(s *persistedSession, now time.Time) error {
+	if s == nil {
+		if err := os.Remove(StatePath(SESSION_STATE_FILE)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	saved := *s
+	saved.BootId, saved.Saved = bootId(), now
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return writeStateFile(SESSION_STATE_FILE, b)
+}
+
+// Persists the running session as it changes, and every
+// SESSION_REFRESH_INTERVAL to keep it recent enough to be restored.
+type SessionStore struct {
+	state *State
+	// The session as last persisted, nil if none.
+	persisted *persistedSession
+	refresh   *BusTimer
+}
+
+func NewSessionStore(state *State) *SessionStore {
+	return &SessionStore{state: state}
+}
+
+func (st *SessionStore) Subscribe(bus *Bus) {
+	st.refresh = bus.NewTimer(func() {
+		st.refresh.Reset(SESSION_REFRESH_INTERVAL)
+		if st.state.state != STATE_OFF {
+			st.Save(true)
+		}
+	})
+	Subscribe(bus, func(Started) { st.refresh.Reset(SESSION_REFRESH_INTERVAL) })
+	Subscribe(bus, func(StateChanged) { st.Save(false) })
+	Subscribe(bus, func(e SessionEnded) {
+		if !e.Exiting {
+			return
+		}
+		if err := saveSession(nil, Clk.Now()); err != nil {
+			slog.Warn("could not clear persisted session", slog.Any("err", err))
+		}
+		st.persisted = nil
+	})
+}
+
+// Persists the session if what it takes to restore it changed, or anyway if
+// refresh.
+func (st *SessionStore) Save(refresh bool) {
+	s := st.state
+	var p *persistedSession
+	if s.state != STATE_OFF {
+		p = &persistedSession{
+			BadgeId:         s.badgeId,
+			MemberName:      s.memberName,
+			InUse:           s.state == STATE_IN_USE,
+			SessionId:       s.sessionId,
+			Start:           s.sessionStart,
+			IdleSeconds:     uint32(s.idleOverride.Seconds()),
+			IdleDeadline:    s.idleDeadline,
+			ExtendDeadline:  s.extendDeadline,
+			SessionDeadline: s.sessionDeadline,
+		}
+	}
+	if !refresh && (p == nil) == (st.persisted == nil) && (p == nil || *p == *st.persisted) {
+		return
+	}
+	if err := saveSession(p, Clk.Now()); err != nil {
+		slog.Warn("could not persist session", slog.Any("err", err))
+		return
+	}
+	st.persisted = p
+}
+
+// Summary of a finished session, emitted when it ends or is handed over.
+type SessionSummary struct {
+	// Hashed so the summary can be shared without leaking badge IDs.
+	// Empty for open access sessions.
+	BadgeHash  string    `json:"badge_hash,omitempty"`
+	OpenAccess bool      `json:"open_access,omitempty"`
+	SessionId  string    `json:"session_id,omitempty"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	// Time spent in use and idle.
+	ActiveSeconds int `json:"active_seconds"`
+	IdleSeconds   int `json:"idle_seconds"`
+	// How many times the machine went in use.
+	Cycles int `json:"cycles"`
+}
+
+// Returns a new random session identifier.
+func NewSessionId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Returns a stable identifier of the badge that does not disclose its ID. Keyed
+// if pseudonymizing badges with a key, see SetBadgePseudonyms.
+func BadgeHash(badgeId string) string {
+	if h := badgeHmac(badgeId); h != nil {
+		return hex.EncodeToString(h[:8])
+	}
+	h := sha256.Sum256([]byte(badgeId))
+	return hex.EncodeToString(h[:8])
+}
+
+// Logs the finished sessions and emits their summary to MQTT and the webhook, if any.
+func SessionSummaryHandler(name string, webhook string, publish PublishFunc) func(SessionSummary) {
+	return func(s SessionSummary) {
+		slog.Info("session summary", slog.Any("summary", s))
+		go PublishSessionSummary(s, name, publish)
+		if webhook == "" {
+			return
+		}
+		go func() {
+			if err := PostSessionSummary(webhook, s); err != nil {
+				slog.Warn("could not post session summary", slog.Any("err", err))
+			}
+		}()
+	}
+}
+
+// Publishes the session summary to MQTT.
+func PublishSessionSummary(s SessionSummary, name string, publish PublishFunc) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		slog.Error("could not marshal session summary", slog.Any("err", err))
+		return
+	}
+	publish(name+"/session", string(b))
+}
+
+// Posts the session summary as JSON to the webhook.
+func PostSessionSummary(url string, s SessionSummary) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), SESSION_WEBHOOK_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("session webhook: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package gauthbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const SIMULATION_HELP = `commands:
+  badge <id>            scan a badge
+  current on|off        machine draws current or not
+  door open|closed      door contact
+  pin <pin> 0|1         set any input pin, e.g. 'pin 17 1' or 'pin chip:gpio-mockup:3 0'
+  help`
+
+// Replaces the hardware with in-memory mocks and disables the devices that
+// cannot be simulated (I2C/SPI/1-Wire), so the state machine runs on any machine.
+func PrepareSimulation(c *AuthboxConfig) *MockHardware {
+	hw := NewMockHardware()
+	Hw = hw
+	if c.CurrentSensing.Driver != CURRENT_DRIVER_GPIO && c.CurrentSensing.Driver != "" {
+		slog.Info("simulation: current sensing replaced by a gpio input", slog.String("pin", c.CurrentSensing.Pin.String()))
+		c.CurrentSensing.Driver = CURRENT_DRIVER_GPIO
+	}
+	c.Expanders, c.Display, c.Eink, c.Temperatures, c.Heartbeat = nil, nil, nil, nil, nil
+	if StateDir == "" {
+		StateDir = filepath.Join(os.TempDir(), "gauthbox-simulation")
+		os.MkdirAll(StateDir, 0o700)
+	}
+	return hw
+}
+
+// Interactive console driving the simulated inputs from 'in' and printing the
+// outputs, named after their role in the config, to 'out'. Returns at EOF.
+func (h *MockHardware) RunConsole(c *AuthboxConfig, in io.Reader, out io.Writer) {
+	names := map[string]string{
+		c.GreenLed.Pin.String(): "green led",
+		c.RedLed.Pin.String():   "red led",
+	}
+	if c.Buzzer != nil {
+		names[c.Buzzer.Pin.String()] = "buzzer"
+	}
+	for _, r := range c.Relays() {
+		names[r.Pin.String()] = relayId(r)
+	}
+	if c.Run != nil {
+		names[c.Run.Relay.Pin.String()] = relayId(c.Run.RelayConfig())
+	}
+	h.OnOutput = func(name string, value int) {
+		if n, ok := names[name]; ok {
+			name = n
+		}
+		fmt.Fprintf(out, "  %s = %d\n", name, value)
+	}
+	fmt.Fprintln(out, SIMULATION_HELP)
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		var err error
+		switch {
+		case args[0] == "badge" && len(args) == 2:
+			err = h.TypeBadge(args[1])
+		case args[0] == "current" && len(args) == 2:
+			h.SetInput(c.CurrentSensing.Pin, args[1] == "on")
+		case args[0] == "door" && len(args) == 2 && c.DoorContact != nil:
+			h.SetInput(c.DoorContact.Pin, args[1] == "closed")
+		case args[0] == "pin" && len(args) == 3:
+			var p Pin
+			if err = json.Unmarshal([]byte(args[1]), &p); err != nil {
+				err = json.Unmarshal([]byte(`"`+args[1]+`"`), &p)
+			}
+			if err == nil {
+				h.SetInput(p, args[2] == "1")
+			}
+		default:
+			fmt.Fprintln(out, SIMULATION_HELP)
+		}
+		if err != nil {
+			fmt.Fprintf(out, "error: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package gauthbox
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// From linux/spi/spidev.h.
+const SPI_IOC_WR_MODE = 0x40016b01
+const SPI_IOC_WR_MAX_SPEED_HZ = 0x40046b04
+const SPI_IOC_MESSAGE_1 = 0x40206b00
+
+// Mirrors struct spi_ioc_transfer.
+type spiIocTransfer struct {
+	txBuf       uint64
+	rxBuf       uint64
+	len         uint32
+	speedHz     uint32
+	delayUsecs  uint16
+	bitsPerWord uint8
+	csChange    uint8
+	txNbits     uint8
+	rxNbits     uint8
+	wordDelay   uint8
+	pad         uint8
+}
+
+// A device on a SPI bus, addressed through /dev/spidev<bus>.<cs>.
+type spiDevice struct {
+	f       *os.File
+	speedHz uint32
+}
+
+// Opens the SPI device on the given bus and chip select, in mode 0.
+func openSpiDevice(bus, cs int, speedHz uint32) (*spiDevice, error) {
+	f, err := os.OpenFile(fmt.Sprintf("/dev/spidev%d.%d", bus, cs), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	mode := uint8(0)
+	if err := spiIoctl(f, SPI_IOC_WR_MODE, unsafe.Pointer(&mode)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := spiIoctl(f, SPI_IOC_WR_MAX_SPEED_HZ, unsafe.Pointer(&speedHz)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &spiDevice{f: f, speedHz: speedHz}, nil
+}
+
+// Full-duplex transfer: writes w while reading into r, which must be the same
+// length as w if non-nil.
+func (d *spiDevice) Tx(w, r []byte) error {
+	if len(w) == 0 {
+		return nil
+	}
+	tr := spiIocTransfer{
+		txBuf:       uint64(uintptr(unsafe.Pointer(&w[0]))),
+		len:         uint32(len(w)),
+		speedHz:     d.speedHz,
+		bitsPerWord: 8,
+	}
+	if r != nil {
+		tr.rxBuf = uint64(uintptr(unsafe.Pointer(&r[0])))
+	}
+	err := spiIoctl(d.f, SPI_IOC_MESSAGE_1, unsafe.Pointer(&tr))
+	runtime.KeepAlive(w)
+	runtime.KeepAlive(r)
+	return err
+}
+
+func (d *spiDevice) Close() error {
+	return d.f.Close()
+}
+
+func spiIoctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
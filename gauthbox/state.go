@@ -0,0 +1,32 @@
+package gauthbox
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Used when not run by systemd with StateDirectory=.
+const DEFAULT_STATE_DIRECTORY = "/var/lib/authbox"
+
+// Persistent state directory, as set by systemd with StateDirectory=.
+// Empty for DEFAULT_STATE_DIRECTORY.
+var StateDir = os.Getenv("STATE_DIRECTORY")
+
+// Returns the path of the named file in the persistent state directory.
+func StatePath(name string) string {
+	dir := StateDir
+	if dir == "" {
+		dir = DEFAULT_STATE_DIRECTORY
+	}
+	return filepath.Join(dir, name)
+}
+
+// Atomically replaces the named state file.
+func writeStateFile(name string, data []byte) error {
+	path := StatePath(name)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,138 @@
+package gauthbox
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const TACHOMETER_DEFAULT_INTERVAL = time.Second
+
+// Switching back to not in use below that fraction of the threshold.
+const TACHOMETER_HYSTERESIS_RATIO = 0.8
+
+type tachometerConfig struct {
+	inputConfig
+	// Short identifier, e.g. "spindle".
+	Id string `json:"id"`
+	// E.g. the number of magnets or reflective marks. Defaults to 1.
+	PulsesPerRevolution uint32 `json:"pulses_per_revolution,omitempty"`
+	IntervalMs          uint32 `json:"interval_ms,omitempty"`
+	// Above that rate, the machine is in use regardless of its current draw.
+	// Zero to only report the rate.
+	InUseRpm float64 `json:"in_use_rpm,omitempty"`
+}
+
+type TachometerReading struct {
+	Id  string
+	Rpm float64
+	// Pulses counted since startup.
+	Count uint64
+	// Above the in use threshold, until it drops below the threshold minus the hysteresis.
+	InUse bool
+}
+
+// Pulse counting logic, for spindle RPM or cycle counts. Counts rising edges and
+// yields a reading every interval. The looper returns once ctx is done,
+// releasing the input.
+// MQTT: registers as a sensor; the raw pulse count is published on the
+// '<id>/count' subtopic, see TachometerCountDiscovery.
+func Tachometer(ctx context.Context, c tachometerConfig) (*DeviceRet[TachometerReading], error) {
+	var count atomic.Uint64
+	watch, _, err := Hw.WatchInput(c.inputConfig, func(high bool) {
+		if high {
+			count.Add(1)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Duration(c.IntervalMs) * time.Millisecond
+	if interval == 0 {
+		interval = TACHOMETER_DEFAULT_INTERVAL
+	}
+	ppr := c.PulsesPerRevolution
+	if ppr == 0 {
+		ppr = 1
+	}
+	events := make(chan TachometerReading)
+	looper := func() {
+		defer watch.Close()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		alive := time.NewTicker(LIVENESS_INTERVAL)
+		defer alive.Stop()
+		Beat("tachometer_" + c.Id)
+		last, lastAt := count.Load(), time.Now()
+		inUse := false
+		for {
+			var now time.Time
+			select {
+			case now = <-ticker.C:
+			case <-alive.C:
+				Beat("tachometer_" + c.Id)
+				continue
+			case <-ctx.Done():
+				return
+			}
+			n := count.Load()
+			rpm := float64(n-last) / float64(ppr) / now.Sub(lastAt).Minutes()
+			last, lastAt = n, now
+			if c.InUseRpm != 0 {
+				if !inUse && rpm > c.InUseRpm {
+					inUse = true
+				} else if inUse && rpm < c.InUseRpm*TACHOMETER_HYSTERESIS_RATIO {
+					inUse = false
+				}
+			}
+			select {
+			case events <- TachometerReading{Id: c.Id, Rpm: rpm, Count: n, InUse: inUse}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+	return &DeviceRet[TachometerReading]{
+		Looper: looper,
+		Events: stampEvents(events),
+		OnEvent: func(r TachometerReading, name string, publish PublishFunc) {
+			publish(name+"/tachometer/"+r.Id, strconv.FormatFloat(r.Rpm, 'f', 0, 64))
+			publish(name+"/tachometer/"+r.Id+"/count", strconv.FormatUint(r.Count, 10))
+		},
+		Discovery: MqttDiscovery{
+			Component: "sensor",
+			Id:        "tachometer_" + c.Id,
+			Announce: func(name, topic string) interface{} {
+				return struct {
+					Device     MqttDevice `json:"device"`
+					StateTopic string     `json:"state_topic"`
+					Unit       string     `json:"unit_of_measurement"`
+				}{
+					Device:     MqttDevice{Name: "Speed (" + c.Id + ") on " + name},
+					StateTopic: topic + "/" + name + "/tachometer/" + c.Id,
+					Unit:       "rpm",
+				}
+			},
+		},
+	}, nil
+}
+
+// MQTT: the pulse count of the tachometer, e.g. machine cycles, as a sensor.
+func TachometerCountDiscovery(c tachometerConfig) MqttDiscovery {
+	return MqttDiscovery{
+		Component: "sensor",
+		Id:        "tachometer_" + c.Id + "_count",
+		Announce: func(name, topic string) interface{} {
+			return struct {
+				Device     MqttDevice `json:"device"`
+				StateClass string     `json:"state_class"`
+				StateTopic string     `json:"state_topic"`
+			}{
+				Device:     MqttDevice{Name: "Count (" + c.Id + ") on " + name},
+				StateClass: "total_increasing",
+				StateTopic: topic + "/" + name + "/tachometer/" + c.Id + "/count",
+			}
+		},
+	}
+}
@@ -0,0 +1,270 @@
+package gauthbox
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const TEMPERATURE_DRIVER_LM75 = "lm75"
+const TEMPERATURE_DRIVER_DS18B20 = "ds18b20"
+
+const W1_DEVICES = "/sys/bus/w1/devices"
+
+const TEMPERATURE_ACTION_ALARM = "alarm"
+const TEMPERATURE_ACTION_OFF = "off"
+
+const TEMPERATURE_DEFAULT_INTERVAL = 10 * time.Second
+const TEMPERATURE_DEFAULT_HYSTERESIS = 2.0
+
+// Consecutive read failures after which a sensor with a threshold is considered
+// over temperature, so that a broken sensor does not disable the cutoff.
+const TEMPERATURE_MAX_READ_FAILURES = 3
+
+type temperatureConfig struct {
+	// Short identifier, e.g. "spindle" or "enclosure".
+	Id string `json:"id"`
+	// One of TEMPERATURE_DRIVER_*.
+	Driver  string `json:"driver"`
+	I2cBus  int    `json:"i2c_bus,omitempty"`
+	Address uint16 `json:"address,omitempty"`
+	// 1-Wire device ID, e.g. "28-0316a2790aff". Defaults to the only DS18B20 on the bus.
+	W1Id      string `json:"w1_id,omitempty"`
+	IntervalS uint32 `json:"interval_s,omitempty"`
+	// Zero disables the threshold.
+	MaxCelsius        float64 `json:"max_celsius,omitempty"`
+	HysteresisCelsius float64 `json:"hysteresis_celsius,omitempty"`
+	// One of TEMPERATURE_ACTION_*, applied above MaxCelsius.
+	OverAction string `json:"over_action,omitempty"`
+}
+
+type TemperatureReading struct {
+	Id      string
+	Celsius float64
+	// Above the threshold, until it drops below the threshold minus the hysteresis.
+	Over bool
+	// Over, and the configured action is to power off.
+	Cutoff bool
+	// The sensor could not be read TEMPERATURE_MAX_READ_FAILURES times in a row,
+	// Celsius is meaningless.
+	Failed bool
+}
+
+// Whether a sensor is over its threshold, failing closed.
+type temperatureThreshold struct {
+	c          temperatureConfig
+	hysteresis float64
+	over       bool
+	// Consecutive read failures.
+	failures int
+}
+
+// Returns the reading for the outcome of reading the sensor, and whether
+// there is one to report: not for the first failures in a row.
+func (t *temperatureThreshold) update(celsius float64, err error) (TemperatureReading, bool) {
+	if err != nil {
+		t.failures++
+		slog.Warn("temperature: could not read sensor", slog.String("id", t.c.Id), slog.Int("failures", t.failures), slog.Any("err", err))
+		if t.failures < TEMPERATURE_MAX_READ_FAILURES || t.c.MaxCelsius == 0 {
+			return TemperatureReading{}, false
+		}
+		if !t.over {
+			t.over = true
+			slog.Error("temperature: sensor unreadable, considering it over threshold", slog.String("id", t.c.Id))
+		}
+		return TemperatureReading{Id: t.c.Id, Over: true, Cutoff: t.c.OverAction == TEMPERATURE_ACTION_OFF, Failed: true}, true
+	}
+	if t.failures >= TEMPERATURE_MAX_READ_FAILURES {
+		slog.Info("temperature: sensor readable again", slog.String("id", t.c.Id))
+		// Only the readings tell whether it is over.
+		t.over = false
+	}
+	t.failures = 0
+	if t.c.MaxCelsius != 0 {
+		if !t.over && celsius > t.c.MaxCelsius {
+			t.over = true
+			slog.Warn("temperature: over threshold", slog.String("id", t.c.Id), slog.Float64("celsius", celsius))
+		} else if t.over && celsius < t.c.MaxCelsius-t.hysteresis {
+			t.over = false
+			slog.Info("temperature: back under threshold", slog.String("id", t.c.Id), slog.Float64("celsius", celsius))
+		}
+	}
+	return TemperatureReading{
+		Id:      t.c.Id,
+		Celsius: celsius,
+		Over:    t.over,
+		Cutoff:  t.over && t.c.OverAction == TEMPERATURE_ACTION_OFF,
+	}, true
+}
+
+// Temperature sensor logic. The event stream yields a reading every interval.
+// A sensor with a threshold that cannot be read is reported over temperature.
+// The looper returns once ctx is done.
+// MQTT: registers as a sensor with a 'temperature' device class.
+func TemperatureSensor(ctx context.Context, c temperatureConfig) (*DeviceRet[TemperatureReading], error) {
+	read, err := temperatureReader(c)
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Duration(c.IntervalS) * time.Second
+	if interval == 0 {
+		interval = TEMPERATURE_DEFAULT_INTERVAL
+	}
+	hysteresis := c.HysteresisCelsius
+	if hysteresis == 0 {
+		hysteresis = TEMPERATURE_DEFAULT_HYSTERESIS
+	}
+	events := make(chan TemperatureReading)
+	looper := func() {
+		threshold := temperatureThreshold{c: c, hysteresis: hysteresis}
+		// A sensor read that hangs, e.g. on the 1-Wire bus, wedges the looper.
+		alive := time.NewTicker(LIVENESS_INTERVAL)
+		defer alive.Stop()
+		for {
+			Beat("temperature_" + c.Id)
+			if r, ok := threshold.update(read()); ok {
+				select {
+				case events <- r:
+				case <-ctx.Done():
+					return
+				}
+			}
+			next := time.After(interval)
+			for waiting := true; waiting; {
+				select {
+				case <-next:
+					waiting = false
+				case <-alive.C:
+					Beat("temperature_" + c.Id)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+	return &DeviceRet[TemperatureReading]{
+		Looper: looper,
+		Events: stampEvents(events),
+		OnEvent: func(r TemperatureReading, name string, publish PublishFunc) {
+			if r.Failed {
+				return
+			}
+			publish(name+"/temperature/"+r.Id, strconv.FormatFloat(r.Celsius, 'f', 1, 64))
+		},
+		Discovery: MqttDiscovery{
+			Component: "sensor",
+			Id:        "temperature_" + c.Id,
+			Announce: func(name, topic string) interface{} {
+				return struct {
+					Device      MqttDevice `json:"device"`
+					DeviceClass string     `json:"device_class"`
+					StateTopic  string     `json:"state_topic"`
+					Unit        string     `json:"unit_of_measurement"`
+				}{
+					Device:      MqttDevice{Name: "Temperature (" + c.Id + ") on " + name},
+					DeviceClass: "temperature",
+					StateTopic:  topic + "/" + name + "/temperature/" + c.Id,
+					Unit:        "°C",
+				}
+			},
+		},
+	}, nil
+}
+
+// Returns a function reading the current temperature in Celsius from the configured driver.
+func temperatureReader(c temperatureConfig) (func() (float64, error), error) {
+	switch c.Driver {
+	case TEMPERATURE_DRIVER_LM75:
+		if c.Address == 0 {
+			c.Address = 0x48
+		}
+		dev, err := openI2cDevice(c.I2cBus, c.Address)
+		if err != nil {
+			return nil, err
+		}
+		return func() (float64, error) {
+			// Also works for TMP102 & co: left-aligned two's complement, 1/16 °C resolution.
+			b := make([]byte, 2)
+			if err := dev.ReadRegister(0x00, b); err != nil {
+				return 0, err
+			}
+			return float64(int16(uint16(b[0])<<8|uint16(b[1]))>>4) * 0.0625, nil
+		}, nil
+	case TEMPERATURE_DRIVER_DS18B20:
+		if c.W1Id == "" {
+			// DS18B20 family code.
+			ids, err := filepath.Glob(W1_DEVICES + "/28-*")
+			if err != nil {
+				return nil, err
+			}
+			if len(ids) != 1 {
+				return nil, fmt.Errorf("found %d DS18B20 on the 1-Wire bus, set 'w1_id'", len(ids))
+			}
+			c.W1Id = filepath.Base(ids[0])
+		}
+		path := filepath.Join(W1_DEVICES, c.W1Id, "temperature")
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+		return func() (float64, error) {
+			// Millidegrees; the kernel does the CRC check and conversion wait.
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return 0, err
+			}
+			milli, err := strconv.Atoi(strings.TrimSpace(string(b)))
+			if err != nil {
+				return 0, err
+			}
+			return float64(milli) / 1000, nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown temperature driver '%s'", c.Driver)
+	}
+}
+
+// Follows the temperature readings: alarms over temperature, and powers off
+// unless the machine is in use. Owns the overheated field of the state.
+type Temperatures struct {
+	state *State
+	bus   *Bus
+}
+
+func NewTemperatures(state *State) *Temperatures {
+	return &Temperatures{state: state}
+}
+
+func (t *Temperatures) Subscribe(bus *Bus) {
+	t.bus = bus
+	Subscribe(bus, t.onReading)
+}
+
+func (t *Temperatures) onReading(e TemperatureRead) {
+	s, r := t.state, e.Reading
+	previous, wasOver := s.overheated[r.Id]
+	if !r.Over {
+		if wasOver {
+			delete(s.overheated, r.Id)
+			Publish(t.bus, StateUpdated{})
+		}
+		return
+	}
+	if wasOver && r.Cutoff == previous.Cutoff && r.Failed == previous.Failed {
+		return
+	}
+	// Over temperature, or still over with another status (e.g. the sensor
+	// failed): alarm, and power off unless the machine is in use.
+	s.overheated[r.Id] = r
+	if r.Failed && !previous.Failed {
+		Publish(t.bus, AlertRaised{Condition: ALERT_TEMPERATURE_SENSOR_FAILED, Detail: "temperature sensor " + r.Id})
+	}
+	if r.Cutoff && s.state == STATE_IDLE {
+		Publish(t.bus, EndSession{})
+	}
+	Publish(t.bus, StateUpdated{})
+}
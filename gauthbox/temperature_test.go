@@ -0,0 +1,152 @@
+package gauthbox
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTemperatureThreshold(t *testing.T) {
+	unreadable := errors.New("unreadable")
+	type step struct {
+		celsius float64
+		err     error
+		// Whether a reading is reported, and its Over, Cutoff and Failed.
+		reported, over, cutoff, failed bool
+	}
+	tests := []struct {
+		name  string
+		c     temperatureConfig
+		steps []step
+	}{{
+		name: "over and back under with hysteresis",
+		c:    temperatureConfig{Id: "spindle", MaxCelsius: 60, OverAction: TEMPERATURE_ACTION_OFF},
+		steps: []step{
+			{celsius: 50, reported: true},
+			{celsius: 61, reported: true, over: true, cutoff: true},
+			{celsius: 59, reported: true, over: true, cutoff: true},
+			{celsius: 57, reported: true},
+		},
+	}, {
+		name: "unreadable fails closed",
+		c:    temperatureConfig{Id: "spindle", MaxCelsius: 60, OverAction: TEMPERATURE_ACTION_OFF},
+		steps: []step{
+			{celsius: 50, reported: true},
+			{err: unreadable},
+			{err: unreadable},
+			{err: unreadable, reported: true, over: true, cutoff: true, failed: true},
+			{err: unreadable, reported: true, over: true, cutoff: true, failed: true},
+			{celsius: 50, reported: true},
+		},
+	}, {
+		name: "unreadable alarms only with the alarm action",
+		c:    temperatureConfig{Id: "enclosure", MaxCelsius: 40, OverAction: TEMPERATURE_ACTION_ALARM},
+		steps: []step{
+			{err: unreadable},
+			{err: unreadable},
+			{err: unreadable, reported: true, over: true, failed: true},
+		},
+	}, {
+		name: "a read in between resets the failures",
+		c:    temperatureConfig{Id: "spindle", MaxCelsius: 60, OverAction: TEMPERATURE_ACTION_OFF},
+		steps: []step{
+			{err: unreadable},
+			{err: unreadable},
+			{celsius: 50, reported: true},
+			{err: unreadable},
+			{err: unreadable},
+		},
+	}, {
+		name: "readable again while over",
+		c:    temperatureConfig{Id: "spindle", MaxCelsius: 60, OverAction: TEMPERATURE_ACTION_OFF},
+		steps: []step{
+			{err: unreadable},
+			{err: unreadable},
+			{err: unreadable, reported: true, over: true, cutoff: true, failed: true},
+			{celsius: 65, reported: true, over: true, cutoff: true},
+		},
+	}, {
+		name: "without threshold, failures are only logged",
+		c:    temperatureConfig{Id: "room"},
+		steps: []step{
+			{err: unreadable},
+			{err: unreadable},
+			{err: unreadable},
+			{err: unreadable},
+			{celsius: 90, reported: true},
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			threshold := temperatureThreshold{c: tt.c, hysteresis: TEMPERATURE_DEFAULT_HYSTERESIS}
+			for i, s := range tt.steps {
+				r, reported := threshold.update(s.celsius, s.err)
+				if reported != s.reported {
+					t.Fatalf("step %d: reported %v, want %v", i, reported, s.reported)
+				}
+				if !reported {
+					continue
+				}
+				if r.Id != tt.c.Id || r.Over != s.over || r.Cutoff != s.cutoff || r.Failed != s.failed {
+					t.Errorf("step %d: got %+v, want over %v, cutoff %v, failed %v", i, r, s.over, s.cutoff, s.failed)
+				}
+			}
+		})
+	}
+}
+
+func TestTemperaturesOnReading(t *testing.T) {
+	type step struct {
+		over, cutoff, failed bool
+		// Whether the reading alerts, ends the session and updates the state.
+		alert, end, updated bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{{
+		name: "over and back under",
+		steps: []step{
+			{},
+			{over: true, cutoff: true, end: true, updated: true},
+			{over: true, cutoff: true},
+			{updated: true},
+			{},
+		},
+	}, {
+		name: "sensor fails while over",
+		steps: []step{
+			{over: true, updated: true},
+			{over: true, failed: true, alert: true, updated: true},
+			{over: true, failed: true},
+			{over: true, updated: true},
+		},
+	}, {
+		name: "sensor fails while over, powering off",
+		steps: []step{
+			{over: true, cutoff: true, end: true, updated: true},
+			{over: true, cutoff: true, failed: true, alert: true, end: true, updated: true},
+			{over: true, cutoff: true, updated: true, end: true},
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := State{state: STATE_IDLE, overheated: map[string]TemperatureReading{}}
+			bus := NewBus()
+			var alert, end, updated bool
+			Subscribe(bus, func(AlertRaised) { alert = true })
+			Subscribe(bus, func(EndSession) { end = true })
+			Subscribe(bus, func(StateUpdated) { updated = true })
+			NewTemperatures(&state).Subscribe(bus)
+			for i, s := range tt.steps {
+				alert, end, updated = false, false, false
+				Publish(bus, TemperatureRead{Reading: TemperatureReading{Id: "spindle", Celsius: 70, Over: s.over, Cutoff: s.cutoff, Failed: s.failed}})
+				if alert != s.alert || end != s.end || updated != s.updated {
+					t.Errorf("step %d: alert %v, end %v, updated %v, want %v, %v, %v", i, alert, end, updated, s.alert, s.end, s.updated)
+				}
+				if r, over := state.overheated["spindle"]; over != s.over || r.Failed != s.failed || state.overheatCutoff() != s.cutoff {
+					t.Errorf("step %d: stored %+v (%v), want over %v, failed %v, cutoff %v", i, r, over, s.over, s.failed, s.cutoff)
+				}
+			}
+		})
+	}
+}
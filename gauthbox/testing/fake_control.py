@@ -34,6 +34,9 @@ async def config(name: str):
             "broker": "mqtt://control.shop:1883",
             "topic": "shop"
         },
+        "events_url": "http://control.shop:8000/events/%s" % name,
+        "check_in_interval_s": 60,
+        "usage_stats": True,
         "idle_duration_s": 5
     }
 
@@ -44,6 +47,32 @@ async def auth(request: Request):
     return {}
 
 
+@app.post('/events/{name}')
+async def events(name: str, request: Request):
+    print(name, await request.json())
+    return {}
+
+
+@app.post('/checkin/{name}')
+async def checkin(name: str, request: Request):
+    print(name, await request.json())
+    return {}
+
+
+@app.post('/usage/{name}')
+async def usage(name: str, request: Request):
+    print(name, await request.json())
+    return {}
+
+
+@app.post('/crash/{name}')
+async def crash(name: str, request: Request):
+    report = await request.json()
+    print(name, report['looper'], report['panic'])
+    print(report['stack'])
+    return {}
+
+
 if __name__ == "__main__":
     import uvicorn
     uvicorn.run('fake_control:app', host="0.0.0.0", port=8000, reload=True)
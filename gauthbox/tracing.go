@@ -0,0 +1,203 @@
+package gauthbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How many finished spans are kept until exported; older ones are dropped.
+const TRACING_QUEUE_SIZE = 512
+const TRACING_EXPORT_INTERVAL = 5 * time.Second
+
+// OpenTelemetry tracing of the badge, auth and config calls, exported as
+// OTLP/JSON over HTTP.
+type tracingConfig struct {
+	// OTLP/HTTP collector base URL, e.g. "http://collector:4318".
+	Endpoint string `json:"endpoint"`
+}
+
+// A timed operation, part of a trace.
+type Span struct {
+	traceId  [16]byte
+	spanId   [8]byte
+	parentId [8]byte
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+}
+
+type spanKey struct{}
+
+// Until tracing is configured, spans are kept, e.g. for fetching the config.
+var tracer = struct {
+	mu      sync.Mutex
+	enabled bool
+	done    []*Span
+}{enabled: true}
+
+// Starts a span, child of the one in ctx if any. End it with End.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	s := &Span{name: name, start: time.Now(), attrs: map[string]string{}}
+	rand.Read(s.spanId[:])
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		s.traceId, s.parentId = parent.traceId, parent.spanId
+	} else {
+		rand.Read(s.traceId[:])
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *Span) SetAttr(key, value string) {
+	s.attrs[key] = value
+}
+
+// Ends the span, failed if err is not nil.
+func (s *Span) End(err error) {
+	s.end, s.err = time.Now(), err
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if !tracer.enabled {
+		return
+	}
+	tracer.done = append(tracer.done, s)
+	if len(tracer.done) > TRACING_QUEUE_SIZE {
+		tracer.done = tracer.done[len(tracer.done)-TRACING_QUEUE_SIZE:]
+	}
+}
+
+// Stops recording spans, as tracing is not configured.
+func DisableTracing() {
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	tracer.enabled, tracer.done = false, nil
+}
+
+type otlpAttr struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func otlpAttrs(attrs map[string]string) []otlpAttr {
+	out := []otlpAttr{}
+	for k, v := range attrs {
+		a := otlpAttr{Key: k}
+		a.Value.StringValue = v
+		out = append(out, a)
+	}
+	return out
+}
+
+type otlpSpan struct {
+	TraceId           string     `json:"traceId"`
+	SpanId            string     `json:"spanId"`
+	ParentSpanId      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes"`
+	Status            struct {
+		// 1 for ok, 2 for error.
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func exportSpans(c tracingConfig, name string, spans []*Span) error {
+	out := []otlpSpan{}
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceId:           hex.EncodeToString(s.traceId[:]),
+			SpanId:            hex.EncodeToString(s.spanId[:]),
+			Name:              s.name,
+			Kind:              1,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttrs(s.attrs),
+		}
+		if s.parentId != [8]byte{} {
+			o.ParentSpanId = hex.EncodeToString(s.parentId[:])
+		}
+		o.Status.Code = 1
+		if s.err != nil {
+			o.Status.Code, o.Status.Message = 2, s.err.Error()
+		}
+		out = append(out, o)
+	}
+	type scope struct {
+		Name string `json:"name"`
+	}
+	type scopeSpans struct {
+		Scope scope      `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	type resource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	}
+	type resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	b, err := json.Marshal(struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}{[]resourceSpans{{
+		Resource:   resource{otlpAttrs(map[string]string{"service.name": "gauthbox", "service.instance.id": name})},
+		ScopeSpans: []scopeSpans{{Scope: scope{"gauthbox"}, Spans: out}},
+	}}})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint+"/v1/traces", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("collector: %s", resp.Status)
+	}
+	return nil
+}
+
+// Tracing export logic. Exports the finished spans every
+// TRACING_EXPORT_INTERVAL; spans that could not be exported are dropped.
+// The looper returns once ctx is done.
+func Tracing(ctx context.Context, name string, c tracingConfig) func() {
+	return func() {
+		for {
+			tracer.mu.Lock()
+			spans := tracer.done
+			tracer.done = nil
+			tracer.mu.Unlock()
+			if len(spans) > 0 {
+				if err := exportSpans(c, name, spans); err != nil {
+					slog.Debug("could not export spans", slog.Int("count", len(spans)), slog.Any("err", err))
+				}
+			}
+			select {
+			case <-time.After(TRACING_EXPORT_INTERVAL):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package gauthbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// State file holding the usage of the current day, so it survives restarts.
+const USAGE_STATE_FILE = "usage.json"
+
+// Usage of a day, as published to MQTT and posted to command & control at
+// '<url>/usage/<name>'. Sessions count towards the day they end.
+type DailyUsage struct {
+	// Local date, e.g. "2024-05-31".
+	Date               string `json:"date"`
+	Sessions           int    `json:"sessions"`
+	OpenAccessSessions int    `json:"open_access_sessions"`
+	UniqueBadges       int    `json:"unique_badges"`
+	// Time spent in use, and badged in overall.
+	ActiveSeconds  int `json:"active_seconds"`
+	SessionSeconds int `json:"session_seconds"`
+	// How many times the machine went in use.
+	Cycles int `json:"cycles"`
+}
+
+// Usage of the current day, as persisted.
+type usageDay struct {
+	DailyUsage
+	// Hashed, like in session summaries.
+	BadgeHashes []string `json:"badge_hashes"`
+}
+
+// Aggregates the session summaries per day.
+type UsageStats struct {
+	mu  sync.Mutex
+	day usageDay
+}
+
+// Returns the stats, resuming the persisted day, if any.
+func NewUsageStats() *UsageStats {
+	u := &UsageStats{}
+	if b, err := os.ReadFile(StatePath(USAGE_STATE_FILE)); err == nil {
+		if err := json.Unmarshal(b, &u.day); err != nil {
+			slog.Warn("could not parse persisted usage", slog.Any("err", err))
+		}
+	}
+	return u
+}
+
+// Closes the current day if t is on another one. Returns the closed day, nil if
+// none or if unused.
+func (u *UsageStats) Roll(t time.Time) *DailyUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.roll(t)
+}
+
+func (u *UsageStats) roll(t time.Time) *DailyUsage {
+	date := t.Format(time.DateOnly)
+	if u.day.Date == date {
+		return nil
+	}
+	closed := u.day.DailyUsage
+	u.day = usageDay{DailyUsage: DailyUsage{Date: date}}
+	u.save()
+	if closed.Date == "" || closed.Sessions == 0 {
+		return nil
+	}
+	return &closed
+}
+
+// Counts the session towards the day it ended. Returns the previous day if
+// this closed it, like Roll.
+func (u *UsageStats) Add(s SessionSummary) *DailyUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	closed := u.roll(s.End)
+	u.day.Sessions++
+	if s.OpenAccess {
+		u.day.OpenAccessSessions++
+	}
+	if s.BadgeHash != "" && !slices.Contains(u.day.BadgeHashes, s.BadgeHash) {
+		u.day.BadgeHashes = append(u.day.BadgeHashes, s.BadgeHash)
+		u.day.UniqueBadges = len(u.day.BadgeHashes)
+	}
+	u.day.ActiveSeconds += s.ActiveSeconds
+	u.day.SessionSeconds += s.ActiveSeconds + s.IdleSeconds
+	u.day.Cycles += s.Cycles
+	u.save()
+	return closed
+}
+
+func (u *UsageStats) save() {
+	b, err := json.Marshal(u.day)
+	if err != nil {
+		return
+	}
+	if err := writeStateFile(USAGE_STATE_FILE, b); err != nil {
+		slog.Warn("could not persist usage", slog.Any("err", err))
+	}
+}
+
+// Counts the session summaries, publishing each day as it closes, at midnight
+// or with the first session of the next day. url is as for PublishDailyUsage.
+func (u *UsageStats) Subscribe(bus *Bus, name string, url string, publish PublishFunc) {
+	closed := func(d *DailyUsage) {
+		if d != nil {
+			go PublishDailyUsage(*d, name, url, publish)
+		}
+	}
+	var rollover *BusTimer
+	rollover = bus.NewTimer(func() {
+		rollover.Reset(untilNextDay(Clk.Now()))
+		closed(u.Roll(Clk.Now()))
+	})
+	Subscribe(bus, func(Started) {
+		rollover.Reset(untilNextDay(Clk.Now()))
+		// The box may have been down at midnight.
+		closed(u.Roll(Clk.Now()))
+	})
+	Subscribe(bus, func(s SessionSummary) { closed(u.Add(s)) })
+}
+
+// Publishes the daily usage to MQTT, retained, and posts it to command &
+// control if url is not empty.
+func PublishDailyUsage(d DailyUsage, name string, url string, publish PublishFunc) {
+	slog.Info("daily usage", slog.Any("usage", d))
+	b, err := json.Marshal(d)
+	if err != nil {
+		slog.Error("could not marshal daily usage", slog.Any("err", err))
+		return
+	}
+	publish(name+"/usage", MqttRetained{Payload: string(b)})
+	if url == "" {
+		return
+	}
+	if err := postDailyUsage(url, b); err != nil {
+		slog.Warn("could not post daily usage", slog.Any("err", err))
+	}
+}
+
+func postDailyUsage(url string, b []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("usage endpoint: %s", resp.Status)
+	}
+	return nil
+}